@@ -2,14 +2,18 @@
 package gopanosapi
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,8 +24,12 @@ const _TYPE_OP = "op"
 const _TYPE_CONFIG = "config"
 const _TYPE_REPORT = "report"
 const _TYPE_EXPORT = "export"
+const _TYPE_IMPORT = "import"
+const _TYPE_COMMIT = "commit"
+const _TYPE_LOG = "log"
 const _ACTION_SET = "set"
 const _ACTION_GET = "get"
+const _ACTION_MOVE = "move"
 
 //noinspection GoUnusedConst
 const _ACTION_TERMINATE = "terminate"
@@ -35,8 +43,9 @@ const STATUS_ERROR = "error"
 //	The authetication attributes must de defined either by calling the "SetKey()" or the "KeyGen()" type functions
 type ApiConnector struct {
 	hostname, apikey, PanosVersion string
-	debugMode                      bool
-	httpcon                        *http.Client
+	// debugMode is accessed atomically: UID toggles it while its deliveries run (1 means enabled)
+	debugMode int32
+	httpcon   *http.Client
 	// Target and vsys are useful to extend the query in Panorama and/or vsys scenarios
 	target, vsys string
 	// Contains (if present) the value of the "status" xml attributed returned by the last API call
@@ -47,6 +56,8 @@ type ApiConnector struct {
 	LastResponseMessage string
 	// Contains last operation xml unmarshall error response
 	LastUnmarshallError error
+	// Middleware chain wrapped around every API call (see "Use()")
+	middleware []ApiMiddleware
 }
 
 type keygenResp struct {
@@ -87,10 +98,76 @@ func (gResp *genericResp) normalizeError() string {
 }
 
 type uidResp struct {
-	XMLName       xml.Name  `xml:"response"`
-	Status        string    `xml:"status,attr"`
-	ResultData    xmlResult `xml:"result"`
-	MsgLoginValue string    `xml:"msg>line>uid-response>payload>login>entry>message,attr"`
+	XMLName    xml.Name  `xml:"response"`
+	Status     string    `xml:"status,attr"`
+	Code       string    `xml:"code,attr"`
+	ResultData xmlResult `xml:"result"`
+	MsgNode    struct {
+		Line []struct {
+			Text    string             `xml:",chardata"`
+			Payload uidResponsePayload `xml:"uid-response>payload"`
+		} `xml:"line"`
+	} `xml:"msg"`
+}
+
+// uidResponsePayload holds the entries rejected by the device, grouped by payload section
+type uidResponsePayload struct {
+	Sections []struct {
+		XMLName xml.Name
+		Entries []struct {
+			Name    string `xml:"name,attr"`
+			Ip      string `xml:"ip,attr"`
+			User    string `xml:"user,attr"`
+			Message string `xml:"message,attr"`
+		} `xml:"entry"`
+	} `xml:",any"`
+}
+
+func (uResp *uidResp) failures() []UidFailure {
+	var failures []UidFailure
+	for _, line := range uResp.MsgNode.Line {
+		for _, section := range line.Payload.Sections {
+			for _, entry := range section.Entries {
+				failures = append(failures, UidFailure{Section: section.XMLName.Local,
+					Name: entry.Name, Ip: entry.Ip, User: entry.User, Message: entry.Message})
+			}
+		}
+	}
+	return failures
+}
+
+func (uResp *uidResp) message() string {
+	for _, failure := range uResp.failures() {
+		if failure.Message != "" {
+			return failure.Message
+		}
+	}
+	var norM string
+	for _, line := range uResp.MsgNode.Line {
+		if text := strings.TrimSpace(line.Text); text != "" {
+			norM = norM + "\n" + text
+		}
+	}
+	return strings.TrimPrefix(norM, "\n")
+}
+
+// UidFailure describes an entry of a uid-message rejected by the device
+type UidFailure struct {
+	// Section is the payload section of the entry (login, logout, register, ...)
+	Section        string
+	Name, Ip, User string
+	Message        string
+}
+
+// UidResult is the outcome of a "SendUid()" call
+type UidResult struct {
+	Status, Code, Message string
+	Failures              []UidFailure
+}
+
+type statusResp struct {
+	Status string `xml:"status,attr"`
+	Code   string `xml:"code,attr"`
 }
 
 type xmlResult struct {
@@ -124,13 +201,13 @@ type reportResp struct {
 }
 
 func (apiC *ApiConnector) trace(message string) {
-	if apiC.debugMode {
+	if atomic.LoadInt32(&apiC.debugMode) != 0 {
 		log.Println(message)
 	}
 }
 
 func (apiC *ApiConnector) traceResponse() {
-	if apiC.debugMode {
+	if atomic.LoadInt32(&apiC.debugMode) != 0 {
 		log.Println("ApiConnector: response message = " + apiC.LastResponseMessage)
 		log.Println("ApiConnector: response statusCode = " + apiC.LastStatusCode)
 		log.Println("ApiConnector: response status = " + apiC.LastStatus)
@@ -147,6 +224,21 @@ func (apiC *ApiConnector) SetVys(vsys string) {
 	apiC.vsys = vsys
 }
 
+// WithTarget returns a copy of the connector (sharing credentials, transport and middleware) bound to the
+// provided target device serial and vsys. Empty values keep the ones of the original connector.
+// Useful to send User-ID updates through Panorama or to several vsys (see "UID.AddDestination()").
+func (apiC *ApiConnector) WithTarget(serial, vsys string) *ApiConnector {
+	c := *apiC
+	c.middleware = c.middleware[:len(c.middleware):len(c.middleware)]
+	if serial != "" {
+		c.target = serial
+	}
+	if vsys != "" {
+		c.vsys = vsys
+	}
+	return &c
+}
+
 func (apiC *ApiConnector) addParams(q *url.Values) {
 	if apiC.target != "" {
 		q.Add("target", apiC.target)
@@ -156,6 +248,74 @@ func (apiC *ApiConnector) addParams(q *url.Values) {
 	}
 }
 
+// call runs the query through the middleware chain and returns the raw response body.
+// Every API method must use it instead of talking to httpcon directly.
+func (apiC *ApiConnector) call(q url.Values) ([]byte, error) {
+	return apiC.upload(q, nil)
+}
+
+// upload is "call()" sending file along with the query (if not nil)
+func (apiC *ApiConnector) upload(q url.Values, file *ApiFile) ([]byte, error) {
+	params := url.Values{}
+	for k, v := range q {
+		params[k] = append([]string(nil), v...)
+	}
+	apiCall := &ApiCall{Host: apiC.hostname, Type: q.Get("type"), Action: q.Get("action"), Params: params, File: file}
+	handler := apiC.send
+	for i := len(apiC.middleware) - 1; i >= 0; i-- {
+		handler = nonNilResult(apiC.middleware[i](handler))
+	}
+	result := handler(apiCall)
+	if result.Err != nil {
+		apiC.LastStatus = _comsErrorCode
+		apiC.LastStatusCode = _comsError
+		return nil, result.Err
+	}
+	return result.Body, nil
+}
+
+// send is the innermost ApiHandler. It posts the call to the device.
+func (apiC *ApiConnector) send(apiCall *ApiCall) *ApiResult {
+	result := &ApiResult{}
+	start := time.Now()
+	var res *http.Response
+	var err error
+	if apiCall.File != nil {
+		res, err = apiC.postFile(apiCall)
+	} else {
+		res, err = apiC.httpcon.PostForm("https://"+apiCall.Host+_apiPath, apiCall.Params)
+	}
+	if err != nil {
+		result.Latency = time.Since(start)
+		result.Err = err
+		return result
+	}
+	result.Body, result.Err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	result.Latency = time.Since(start)
+	var sResp statusResp
+	if xml.Unmarshal(result.Body, &sResp) == nil {
+		result.Status = sResp.Status
+		result.StatusCode = sResp.Code
+	}
+	return result
+}
+
+// postFile posts apiCall.File as a multipart form, with the API parameters in the query string
+func (apiC *ApiConnector) postFile(apiCall *ApiCall) (*http.Response, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", apiCall.File.Name)
+	if err != nil {
+		return nil, err
+	}
+	part.Write(apiCall.File.Content)
+	if err = form.Close(); err != nil {
+		return nil, err
+	}
+	return apiC.httpcon.Post("https://"+apiCall.Host+_apiPath+apiCall.Params.Encode(), form.FormDataContentType(), &body)
+}
+
 func (apiC *ApiConnector) reportUninit() error {
 	apiC.trace("ApiConnector: RESTFul call without a valid API KEY. Try calling \"SetKey()\" or \"KeyGen\" first.")
 	return errors.New("no valid API KEY present")
@@ -169,11 +329,9 @@ func (apiC *ApiConnector) grabPanosRelease() error {
 	if apiC.LastStatus != STATUS_OK {
 		return errors.New(apiC.LastResponseMessage)
 	}
-	var panosVersion struct {
-		PANOSRelease string `xml:"sw-version"`
+	if info, err := ParseResult(data); err == nil {
+		apiC.PanosVersion = info.Value("system/sw-version")
 	}
-	xml.Unmarshal(data, &panosVersion)
-	apiC.PanosVersion = panosVersion.PANOSRelease
 	return nil
 }
 
@@ -189,10 +347,28 @@ func (apiC *ApiConnector) Init(Hname string) {
 	apiC.hostname = Hname
 }
 
+// SetTransport replaces the http.RoundTripper used to reach the device (i.e. a proxy aware transport,
+// a "Recorder" or a "Replayer"). It must be called after "Init()".
+func (apiC *ApiConnector) SetTransport(rt http.RoundTripper) {
+	apiC.httpcon.Transport = rt
+}
+
+// Transport returns the http.RoundTripper currently used to reach the device (nil before "Init()")
+func (apiC *ApiConnector) Transport() http.RoundTripper {
+	if apiC.httpcon == nil {
+		return nil
+	}
+	return apiC.httpcon.Transport
+}
+
 // Debug turns on or off the logging capabilities of the package.
-// Log traces will appear in stderr.
+// Log traces will appear in stderr. It is safe to call while API calls are running.
 func (apiC *ApiConnector) Debug(debug bool) {
-	apiC.debugMode = debug
+	var mode int32
+	if debug {
+		mode = 1
+	}
+	atomic.StoreInt32(&apiC.debugMode, mode)
 }
 
 // SetKey will update the ApiConnector unexported apikey field with the provided API access KEY.
@@ -216,14 +392,10 @@ func (apiC *ApiConnector) Keygen(username, password string) error {
 	q.Set("type", _TYPE_KEYGEN)
 	q.Add("user", username)
 	q.Add("password", password)
-	res, err := apiC.httpcon.PostForm("https://"+apiC.hostname+_apiPath, q)
+	xmlresponse, err := apiC.call(q)
 	if err != nil {
-		apiC.LastStatus = _comsErrorCode
-		apiC.LastStatusCode = _comsError
 		return err
 	}
-	xmlresponse, _ := ioutil.ReadAll(res.Body)
-	res.Body.Close()
 	var kResp keygenResp
 	xml.Unmarshal(xmlresponse, &kResp)
 	apiC.LastStatusCode = kResp.Code
@@ -241,6 +413,30 @@ func (apiC *ApiConnector) Keygen(username, password string) error {
 // Users might be interested in the UID type in the panos package for a
 // high level interface to the User-ID API framework
 func (apiC *ApiConnector) Uid(payload string) ([]byte, error) {
+	uidResp, err := apiC.uidCall(payload)
+	if err != nil {
+		return nil, err
+	}
+	return uidResp.ResultData.XmlResult, nil
+}
+
+// SendUid sends a uid-message payload and reports the outcome, including the entries rejected by the device.
+// A non nil error is returned if the payload could not be delivered or was rejected (status different
+// from "success"). The UidResult is available whenever the device response could be parsed.
+func (apiC *ApiConnector) SendUid(payload string) (*UidResult, error) {
+	uidResp, err := apiC.uidCall(payload)
+	if err != nil {
+		return nil, err
+	}
+	result := &UidResult{Status: uidResp.Status, Code: uidResp.Code, Message: uidResp.message(),
+		Failures: uidResp.failures()}
+	if result.Status != STATUS_OK {
+		return result, errors.New("uid-message rejected: " + result.Message)
+	}
+	return result, nil
+}
+
+func (apiC *ApiConnector) uidCall(payload string) (*uidResp, error) {
 	if apiC.apikey == "" {
 		return nil, apiC.reportUninit()
 	}
@@ -252,14 +448,10 @@ func (apiC *ApiConnector) Uid(payload string) ([]byte, error) {
 	q.Add("key", apiC.apikey)
 	q.Add("cmd", payload)
 	apiC.addParams(&q)
-	res, err := apiC.httpcon.PostForm("https://"+apiC.hostname+_apiPath, q)
+	xmlresponse, err := apiC.call(q)
 	if err != nil {
-		apiC.LastStatus = _comsErrorCode
-		apiC.LastStatusCode = _comsError
 		return nil, err
 	}
-	xmlresponse, _ := ioutil.ReadAll(res.Body)
-	res.Body.Close()
 	apiC.trace("ApiConnector.Uid: response\n...\n" + string(xmlresponse) + "\n...\n")
 	apiC.LastUnmarshallError = xml.Unmarshal(xmlresponse, &uidResp)
 	if apiC.LastUnmarshallError != nil {
@@ -268,9 +460,9 @@ func (apiC *ApiConnector) Uid(payload string) ([]byte, error) {
 	}
 	apiC.LastStatus = uidResp.Status
 	apiC.LastStatusCode = ""
-	apiC.LastResponseMessage = uidResp.MsgLoginValue
+	apiC.LastResponseMessage = uidResp.message()
 	apiC.traceResponse()
-	return uidResp.ResultData.XmlResult, nil
+	return &uidResp, nil
 }
 
 // Op provides a low-level access to the operational functions of a PANOS device.
@@ -285,14 +477,10 @@ func (apiC *ApiConnector) Op(cmd string) ([]byte, error) {
 	q.Add("cmd", cmd)
 	q.Add("key", apiC.apikey)
 	apiC.addParams(&q)
-	res, err := apiC.httpcon.PostForm("https://"+apiC.hostname+_apiPath, q)
+	xmlresponse, err := apiC.call(q)
 	if err != nil {
-		apiC.LastStatus = _comsErrorCode
-		apiC.LastStatusCode = _comsError
 		return nil, err
 	}
-	xmlresponse, _ := ioutil.ReadAll(res.Body)
-	res.Body.Close()
 	apiC.trace("ApiConnector.Op: response\n...\n" + string(xmlresponse) + "\n...\n")
 	apiC.LastUnmarshallError = xml.Unmarshal(xmlresponse, &opResp)
 	if apiC.LastUnmarshallError != nil {
@@ -336,14 +524,10 @@ func (apiC *ApiConnector) Config(action int, xpathValue string, elementValue str
 	}
 	q.Add("key", apiC.apikey)
 	apiC.addParams(&q)
-	res, err := apiC.httpcon.PostForm("https://"+apiC.hostname+_apiPath, q)
+	xmlresponse, err := apiC.call(q)
 	if err != nil {
-		apiC.LastStatus = _comsErrorCode
-		apiC.LastStatusCode = _comsError
 		return nil, err
 	}
-	xmlresponse, _ := ioutil.ReadAll(res.Body)
-	res.Body.Close()
 	apiC.trace("ApiConnector.Config: response\n...\n" + string(xmlresponse) + "\n...\n")
 	apiC.LastUnmarshallError = xml.Unmarshal(xmlresponse, &cfgResp)
 	if apiC.LastUnmarshallError != nil {
@@ -357,6 +541,41 @@ func (apiC *ApiConnector) Config(action int, xpathValue string, elementValue str
 	return cfgResp.XmlData.XmlResult, nil
 }
 
+// ConfigMove moves the configuration node at xpathValue (i.e. a security rule) to where ("top", "bottom",
+// "before" or "after"). dst is the name of the sibling entry used by "before" and "after".
+func (apiC *ApiConnector) ConfigMove(xpathValue, where, dst string) ([]byte, error) {
+	if apiC.apikey == "" {
+		return nil, apiC.reportUninit()
+	}
+	apiC.trace("ApiConnector.ConfigMove: called with xpath = " + xpathValue + ", where = " + where + " and dst = " + dst)
+	var cfgResp genericResp
+	q := url.Values{}
+	q.Set("type", _TYPE_CONFIG)
+	q.Add("action", _ACTION_MOVE)
+	q.Add("xpath", xpathValue)
+	q.Add("where", where)
+	if dst != "" {
+		q.Add("dst", dst)
+	}
+	q.Add("key", apiC.apikey)
+	apiC.addParams(&q)
+	xmlresponse, err := apiC.call(q)
+	if err != nil {
+		return nil, err
+	}
+	apiC.trace("ApiConnector.ConfigMove: response\n...\n" + string(xmlresponse) + "\n...\n")
+	apiC.LastUnmarshallError = xml.Unmarshal(xmlresponse, &cfgResp)
+	if apiC.LastUnmarshallError != nil {
+		apiC.trace("ApiConnector.ConfigMove: Error parsing last response")
+		return nil, apiC.LastUnmarshallError
+	}
+	apiC.LastStatus = cfgResp.Status
+	apiC.LastStatusCode = cfgResp.Code
+	apiC.LastResponseMessage = cfgResp.normalizeError()
+	apiC.traceResponse()
+	return cfgResp.XmlData.XmlResult, nil
+}
+
 //noinspection GoUnusedConst,GoUnusedConst
 const (
 	REPORT_DYNAMIC = iota
@@ -390,14 +609,10 @@ func (apiC *ApiConnector) Report(reportType int, reportName string, cmd string,
 	}
 	q.Add("key", apiC.apikey)
 	apiC.addParams(&q)
-	res, err := apiC.httpcon.PostForm("https://"+apiC.hostname+_apiPath, q)
+	xmlresponse, err := apiC.call(q)
 	if err != nil {
-		apiC.LastStatus = _comsErrorCode
-		apiC.LastStatusCode = _comsError
 		return nil, err
 	}
-	xmlresponse, _ := ioutil.ReadAll(res.Body)
-	res.Body.Close()
 	apiC.trace("ApiConnector.Report: response\n...\n" + string(xmlresponse) + "\n...\n")
 	var returnValue []byte
 	switch async {
@@ -441,14 +656,10 @@ func (apiC *ApiConnector) getReportJob(reportType int, jobId string, action stri
 	q.Add("job-id", jobId)
 	apiC.addParams(&q)
 	for {
-		res, err := apiC.httpcon.PostForm("https://"+apiC.hostname+_apiPath, q)
+		xmlresponse, err := apiC.call(q)
 		if err != nil {
-			apiC.LastStatus = _comsErrorCode
-			apiC.LastStatusCode = _comsError
 			return nil, err
 		}
-		xmlresponse, _ := ioutil.ReadAll(res.Body)
-		res.Body.Close()
 		apiC.trace("ApiConnector.getReportJob: response\n...\n" + string(xmlresponse) + "\n...\n")
 		apiC.LastUnmarshallError = xml.Unmarshal(xmlresponse, &reportJResp)
 		if apiC.LastUnmarshallError != nil {
@@ -511,35 +722,12 @@ var exportCategoryMap = [...]string{"certificate",
 	"filter-pcap",
 	"dlp-pcap"}
 
-// Export provides a low-level access to the configuration functions of a PANOS device.
-// TODO: Not done yet
-func (apiC *ApiConnector) Export(exportCategory int, optionalArgs []struct{ arg, value string }) ([]byte, error) {
-	if apiC.apikey == "" {
-		return nil, apiC.reportUninit()
-	}
-	apiC.trace(fmt.Sprintf("ApiConnector.Export: called with exportCategory = %v and optionalArgs = %v\n",
-		exportCategoryMap[exportCategory], optionalArgs))
-	//	var cfgResp genericResp
-	q := url.Values{}
-	q.Set("type", _TYPE_EXPORT)
-	q.Add("category", exportCategoryMap[exportCategory])
-	q.Add("key", apiC.apikey)
-	for _, v := range optionalArgs {
-		q.Add(v.arg, v.value)
+// Export exports a file of exportCategory (one of the EXPORT_ constants) and returns its content. params
+// holds the additional parameters of the category (i.e. "certificate-name" and "format"). See "ExportFile()"
+// for the categories without a constant (i.e. "configuration").
+func (apiC *ApiConnector) Export(exportCategory int, params map[string]string) ([]byte, error) {
+	if exportCategory < 0 || exportCategory >= len(exportCategoryMap) {
+		return nil, errors.New(fmt.Sprint("unknown export category ", exportCategory))
 	}
-	res, err := apiC.httpcon.PostForm("https://"+apiC.hostname+_apiPath, q)
-	if err != nil {
-		apiC.LastStatus = _comsErrorCode
-		apiC.LastStatusCode = _comsError
-		return nil, err
-	}
-	xmlresponse, _ := ioutil.ReadAll(res.Body)
-	res.Body.Close()
-	//	xml.Unmarshal(xmlresponse, &cfgResp)
-	//	apiC.LastStatus = cfgResp.Status
-	//	apiC.LastStatusCode = cfgResp.Code
-	//	apiC.LastResponseMessage = cfgResp.MsgNode.Text
-	//	return cfgResp.XmlData.XmlResult, nil
-	// apiC.traceResponse()
-	return xmlresponse, nil
+	return apiC.ExportFile(exportCategoryMap[exportCategory], params)
 }
@@ -0,0 +1,530 @@
+// Command panxapi is a command line client of the PAN-OS XML API built on the gopanosapi package.
+//
+// Usage:
+//
+//	panxapi [flags] command [arguments]
+//
+// Commands:
+//
+//	keygen                                         generate and print an API key
+//	op <cmd>                                       run an op command, in XML or CLI-style ('show jobs id "4"')
+//	config show|get|delete <xpath>                 read or delete configuration (show reads the running one)
+//	config set|edit <xpath> <element>              change the candidate configuration
+//	config move <xpath> top|bottom|before|after [dst]
+//	config diff [xpath]                            show the candidate changes not committed yet
+//	config revert                                  discard the candidate changes
+//	config save|load <name>                        save or load a named candidate configuration
+//	commit [-wait] [-timeout d] [cmd]              commit the candidate configuration
+//	report [-type t] [-name n] [-async] [cmd]      run a dynamic, predefined or custom report
+//	export [-out file] <category> [param=value]    export a file (i.e. configuration)
+//	import <category> <file> [param=value]         import a file
+//	log [-type t] [-query filter] [-n count] [-timeout d]  query logs
+//	uid login <user> <ip> [timeout]                send User-ID changes (timeout in minutes or as a duration)
+//	uid logout <user> <ip>
+//	uid tag [-timeout seconds] <ip> <tag>...
+//	uid untag <ip> <tag>...
+//
+// The connection settings (hostname, api_key, api_username, api_password, serial and vsys) are read from
+// $HOME/.panrc and ./.panrc, one "name=value" per line. Lines can be tagged ("hostname%lab=10.0.0.1") and
+// selected with -tag. Flags take precedence over .panrc values. The password is not accepted as a flag
+// (it would be visible in the process list): without api_password it is taken from $PANXAPI_PASSWORD
+// or read from the terminal.
+//
+// Results are printed as returned by the device (-o xml), indented (-o pretty) or converted to JSON (-o json).
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+type options struct {
+	tag, host, key, user, serial, vsys string
+	output                             string
+	debug                              bool
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.tag, "tag", "", "`tag` of the .panrc settings to use")
+	flag.StringVar(&opts.host, "host", "", "device `hostname` or address")
+	flag.StringVar(&opts.key, "key", "", "API `key`")
+	flag.StringVar(&opts.user, "user", "", "`user` name for keygen")
+	flag.StringVar(&opts.serial, "serial", "", "`serial` of the Panorama managed device to target")
+	flag.StringVar(&opts.vsys, "vsys", "", "`vsys` to target")
+	flag.StringVar(&opts.output, "o", _formatXml, "output `format`: xml, pretty or json")
+	flag.BoolVar(&opts.debug, "debug", false, "trace the API calls")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: panxapi [flags] keygen|op|config|commit|report|export|import|log|uid [arguments]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	commands := map[string]func(*options, []string) error{
+		"keygen": keygen,
+		"op":     op,
+		"config": config,
+		"commit": commit,
+		"report": report,
+		"export": export,
+		"import": importFile,
+		"log":    logQuery,
+		"uid":    uid,
+	}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "panxapi: unknown command "+flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := command(&opts, flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "panxapi: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// settings merges the .panrc values with the flags
+func (opts *options) settings() (panrc, error) {
+	rc, err := loadPanrc(opts.tag)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range map[string]string{"hostname": opts.host, "api_key": opts.key, "api_username": opts.user,
+		"serial": opts.serial, "vsys": opts.vsys} {
+		if value != "" {
+			rc[name] = value
+		}
+	}
+	if rc["hostname"] == "" {
+		return nil, errors.New("no hostname (use -host or a .panrc file)")
+	}
+	return rc, nil
+}
+
+// connect returns a connector to the device, authenticated with the API key or else the credentials
+func (opts *options) connect() (*gopanosapi.ApiConnector, error) {
+	rc, err := opts.settings()
+	if err != nil {
+		return nil, err
+	}
+	apiC := &gopanosapi.ApiConnector{}
+	apiC.Debug(opts.debug)
+	apiC.Init(rc["hostname"])
+	switch {
+	case rc["api_key"] != "":
+		err = apiC.SetKey(rc["api_key"])
+	case rc["api_username"] != "":
+		var password string
+		if password, err = rc.password(); err == nil {
+			err = apiC.Keygen(rc["api_username"], password)
+		}
+	default:
+		err = errors.New("no API key nor credentials (use -key, -user or a .panrc file)")
+	}
+	if err != nil {
+		return nil, err
+	}
+	apiC.SetTarget(rc["serial"])
+	apiC.SetVys(rc["vsys"])
+	return apiC, nil
+}
+
+// checkStatus turns the error status of the last API call into an error
+func checkStatus(apiC *gopanosapi.ApiConnector) error {
+	if apiC.LastStatus != gopanosapi.STATUS_OK {
+		return errors.New(strings.TrimSpace(apiC.LastResponseMessage))
+	}
+	return nil
+}
+
+// print writes an XML fragment in the output format selected
+func (opts *options) print(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	out, err := format(data, opts.output)
+	if err != nil {
+		return err
+	}
+	fmt.Println(strings.TrimSpace(string(out)))
+	return nil
+}
+
+// params parses "name=value" arguments
+func params(args []string) (map[string]string, error) {
+	values := make(map[string]string, len(args))
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return nil, errors.New("invalid parameter " + arg + " (expected name=value)")
+		}
+		values[arg[:i]] = arg[i+1:]
+	}
+	return values, nil
+}
+
+func usage(text string) error {
+	return errors.New("usage: panxapi " + text)
+}
+
+func keygen(opts *options, args []string) error {
+	rc, err := opts.settings()
+	if err != nil {
+		return err
+	}
+	if rc["api_username"] == "" {
+		return errors.New("keygen requires -user (or api_username in .panrc)")
+	}
+	password, err := rc.password()
+	if err != nil {
+		return err
+	}
+	apiC := &gopanosapi.ApiConnector{}
+	apiC.Debug(opts.debug)
+	apiC.Init(rc["hostname"])
+	if err := apiC.Keygen(rc["api_username"], password); err != nil {
+		return err
+	}
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(apiC.GetKey()))
+	return opts.print([]byte("<key>" + b.String() + "</key>"))
+}
+
+func op(opts *options, args []string) error {
+	if len(args) != 1 {
+		return usage("op <cmd>")
+	}
+	cmd := strings.TrimSpace(args[0])
+	if !strings.HasPrefix(cmd, "<") {
+		var err error
+		if cmd, err = cliToXml(cmd); err != nil {
+			return err
+		}
+	}
+	apiC, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	result, err := apiC.Op(cmd)
+	if err != nil {
+		return err
+	}
+	if err := checkStatus(apiC); err != nil {
+		return err
+	}
+	return opts.print(result)
+}
+
+func config(opts *options, args []string) error {
+	actions := map[string]int{"show": gopanosapi.CONFIG_SHOW, "get": gopanosapi.CONFIG_GET, "set": gopanosapi.CONFIG_SET,
+		"edit": gopanosapi.CONFIG_EDIT, "delete": gopanosapi.CONFIG_DELETE}
+	if len(args) == 0 {
+		return usage("config show|get|set|edit|delete|move|diff|revert|save|load [...]")
+	}
+	switch action := args[0]; action {
+	case "diff", "revert", "save", "load":
+		return configChanges(opts, action, args[1:])
+	}
+	if len(args) < 2 {
+		return usage("config show|get|set|edit|delete|move <xpath> [...]")
+	}
+	apiC, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	var result []byte
+	switch action := args[0]; action {
+	case "show", "get", "delete":
+		if len(args) != 2 {
+			return usage("config " + action + " <xpath>")
+		}
+		result, err = apiC.Config(actions[action], args[1], "")
+	case "set", "edit":
+		if len(args) != 3 {
+			return usage("config " + action + " <xpath> <element>")
+		}
+		result, err = apiC.Config(actions[action], args[1], args[2])
+	case "move":
+		if len(args) != 3 && len(args) != 4 {
+			return usage("config move <xpath> top|bottom|before|after [dst]")
+		}
+		dst := ""
+		if len(args) == 4 {
+			dst = args[3]
+		}
+		result, err = apiC.ConfigMove(args[1], args[2], dst)
+	default:
+		return errors.New("unknown config action " + action)
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkStatus(apiC); err != nil {
+		return err
+	}
+	return opts.print(result)
+}
+
+// configChanges previews, reverts, saves or loads the candidate configuration
+func configChanges(opts *options, action string, args []string) error {
+	if (action == "diff" && len(args) > 1) || (action == "revert" && len(args) > 0) ||
+		((action == "save" || action == "load") && len(args) != 1) {
+		return usage("config diff [xpath] | revert | save <name> | load <name>")
+	}
+	apiC, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "revert":
+		return apiC.RevertConfig()
+	case "save":
+		return apiC.SaveConfig(args[0])
+	case "load":
+		return apiC.LoadConfig(args[0])
+	}
+	xpath := ""
+	if len(args) == 1 {
+		xpath = args[0]
+	}
+	changes, err := apiC.PendingChanges(xpath)
+	if err != nil {
+		return err
+	}
+	fmt.Print(gopanosapi.FormatChanges(changes))
+	return nil
+}
+
+// printJob writes the status of a job in the output format selected
+func (opts *options) printJob(job *gopanosapi.JobStatus) error {
+	data, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"job"`
+		*gopanosapi.JobStatus
+	}{JobStatus: job})
+	if err != nil {
+		return err
+	}
+	return opts.print(data)
+}
+
+func commit(opts *options, args []string) error {
+	flags := flag.NewFlagSet("commit", flag.ContinueOnError)
+	wait := flags.Bool("wait", false, "wait for the commit job to finish")
+	timeout := flags.Duration("timeout", 0, "maximum `time` to wait (no limit if zero)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return usage("commit [-wait] [-timeout d] [cmd]")
+	}
+	apiC, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	id, err := apiC.Commit(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		fmt.Fprintln(os.Stderr, "panxapi: no changes to commit")
+		return nil
+	}
+	if !*wait {
+		return opts.print([]byte("<job>" + id + "</job>"))
+	}
+	job, err := apiC.WaitJob(id, *timeout)
+	if job != nil {
+		if printErr := opts.printJob(job); printErr != nil {
+			return printErr
+		}
+	}
+	return err
+}
+
+func report(opts *options, args []string) error {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	reportType := flags.String("type", "dynamic", "report `type`: dynamic, predefined or custom")
+	name := flags.String("name", "", "report `name`")
+	async := flags.Bool("async", false, "run the report as a job")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	types := map[string]int{"dynamic": gopanosapi.REPORT_DYNAMIC, "predefined": gopanosapi.REPORT_PREDEFINED,
+		"custom": gopanosapi.REPORT_CUSTOM}
+	t, ok := types[*reportType]
+	if !ok || flags.NArg() > 1 {
+		return usage("report [-type dynamic|predefined|custom] [-name name] [-async] [cmd]")
+	}
+	apiC, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	result, err := apiC.Report(t, *name, flags.Arg(0), *async)
+	if err != nil {
+		return err
+	}
+	if err := checkStatus(apiC); err != nil {
+		return err
+	}
+	return opts.print(result)
+}
+
+func export(opts *options, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := flags.String("out", "", "`file` to write (standard output if empty)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return usage("export [-out file] <category> [param=value ...]")
+	}
+	extra, err := params(flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	apiC, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	content, err := apiC.ExportFile(flags.Arg(0), extra)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(content)
+		return err
+	}
+	return ioutil.WriteFile(*out, content, 0600)
+}
+
+func importFile(opts *options, args []string) error {
+	if len(args) < 2 {
+		return usage("import <category> <file> [param=value ...]")
+	}
+	extra, err := params(args[2:])
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	apiC, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	return apiC.Import(args[0], filepath.Base(args[1]), content, extra)
+}
+
+func logQuery(opts *options, args []string) error {
+	flags := flag.NewFlagSet("log", flag.ContinueOnError)
+	logType := flags.String("type", "traffic", "log `type` (traffic, threat, system, config, ...)")
+	query := flags.String("query", "", "log `filter`")
+	count := flags.Int("n", 0, "maximum `number` of entries (device default if zero)")
+	timeout := flags.Duration("timeout", 5*time.Minute, "maximum `time` to wait for the log job (no limit if zero)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usage("log [-type type] [-query filter] [-n count] [-timeout d]")
+	}
+	apiC, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	result, err := apiC.Log(*logType, *query, *count, *timeout)
+	if err != nil {
+		return err
+	}
+	return opts.print(result)
+}
+
+// loginTimeout parses a login timeout in minutes ("60") or as a duration ("8h")
+func loginTimeout(value string) (time.Duration, error) {
+	if minutes, err := strconv.Atoi(value); err == nil && minutes >= 0 {
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func uid(opts *options, args []string) error {
+	if len(args) == 0 {
+		return usage("uid login|logout|tag|untag [arguments]")
+	}
+	flags := flag.NewFlagSet("uid "+args[0], flag.ContinueOnError)
+	tagTimeout := flags.Int("timeout", 0, "tag registration timeout in `seconds` (none if zero)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	rest := flags.Args()
+	var queue func(u *gopanosapi.UID)
+	switch args[0] {
+	case "login":
+		if len(rest) != 2 && len(rest) != 3 {
+			return usage("uid login <user> <ip> [timeout]")
+		}
+		var timeout time.Duration
+		if len(rest) == 3 {
+			var err error
+			if timeout, err = loginTimeout(rest[2]); err != nil {
+				return errors.New("invalid timeout " + rest[2])
+			}
+		}
+		queue = func(u *gopanosapi.UID) { u.AddLogin(rest[0], rest[1], timeout) }
+	case "logout":
+		if len(rest) != 2 {
+			return usage("uid logout <user> <ip>")
+		}
+		queue = func(u *gopanosapi.UID) { u.AddLogout(rest[0], rest[1]) }
+	case "tag":
+		if len(rest) < 2 {
+			return usage("uid tag [-timeout seconds] <ip> <tag> ...")
+		}
+		timeout := time.Duration(*tagTimeout) * time.Second
+		queue = func(u *gopanosapi.UID) { u.RegisterTags(rest[0], timeout, rest[1:]...) }
+	case "untag":
+		if len(rest) < 2 {
+			return usage("uid untag <ip> <tag> ...")
+		}
+		queue = func(u *gopanosapi.UID) { u.UnregisterTags(rest[0], rest[1:]...) }
+	default:
+		return errors.New("unknown uid action " + args[0])
+	}
+	apiC, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	u, err := gopanosapi.NewUID(apiC)
+	if err != nil {
+		return err
+	}
+	u.SetSynchronous(true)
+	u.SetRetryPolicy(0, 0, 0)
+	if err := u.Start(); err != nil {
+		return err
+	}
+	defer u.Close(context.Background())
+	queue(u)
+	results, err := u.Flush(context.Background())
+	for _, result := range results {
+		for _, failure := range result.Failures {
+			entry := strings.TrimSpace(strings.Join([]string{failure.Name, failure.User, failure.Ip}, " "))
+			fmt.Fprintln(os.Stderr, "panxapi: "+failure.Section+" "+entry+": "+failure.Message)
+		}
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+// cliToXml converts a CLI-style op command into its XML form. Every word is an element nested in the
+// previous one; double quoted words are the text of the previous element:
+//
+//	show jobs id "4"   =>   <show><jobs><id>4</id></jobs></show>
+//
+// Words following a quoted value open a sibling of the element holding the value.
+func cliToXml(cmd string) (string, error) {
+	words, err := splitWords(cmd)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	var open []string
+	for i, word := range words {
+		if word.quoted {
+			if len(open) == 0 || (i > 0 && words[i-1].quoted) {
+				return "", errors.New("value \"" + word.text + "\" does not follow an element")
+			}
+			xml.EscapeText(&b, []byte(word.text))
+			last := open[len(open)-1]
+			open = open[:len(open)-1]
+			b.WriteString("</" + last + ">")
+			continue
+		}
+		b.WriteString("<" + word.text + ">")
+		open = append(open, word.text)
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+	return b.String(), nil
+}
+
+type word struct {
+	text   string
+	quoted bool
+}
+
+func splitWords(cmd string) ([]word, error) {
+	var words []word
+	for cmd = strings.TrimSpace(cmd); cmd != ""; cmd = strings.TrimSpace(cmd) {
+		if cmd[0] == '"' {
+			end := strings.Index(cmd[1:], "\"")
+			if end < 0 {
+				return nil, errors.New("unterminated quote in command")
+			}
+			words = append(words, word{text: cmd[1 : end+1], quoted: true})
+			cmd = cmd[end+2:]
+			continue
+		}
+		end := strings.IndexAny(cmd, " \t\"")
+		if end < 0 {
+			end = len(cmd)
+		}
+		words = append(words, word{text: cmd[:end]})
+		cmd = cmd[end:]
+	}
+	return words, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+// Output formats
+const (
+	_formatXml    = "xml"
+	_formatPretty = "pretty"
+	_formatJson   = "json"
+)
+
+// format renders the XML fragment data (i.e. the content of a <result> element) in the requested format
+func format(data []byte, outputFormat string) ([]byte, error) {
+	switch outputFormat {
+	case _formatXml:
+		return data, nil
+	case _formatPretty:
+		return indentXml(data)
+	case _formatJson:
+		value, err := gopanosapi.XmlToMap(data)
+		if err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(value, "", "  ")
+	}
+	return nil, errors.New("unknown output format " + outputFormat)
+}
+
+func indentXml(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var b bytes.Buffer
+	encoder := xml.NewEncoder(&b)
+	encoder.Indent("", "  ")
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if text, ok := token.(xml.CharData); ok && len(bytes.TrimSpace(text)) == 0 {
+			continue
+		}
+		if err := encoder.EncodeToken(xml.CopyToken(token)); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Environment variable holding the password for keygen when .panrc has none
+const _passwordEnv = "PANXAPI_PASSWORD"
+
+// panrc holds the connection settings read from .panrc files
+type panrc map[string]string
+
+// loadPanrc reads $HOME/.panrc and then ./.panrc (whose values take precedence).
+// Lines are "name=value" or "name%tag=value"; with a tag only the lines of that tag are used.
+func loadPanrc(tag string) (panrc, error) {
+	rc := panrc{}
+	var paths []string
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".panrc"))
+	}
+	paths = append(paths, ".panrc")
+	for _, path := range paths {
+		if err := rc.read(path, tag); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (rc panrc) read(path, tag string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		lineTag := ""
+		if j := strings.Index(name, "%"); j >= 0 {
+			name, lineTag = name[:j], name[j+1:]
+		}
+		if lineTag == tag {
+			rc[name] = value
+		}
+	}
+	return scanner.Err()
+}
+
+// password returns the password for keygen: api_password, $PANXAPI_PASSWORD or else the one typed in the terminal
+func (rc panrc) password() (string, error) {
+	if password := rc["api_password"]; password != "" {
+		return password, nil
+	}
+	if password := os.Getenv(_passwordEnv); password != "" {
+		return password, nil
+	}
+	return readPassword("Password for " + rc["api_username"] + ": ")
+}
+
+// readPassword prompts on stderr and reads a line from stdin, without echoing it if stdin is a terminal
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 && stty("-echo") == nil {
+		defer fmt.Fprintln(os.Stderr)
+		defer stty("echo")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("no password (use api_password in .panrc or $" + _passwordEnv + ")")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// stty changes the settings of the terminal attached to stdin
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,244 @@
+package gopanosapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Conversion between the XML returned by the API and maps (or JSON) following the PAN-OS conventions:
+//   - elements become objects keyed by child name and repeated children become arrays
+//   - "entry" and "member" children are always arrays, even if there is only one
+//   - attributes are keys prefixed with "@" (i.e. "@name" of entries)
+//   - elements with only text become strings and empty elements become nil (null in JSON)
+//   - the text of elements with attributes or children is kept under "#text"
+//
+// So "<entry name="a"><tag><member>x</member></tag></entry>" becomes
+// {"entry": [{"@name": "a", "tag": {"member": ["x"]}}]}. The conversion back gives an equivalent XML, not
+// always the same: maps have no order, so children of different names are written in alphabetical order
+// and the text of elements with children is written before them. Repeated children (i.e. the entries of
+// a rulebase) keep their order.
+
+// Names of the children always converted to arrays
+var xmlLists = map[string]bool{"entry": true, "member": true}
+
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     bytes.Buffer
+}
+
+// XmlToMap converts an XML fragment (i.e. the result of "Op()" or "Config()") into a map. A fragment
+// with only text is returned as {"#text": text}.
+func XmlToMap(data []byte) (map[string]interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		current := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			child := &xmlNode{name: t.Name.Local, attrs: t.Attr}
+			current.children = append(current.children, child)
+			stack = append(stack, child)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			current.text.Write(t)
+		}
+	}
+	switch value := root.value().(type) {
+	case map[string]interface{}:
+		return value, nil
+	case string:
+		return map[string]interface{}{"#text": value}, nil
+	}
+	return map[string]interface{}{}, nil
+}
+
+// XmlToJson converts an XML fragment into JSON (see "XmlToMap()")
+func XmlToJson(data []byte) ([]byte, error) {
+	value, err := XmlToMap(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func (node *xmlNode) value() interface{} {
+	text := strings.TrimSpace(node.text.String())
+	if len(node.attrs) == 0 && len(node.children) == 0 {
+		if text == "" {
+			return nil
+		}
+		return text
+	}
+	object := make(map[string]interface{})
+	for _, attr := range node.attrs {
+		object["@"+attr.Name.Local] = attr.Value
+	}
+	count := make(map[string]int, len(node.children))
+	for _, child := range node.children {
+		count[child.name]++
+	}
+	for _, child := range node.children {
+		if count[child.name] > 1 || xmlLists[child.name] {
+			list, _ := object[child.name].([]interface{})
+			object[child.name] = append(list, child.value())
+		} else {
+			object[child.name] = child.value()
+		}
+	}
+	if text != "" {
+		object["#text"] = text
+	}
+	return object
+}
+
+// MapToXml converts a map built as described in "XmlToMap()" into an XML fragment, i.e. the element of
+// "Config()" set and edit actions. Keys are written in alphabetical order (the items of arrays in their
+// own order), so the original order of siblings with different names is not kept. Values can be maps, arrays,
+// strings, numbers (including json.Number), booleans or nil.
+func MapToXml(value map[string]interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := xml.NewEncoder(&b)
+	for _, key := range sortedKeys(value) {
+		if key == "#text" {
+			text, err := xmlText(value[key])
+			if err != nil {
+				return nil, err
+			}
+			if err := encoder.EncodeToken(xml.CharData(text)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "@") {
+			return nil, errors.New("attribute " + key + " outside of an element")
+		}
+		if err := encodeXmlValue(encoder, key, value[key]); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// JsonToXml converts JSON into an XML fragment (see "MapToXml()")
+func JsonToXml(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value map[string]interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return MapToXml(value)
+}
+
+func encodeXmlValue(encoder *xml.Encoder, name string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if _, ok := item.([]interface{}); ok {
+				return errors.New("nested arrays in " + name)
+			}
+			if err := encodeXmlValue(encoder, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		var text string
+		var children []string
+		for _, key := range sortedKeys(v) {
+			switch {
+			case key == "#text":
+				var err error
+				if text, err = xmlText(v[key]); err != nil {
+					return err
+				}
+			case strings.HasPrefix(key, "@"):
+				attr, err := xmlText(v[key])
+				if err != nil {
+					return err
+				}
+				start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: key[1:]}, Value: attr})
+			default:
+				children = append(children, key)
+			}
+		}
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		if text != "" {
+			if err := encoder.EncodeToken(xml.CharData(text)); err != nil {
+				return err
+			}
+		}
+		for _, key := range children {
+			if err := encodeXmlValue(encoder, key, v[key]); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	}
+	text, err := xmlText(value)
+	if err != nil {
+		return errors.New(name + ": " + err.Error())
+	}
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+	if text != "" {
+		if err := encoder.EncodeToken(xml.CharData(text)); err != nil {
+			return err
+		}
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+// xmlText returns the text of a scalar value
+func xmlText(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	}
+	return "", errors.New("unsupported value type")
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
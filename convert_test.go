@@ -0,0 +1,24 @@
+package gopanosapi
+
+import "testing"
+
+func TestXmlRoundTrip(t *testing.T) {
+	for _, test := range []struct{ in, out string }{
+		{`<entry name="a"><tag><member>x</member></tag></entry>`, `<entry name="a"><tag><member>x</member></tag></entry>`},
+		// entries keep their order
+		{`<entry name="b"/><entry name="a"/>`, `<entry name="b"></entry><entry name="a"></entry>`},
+		// siblings of different names are written in alphabetical order
+		{`<to>any</to><from>any</from><to>dmz</to>`, `<from>any</from><to>any</to><to>dmz</to>`},
+		{`<e>text<c>x</c></e>`, `<e>text<c>x</c></e>`},
+		{`<e><c>x</c>text</e>`, `<e>text<c>x</c></e>`},
+	} {
+		value, err := XmlToMap([]byte(test.in))
+		if err != nil {
+			t.Fatalf("XmlToMap(%s): %v", test.in, err)
+		}
+		out, err := MapToXml(value)
+		if err != nil || string(out) != test.out {
+			t.Errorf("MapToXml(XmlToMap(%s)) = %s, %v, want %s", test.in, out, err, test.out)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package edl
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+// normalize validates the entries of a list of type listType, returning them in the format expected
+// by PAN-OS (sorted, without duplicates) along with the number of invalid entries dropped.
+// Empty lines and comments ("#" or "//") are skipped.
+func normalize(listType string, raw []string) ([]string, int) {
+	seen := make(map[string]struct{}, len(raw))
+	entries := make([]string, 0, len(raw))
+	invalid := 0
+	for _, entry := range raw {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") || strings.HasPrefix(entry, "//") {
+			continue
+		}
+		var ok bool
+		switch listType {
+		case gopanosapi.EDL_IP:
+			entry, ok = normalizeIp(entry)
+		case gopanosapi.EDL_DOMAIN:
+			entry, ok = normalizeDomain(entry)
+		case gopanosapi.EDL_URL:
+			entry, ok = normalizeUrl(entry)
+		}
+		if !ok {
+			invalid++
+			continue
+		}
+		if _, dup := seen[entry]; !dup {
+			seen[entry] = struct{}{}
+			entries = append(entries, entry)
+		}
+	}
+	sort.Strings(entries)
+	return entries, invalid
+}
+
+// normalizeIp accepts addresses, networks ("10.0.0.0/8") and ranges ("10.0.0.1-10.0.0.9")
+func normalizeIp(entry string) (string, bool) {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", false
+		}
+		return network.String(), true
+	}
+	if i := strings.Index(entry, "-"); i > 0 {
+		first, last := net.ParseIP(entry[:i]), net.ParseIP(entry[i+1:])
+		if first == nil || last == nil || (first.To4() == nil) != (last.To4() == nil) {
+			return "", false
+		}
+		if first.To4() != nil {
+			first, last = first.To4(), last.To4()
+		}
+		if bytes.Compare(first, last) > 0 {
+			return "", false
+		}
+		return first.String() + "-" + last.String(), true
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// normalizeDomain accepts host names, optionally prefixed by the "*." wildcard
+func normalizeDomain(entry string) (string, bool) {
+	entry = strings.TrimSuffix(strings.ToLower(entry), ".")
+	name := strings.TrimPrefix(entry, "*.")
+	if name == "" || len(name) > 253 {
+		return "", false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !validLabel(label) {
+			return "", false
+		}
+	}
+	return entry, true
+}
+
+func validLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeUrl accepts URLs without the scheme (it is dropped if present). Host names are lowercased and
+// may contain "*" wildcards; paths are kept as they are.
+func normalizeUrl(entry string) (string, bool) {
+	lower := strings.ToLower(entry)
+	for _, scheme := range []string{"http://", "https://"} {
+		if strings.HasPrefix(lower, scheme) {
+			entry = entry[len(scheme):]
+			break
+		}
+	}
+	host, path := entry, ""
+	if i := strings.Index(entry, "/"); i >= 0 {
+		host, path = entry[:i], entry[i:]
+	}
+	host = strings.ToLower(host)
+	if host == "" || strings.ContainsAny(path, " \t") {
+		return "", false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune(".-_*:[]", c)) {
+			return "", false
+		}
+	}
+	return host + path, true
+}
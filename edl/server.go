@@ -0,0 +1,299 @@
+// Package edl serves External Dynamic Lists (IP, domain and URL lists) to PAN-OS devices.
+//
+// A Server is an http.Handler serving every list at "/<name>" in the format PAN-OS expects: one entry
+// per line, validated against the list type. Entries come from pluggable providers and are updated
+// periodically; responses carry ETag and Last-Modified headers so devices only download changed lists.
+// After an update the Server can make the device fetch the list right away through an ApiConnector:
+//
+//	blocklist := &edl.StaticList{}
+//	server := edl.NewServer()
+//	server.AddList(edl.List{Name: "blocklist", Type: gopanosapi.EDL_IP, Provider: blocklist})
+//	server.SetRefresher(&device)
+//	server.Start(5 * time.Minute)
+//	go http.ListenAndServeTLS(":8443", "cert.pem", "key.pem", server)
+//	blocklist.Set("198.51.100.7", "203.0.113.0/24")
+//	server.Update("blocklist")
+package edl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+// Provider returns the entries of a list
+type Provider interface {
+	Entries() ([]string, error)
+}
+
+// ProviderFunc adapts a function to the Provider interface
+type ProviderFunc func() ([]string, error)
+
+func (f ProviderFunc) Entries() ([]string, error) {
+	return f()
+}
+
+// StaticList is a Provider whose entries are set by the program
+type StaticList struct {
+	lock    sync.Mutex
+	entries []string
+}
+
+// Set replaces the entries of the list
+func (l *StaticList) Set(entries ...string) {
+	l.lock.Lock()
+	l.entries = append([]string(nil), entries...)
+	l.lock.Unlock()
+}
+
+func (l *StaticList) Entries() ([]string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.entries...), nil
+}
+
+// Refresher makes a device fetch an External Dynamic List (*gopanosapi.ApiConnector implements it)
+type Refresher interface {
+	RefreshExternalList(listType, name string) error
+}
+
+var _ Refresher = (*gopanosapi.ApiConnector)(nil)
+
+// List describes a list served by a Server
+type List struct {
+	// Name is the path the list is served at ("/<Name>")
+	Name string
+	// Type is gopanosapi.EDL_IP, gopanosapi.EDL_DOMAIN or gopanosapi.EDL_URL
+	Type     string
+	Provider Provider
+	// Object is the name of the External Dynamic List object refreshed in the device (Name if empty)
+	Object string
+}
+
+// Status describes the last update of a list
+type Status struct {
+	Name, Type string
+	// Entries served and entries dropped by the last update because they were not valid for the list type
+	Entries, Invalid int
+	ETag             string
+	Modified         time.Time
+	// Err is the error of the last update (provider or device refresh)
+	Err error
+}
+
+type servedList struct {
+	config  List
+	content []byte
+	status  Status
+	updated bool
+	// refreshFailed is set when the device could not be refreshed after the last change
+	refreshFailed bool
+}
+
+// Server serves External Dynamic Lists over HTTP
+type Server struct {
+	lock      sync.Mutex
+	lists     map[string]*servedList
+	refresher Refresher
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a Server without lists
+func NewServer() *Server {
+	return &Server{lists: make(map[string]*servedList)}
+}
+
+// AddList adds (or replaces) a list. Its entries are retrieved on the first update or request.
+func (s *Server) AddList(list List) error {
+	switch list.Type {
+	case gopanosapi.EDL_IP, gopanosapi.EDL_DOMAIN, gopanosapi.EDL_URL:
+	default:
+		return errors.New("unknown list type " + list.Type)
+	}
+	if list.Name == "" || strings.Contains(list.Name, "/") {
+		return errors.New("invalid list name " + list.Name)
+	}
+	if list.Provider == nil {
+		return errors.New("list " + list.Name + " has no provider")
+	}
+	if list.Object == "" {
+		list.Object = list.Name
+	}
+	s.lock.Lock()
+	s.lists[list.Name] = &servedList{config: list, status: Status{Name: list.Name, Type: list.Type}}
+	s.lock.Unlock()
+	return nil
+}
+
+// SetRefresher sets the device refreshed after the content of a list changes (none by default)
+func (s *Server) SetRefresher(refresher Refresher) {
+	s.lock.Lock()
+	s.refresher = refresher
+	s.lock.Unlock()
+}
+
+// Status returns the status of the list name (false if there is no such list)
+func (s *Server) Status(name string) (Status, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list, ok := s.lists[name]
+	if !ok {
+		return Status{}, false
+	}
+	return list.status, true
+}
+
+// Update retrieves the entries of the list name from its provider. If the content changed, the
+// device set with "SetRefresher()" is told to fetch the list (not on the first update: there was
+// no content to replace yet). A failed refresh is retried on the next update, even if the content
+// did not change again. On provider errors the previous content keeps being served.
+func (s *Server) Update(name string) error {
+	return s.update(name, true)
+}
+
+// update retrieves the entries of the list name, refreshing the device if the previous content
+// changed and refresh is set (updates triggered by the device fetching the list do not refresh it)
+func (s *Server) update(name string, refresh bool) error {
+	s.lock.Lock()
+	list, ok := s.lists[name]
+	s.lock.Unlock()
+	if !ok {
+		return errors.New("no list named " + name)
+	}
+	raw, err := list.config.Provider.Entries()
+	s.lock.Lock()
+	if s.lists[name] != list {
+		// replaced while updating
+		s.lock.Unlock()
+		return nil
+	}
+	if list.status.Err = err; err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	entries, invalid := normalize(list.config.Type, raw)
+	var content bytes.Buffer
+	for _, entry := range entries {
+		content.WriteString(entry)
+		content.WriteByte('\n')
+	}
+	changed := !list.updated || !bytes.Equal(content.Bytes(), list.content)
+	refresh = refresh && (changed || list.refreshFailed) && list.updated
+	list.status.Entries, list.status.Invalid = len(entries), invalid
+	if changed {
+		sum := sha256.Sum256(content.Bytes())
+		list.content = content.Bytes()
+		list.status.ETag = "\"" + hex.EncodeToString(sum[:16]) + "\""
+		list.status.Modified = time.Now().UTC()
+	}
+	list.updated = true
+	refresher := s.refresher
+	s.lock.Unlock()
+	if !refresh || refresher == nil {
+		return nil
+	}
+	err = refresher.RefreshExternalList(list.config.Type, list.config.Object)
+	s.lock.Lock()
+	list.status.Err, list.refreshFailed = err, err != nil
+	s.lock.Unlock()
+	return err
+}
+
+// UpdateAll updates every list (retrying the failed device refreshes) and returns the first error found
+func (s *Server) UpdateAll() error {
+	s.lock.Lock()
+	names := make([]string, 0, len(s.lists))
+	for name := range s.lists {
+		names = append(names, name)
+	}
+	s.lock.Unlock()
+	var firstErr error
+	for _, name := range names {
+		if err := s.Update(name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Start runs "UpdateAll()" now and every interval until "Stop()" is called
+func (s *Server) Start(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("non-positive update interval")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stop != nil {
+		return errors.New("updates already started")
+	}
+	stop := make(chan struct{})
+	s.stop = stop
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.UpdateAll()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends the periodic updates started by "Start()"
+func (s *Server) Stop() {
+	s.lock.Lock()
+	stop := s.stop
+	s.stop = nil
+	s.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		s.wg.Wait()
+	}
+}
+
+// ServeHTTP serves the list named by the request path. Conditional requests (If-None-Match and
+// If-Modified-Since) get a 304 response when the list did not change.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	s.lock.Lock()
+	list, ok := s.lists[name]
+	updated := ok && list.updated
+	s.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !updated {
+		s.update(name, false)
+	}
+	s.lock.Lock()
+	content, status, updated := list.content, list.status, list.updated
+	s.lock.Unlock()
+	if !updated {
+		http.Error(w, "list not available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("ETag", status.ETag)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, name, status.Modified, bytes.NewReader(content))
+}
@@ -0,0 +1,130 @@
+package edl
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+// refresher counts the lists refreshed. The first failures refreshes fail.
+type refresher struct {
+	lock      sync.Mutex
+	refreshes []string
+	failures  int
+}
+
+func (r *refresher) RefreshExternalList(listType, name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.refreshes = append(r.refreshes, listType+" "+name)
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (r *refresher) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.refreshes)
+}
+
+func newTestServer(t *testing.T) (*Server, *StaticList, *refresher) {
+	t.Helper()
+	list := &StaticList{}
+	list.Set("198.51.100.7")
+	s := NewServer()
+	if err := s.AddList(List{Name: "blocklist", Type: gopanosapi.EDL_IP, Provider: list}); err != nil {
+		t.Fatal(err)
+	}
+	device := &refresher{}
+	s.SetRefresher(device)
+	return s, list, device
+}
+
+func fetch(s *Server) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/blocklist", nil))
+	return w
+}
+
+func TestFetchDoesNotRefresh(t *testing.T) {
+	s, list, device := newTestServer(t)
+	if w := fetch(s); w.Code != http.StatusOK || w.Body.String() != "198.51.100.7\n" {
+		t.Fatalf("first fetch: %d %q", w.Code, w.Body)
+	}
+	if device.count() != 0 {
+		t.Errorf("the fetch of the device refreshed it %d times", device.count())
+	}
+	if err := s.Update("blocklist"); err != nil || device.count() != 0 {
+		t.Errorf("unchanged update: %v, %d refreshes", err, device.count())
+	}
+	list.Set("198.51.100.7", "203.0.113.0/24")
+	if err := s.Update("blocklist"); err != nil || device.count() != 1 {
+		t.Errorf("changed update: %v, %d refreshes", err, device.count())
+	}
+}
+
+func TestFirstUpdateDoesNotRefresh(t *testing.T) {
+	s, list, device := newTestServer(t)
+	if err := s.Update("blocklist"); err != nil || device.count() != 0 {
+		t.Errorf("first update: %v, %d refreshes", err, device.count())
+	}
+	list.Set("203.0.113.0/24")
+	if err := s.Update("blocklist"); err != nil || device.count() != 1 {
+		t.Errorf("changed update: %v, %d refreshes", err, device.count())
+	}
+	if status, _ := s.Status("blocklist"); status.Entries != 1 || status.Err != nil {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestStart(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		if err := s.Start(interval); err == nil {
+			t.Errorf("Start(%v) accepted", interval)
+		}
+	}
+	if err := s.Start(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(time.Minute); err == nil {
+		t.Error("Start() accepted twice")
+	}
+	s.Stop()
+}
+
+func TestFailedRefreshIsRetried(t *testing.T) {
+	s, list, device := newTestServer(t)
+	device.failures = 2
+	if err := s.UpdateAll(); err != nil {
+		t.Fatal(err)
+	}
+	list.Set("203.0.113.0/24")
+	if err := s.UpdateAll(); err == nil || device.count() != 1 {
+		t.Errorf("failed refresh: %v, %d refreshes", err, device.count())
+	}
+	if status, _ := s.Status("blocklist"); status.Err == nil {
+		t.Errorf("status = %+v", status)
+	}
+	// the content did not change again but the device still has to fetch it
+	if err := s.UpdateAll(); err == nil || device.count() != 2 {
+		t.Errorf("first retry: %v, %d refreshes", err, device.count())
+	}
+	if err := s.UpdateAll(); err != nil || device.count() != 3 {
+		t.Errorf("second retry: %v, %d refreshes", err, device.count())
+	}
+	if status, _ := s.Status("blocklist"); status.Err != nil {
+		t.Errorf("status = %+v", status)
+	}
+	if err := s.UpdateAll(); err != nil || device.count() != 3 {
+		t.Errorf("unchanged update after the refresh: %v, %d refreshes", err, device.count())
+	}
+}
@@ -0,0 +1,23 @@
+package gopanosapi
+
+import "errors"
+
+// External Dynamic List types
+const (
+	EDL_IP     = "ip"
+	EDL_DOMAIN = "domain"
+	EDL_URL    = "url"
+)
+
+// RefreshExternalList makes the device fetch the External Dynamic List name of type listType (EDL_IP,
+// EDL_DOMAIN or EDL_URL) right away instead of waiting for its repeat interval
+func (apiC *ApiConnector) RefreshExternalList(listType, name string) error {
+	switch listType {
+	case EDL_IP, EDL_DOMAIN, EDL_URL:
+	default:
+		return errors.New("unknown external list type " + listType)
+	}
+	_, err := apiC.query("<request><system><external-list><refresh><type><"+listType+"><name>"+escapeText(name)+
+		"</name></"+listType+"></type></refresh></external-list></system></request>", nil)
+	return err
+}
@@ -0,0 +1,83 @@
+package gopanosapi
+
+import (
+	"errors"
+	"net/url"
+	"time"
+)
+
+// ApiCall describes a single request to the PANOS XML API as seen by the middleware chain.
+// Type and Action are provided for convenience; the request actually sent is built from
+// Params, so middlewares willing to mutate the request must change Params.
+type ApiCall struct {
+	Host   string
+	Type   string
+	Action string
+	Params url.Values
+	// File is the file uploaded by import calls (nil otherwise)
+	File *ApiFile
+}
+
+// ApiFile is a file uploaded to the device
+type ApiFile struct {
+	Name    string
+	Content []byte
+}
+
+// ApiResult describes the outcome of an ApiCall.
+// Status and StatusCode hold the "status" and "code" attributes of the response element (if any)
+// and Err is only set for communication errors.
+type ApiResult struct {
+	Body       []byte
+	Status     string
+	StatusCode string
+	Latency    time.Duration
+	Err        error
+}
+
+// ApiHandler performs an ApiCall
+type ApiHandler func(apiCall *ApiCall) *ApiResult
+
+// ApiMiddleware wraps an ApiHandler to add behaviour around every API call
+// (Op, Config, Commit, Report, Log, Uid, Export, Import, Keygen and job polling).
+// The handler returned must always return a result: a nil one is turned into a communication error.
+type ApiMiddleware func(next ApiHandler) ApiHandler
+
+// nonNilResult replaces the nil results of handler with an error result, so a faulty middleware
+// does not break the ones wrapping it
+func nonNilResult(handler ApiHandler) ApiHandler {
+	return func(apiCall *ApiCall) *ApiResult {
+		if result := handler(apiCall); result != nil {
+			return result
+		}
+		return &ApiResult{Err: errors.New("API middleware returned no result")}
+	}
+}
+
+// Use appends middlewares to the ApiConnector chain.
+// The first middleware registered is the outermost one.
+func (apiC *ApiConnector) Use(mw ...ApiMiddleware) {
+	apiC.middleware = append(apiC.middleware, mw...)
+}
+
+// OnRequest registers a hook invoked before each request is sent.
+// The hook may modify the call parameters.
+func (apiC *ApiConnector) OnRequest(hook func(apiCall *ApiCall)) {
+	apiC.Use(func(next ApiHandler) ApiHandler {
+		return func(apiCall *ApiCall) *ApiResult {
+			hook(apiCall)
+			return next(apiCall)
+		}
+	})
+}
+
+// OnResponse registers a hook invoked after each response is received (or the call failed)
+func (apiC *ApiConnector) OnResponse(hook func(apiCall *ApiCall, result *ApiResult)) {
+	apiC.Use(func(next ApiHandler) ApiHandler {
+		return func(apiCall *ApiCall) *ApiResult {
+			result := next(apiCall)
+			hook(apiCall, result)
+			return result
+		}
+	})
+}
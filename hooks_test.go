@@ -0,0 +1,92 @@
+package gopanosapi_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+const showSystemInfo = "<show><system><info></info></system></show>"
+
+// tracing returns a middleware appending "name>" to events before calling the next handler and
+// "<name" after it
+func tracing(events *[]string, name string) gopanosapi.ApiMiddleware {
+	return func(next gopanosapi.ApiHandler) gopanosapi.ApiHandler {
+		return func(apiCall *gopanosapi.ApiCall) *gopanosapi.ApiResult {
+			*events = append(*events, name+">")
+			result := next(apiCall)
+			*events = append(*events, "<"+name)
+			return result
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	device, apiC := newDevice(t)
+	var events []string
+	apiC.Use(tracing(&events, "a"), tracing(&events, "b"))
+	apiC.OnRequest(func(apiCall *gopanosapi.ApiCall) {
+		events = append(events, "request "+apiCall.Type)
+		// the request sent is built from the parameters changed by the hooks
+		apiCall.Params.Set("cmd", showSystemInfo)
+	})
+	apiC.OnResponse(func(apiCall *gopanosapi.ApiCall, result *gopanosapi.ApiResult) {
+		events = append(events, "response "+result.Status)
+	})
+	apiC.Use(tracing(&events, "c"))
+	response, err := apiC.Op("<show><clock></clock></show>")
+	if err != nil || !strings.Contains(string(response), device.Hostname) {
+		t.Fatalf("Op() = %s, %v", response, err)
+	}
+	want := []string{"a>", "b>", "request op", "c>", "<c", "response success", "<b", "<a"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	device, apiC := newDevice(t)
+	requests := device.Requests()
+	apiC.Use(func(next gopanosapi.ApiHandler) gopanosapi.ApiHandler {
+		return func(apiCall *gopanosapi.ApiCall) *gopanosapi.ApiResult {
+			return &gopanosapi.ApiResult{Body: []byte(`<response status="success"><result>cached</result></response>`),
+				Status: gopanosapi.STATUS_OK}
+		}
+	})
+	response, err := apiC.Op(showSystemInfo)
+	if err != nil || !strings.Contains(string(response), "cached") {
+		t.Errorf("Op() = %s, %v", response, err)
+	}
+	if device.Requests() != requests {
+		t.Error("the device received a request answered by a middleware")
+	}
+}
+
+func TestNilMiddlewareResult(t *testing.T) {
+	device, apiC := newDevice(t)
+	requests := device.Requests()
+	var seen *gopanosapi.ApiResult
+	apiC.OnResponse(func(apiCall *gopanosapi.ApiCall, result *gopanosapi.ApiResult) { seen = result })
+	// faulty middlewares: one not calling the next handler and one dropping its result
+	apiC.Use(func(next gopanosapi.ApiHandler) gopanosapi.ApiHandler {
+		return func(apiCall *gopanosapi.ApiCall) *gopanosapi.ApiResult {
+			next(apiCall)
+			return nil
+		}
+	})
+	apiC.Use(func(next gopanosapi.ApiHandler) gopanosapi.ApiHandler {
+		return func(apiCall *gopanosapi.ApiCall) *gopanosapi.ApiResult { return nil }
+	})
+	_, err := apiC.Op(showSystemInfo)
+	if err == nil || seen == nil || seen.Err != err {
+		t.Errorf("Op() = %v, result seen by the hook = %+v", err, seen)
+	}
+	if apiC.LastStatusCode != "API_COMSERROR" {
+		t.Errorf("LastStatusCode = %q", apiC.LastStatusCode)
+	}
+	if device.Requests() != requests {
+		t.Error("the device received a request dropped by a middleware")
+	}
+}
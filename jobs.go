@@ -0,0 +1,183 @@
+package gopanosapi
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval between polls of a job status
+const _jobPollInterval = 500 * time.Millisecond
+
+// JobStatus is the status of a device job (commit, download, install, ...) as reported by "show jobs id"
+type JobStatus struct {
+	Id   string `xml:"id"`
+	Type string `xml:"type"`
+	// Status is ACT, PEND or FIN
+	Status string `xml:"status"`
+	// Result is OK or FAIL once finished
+	Result   string   `xml:"result"`
+	Progress string   `xml:"progress"`
+	Details  []string `xml:"details>line"`
+}
+
+// Finished tells whether the job is over
+func (job *JobStatus) Finished() bool {
+	return job.Status == _statusFin
+}
+
+type logJobResp struct {
+	XMLName xml.Name  `xml:"response"`
+	Status  string    `xml:"status,attr"`
+	Job     jobResp   `xml:"result>job"`
+	Log     xmlResult `xml:"result>log"`
+}
+
+// Job returns the status of the job id
+func (apiC *ApiConnector) Job(id string) (*JobStatus, error) {
+	var result struct {
+		Job JobStatus `xml:"job"`
+	}
+	if _, err := apiC.query("<show><jobs><id>"+escapeText(id)+"</id></jobs></show>", &result); err != nil {
+		return nil, err
+	}
+	return &result.Job, nil
+}
+
+// WaitJob polls the job id until it finishes or timeout expires (zero means no limit).
+// Jobs finishing with a FAIL result are reported as errors.
+func (apiC *ApiConnector) WaitJob(id string, timeout time.Duration) (*JobStatus, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		job, err := apiC.Job(id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Finished() {
+			if job.Result == "FAIL" {
+				return job, errors.New("job " + id + " failed: " + strings.Join(job.Details, " "))
+			}
+			return job, nil
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return job, errors.New("timeout waiting for job " + id)
+		}
+		time.Sleep(_jobPollInterval)
+	}
+}
+
+// Commit commits the candidate configuration and returns the id of the commit job (empty if there
+// were no changes to commit). cmd is the commit command, "<commit></commit>" if empty (i.e.
+// "<commit><partial>...</partial></commit>", or "<commit-all>...</commit-all>" in Panorama).
+// Use "WaitJob()" to wait for the commit to finish.
+func (apiC *ApiConnector) Commit(cmd string) (string, error) {
+	if apiC.apikey == "" {
+		return "", apiC.reportUninit()
+	}
+	if cmd == "" {
+		cmd = "<commit></commit>"
+	}
+	apiC.trace("ApiConnector.Commit: called with cmd = " + cmd)
+	q := url.Values{}
+	q.Set("type", _TYPE_COMMIT)
+	if strings.HasPrefix(cmd, "<commit-all>") {
+		q.Add("action", "all")
+	}
+	q.Add("cmd", cmd)
+	q.Add("key", apiC.apikey)
+	apiC.addParams(&q)
+	xmlresponse, err := apiC.call(q)
+	if err != nil {
+		return "", err
+	}
+	apiC.trace("ApiConnector.Commit: response\n...\n" + string(xmlresponse) + "\n...\n")
+	var cResp genericResp
+	apiC.LastUnmarshallError = xml.Unmarshal(xmlresponse, &cResp)
+	if apiC.LastUnmarshallError != nil {
+		apiC.trace("ApiConnector.Commit: Error parsing last response")
+		return "", apiC.LastUnmarshallError
+	}
+	apiC.LastStatus = cResp.Status
+	apiC.LastStatusCode = cResp.Code
+	apiC.LastResponseMessage = cResp.normalizeError()
+	apiC.traceResponse()
+	if cResp.Status != STATUS_OK {
+		return "", errors.New("commit failed: " + apiC.LastResponseMessage)
+	}
+	var job struct {
+		Id string `xml:"result>job"`
+	}
+	xml.Unmarshal(xmlresponse, &job)
+	return job.Id, nil
+}
+
+// Log retrieves the entries of logType ("traffic", "threat", "system", "config", ...) matching query
+// (a log filter, all entries if empty). nlogs limits the number of entries (device default if zero).
+// It returns the <logs> element of the finished log job, or an error if the job does not finish
+// within timeout (no limit if zero).
+func (apiC *ApiConnector) Log(logType, query string, nlogs int, timeout time.Duration) ([]byte, error) {
+	if apiC.apikey == "" {
+		return nil, apiC.reportUninit()
+	}
+	apiC.trace("ApiConnector.Log: called with logType = " + logType + " and query = " + query)
+	q := url.Values{}
+	q.Set("type", _TYPE_LOG)
+	q.Add("log-type", logType)
+	if query != "" {
+		q.Add("query", query)
+	}
+	if nlogs > 0 {
+		q.Add("nlogs", strconv.Itoa(nlogs))
+	}
+	q.Add("key", apiC.apikey)
+	apiC.addParams(&q)
+	xmlresponse, err := apiC.call(q)
+	if err != nil {
+		return nil, err
+	}
+	apiC.trace("ApiConnector.Log: response\n...\n" + string(xmlresponse) + "\n...\n")
+	var jResp asyncResp
+	apiC.LastUnmarshallError = xml.Unmarshal(xmlresponse, &jResp)
+	if apiC.LastUnmarshallError != nil {
+		apiC.trace("ApiConnector.Log: Error parsing last response")
+		return nil, apiC.LastUnmarshallError
+	}
+	apiC.LastStatus = jResp.Status
+	apiC.LastStatusCode = ""
+	apiC.LastResponseMessage = jResp.MsgNode
+	if jResp.Status != STATUS_OK || jResp.JobId == "" {
+		return nil, errors.New("log query failed: " + jResp.MsgNode)
+	}
+	q = url.Values{}
+	q.Set("type", _TYPE_LOG)
+	q.Add("action", _ACTION_GET)
+	q.Add("job-id", jResp.JobId)
+	q.Add("key", apiC.apikey)
+	apiC.addParams(&q)
+	deadline := time.Now().Add(timeout)
+	for {
+		xmlresponse, err = apiC.call(q)
+		if err != nil {
+			return nil, err
+		}
+		var lResp logJobResp
+		apiC.LastUnmarshallError = xml.Unmarshal(xmlresponse, &lResp)
+		if apiC.LastUnmarshallError != nil {
+			apiC.trace("ApiConnector.Log: Error parsing last response")
+			return nil, apiC.LastUnmarshallError
+		}
+		if lResp.Status != STATUS_OK {
+			return nil, errors.New("log job " + jResp.JobId + " failed")
+		}
+		if lResp.Job.Status == _statusFin {
+			return lResp.Log.XmlResult, nil
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return nil, errors.New("timeout waiting for log job " + jResp.JobId)
+		}
+		time.Sleep(_jobPollInterval)
+	}
+}
@@ -0,0 +1,49 @@
+package gopanosapi_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xhoms/gopanosapi"
+	"github.com/xhoms/gopanosapi/panostest"
+)
+
+// newDevice returns an emulated device and a connector to it
+func newDevice(t *testing.T) (*panostest.Server, *gopanosapi.ApiConnector) {
+	t.Helper()
+	device := panostest.NewServer()
+	t.Cleanup(device.Close)
+	apiC := &gopanosapi.ApiConnector{}
+	apiC.Init(device.Host)
+	if err := apiC.Keygen(device.User, device.Password); err != nil {
+		t.Fatal(err)
+	}
+	return device, apiC
+}
+
+func TestLogTimeout(t *testing.T) {
+	device, apiC := newDevice(t)
+	device.SetLogs("traffic", `<entry logid="1"/>`)
+	device.LogDelay = time.Hour
+	if _, err := apiC.Log("traffic", "", 0, time.Millisecond); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Log() = %v, want a timeout", err)
+	}
+	device.LogDelay = 0
+	logs, err := apiC.Log("traffic", "", 0, time.Minute)
+	if err != nil || !strings.Contains(string(logs), `logid="1"`) {
+		t.Errorf("Log() = %s, %v", logs, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	_, apiC := newDevice(t)
+	if _, err := apiC.Export(-1, nil); err == nil {
+		t.Error("Export() accepted an unknown category")
+	}
+	// the emulated device only exports the configuration
+	if _, err := apiC.Export(gopanosapi.EXPORT_CERTIFICATE, map[string]string{"certificate-name": "ca"}); err == nil ||
+		!strings.Contains(err.Error(), "Unsupported export category certificate") {
+		t.Errorf("Export() = %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package gopanosapi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const _metricCounter = "counter"
+const _metricGauge = "gauge"
+const _metricHistogram = "histogram"
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+var batchBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type promSeries struct {
+	labels  string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+type promFamily struct {
+	name, help, kind string
+	bounds           []float64
+	series           map[string]*promSeries
+}
+
+func newPromFamily(name, help, kind string, bounds []float64) *promFamily {
+	return &promFamily{name: name, help: help, kind: kind, bounds: bounds, series: make(map[string]*promSeries)}
+}
+
+// with returns the series identified by the provided label name/value pairs
+func (f *promFamily) with(labels ...string) *promSeries {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(labels[i] + "=\"" + labelEscaper.Replace(labels[i+1]) + "\"")
+	}
+	key := b.String()
+	s, ok := f.series[key]
+	if !ok {
+		s = &promSeries{labels: key, buckets: make([]uint64, len(f.bounds))}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (s *promSeries) observe(bounds []float64, v float64) {
+	for i, bound := range bounds {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.value += v
+	s.count++
+}
+
+func formatLabels(labels, extra string) string {
+	switch {
+	case labels == "" && extra == "":
+		return ""
+	case labels == "":
+		return "{" + extra + "}"
+	case extra == "":
+		return "{" + labels + "}"
+	}
+	return "{" + labels + "," + extra + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (f *promFamily) write(w *bufio.Writer) {
+	if len(f.series) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != _metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(s.labels, ""), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range f.bounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(s.labels, "le=\""+formatFloat(bound)+"\""), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(s.labels, "le=\"+Inf\""), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(s.labels, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(s.labels, ""), s.count)
+	}
+}
+
+// Metrics collects statistics about API calls and User-ID flushing.
+// It does not depend on any metrics library: use "WritePrometheus()" or serve it as an http.Handler
+// to expose the values in the Prometheus text format.
+// A Metrics value must be created with "NewMetrics()" and can be shared by many ApiConnector and UID values.
+type Metrics struct {
+	lock             sync.Mutex
+	apiRequests      *promFamily
+	apiErrors        *promFamily
+	apiRetries       *promFamily
+	apiLatency       *promFamily
+	uidPending       *promFamily
+	uidBatchSize     *promFamily
+	uidFlushDuration *promFamily
+	uidFailures      *promFamily
+}
+
+// NewMetrics returns an empty Metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{
+		apiRequests: newPromFamily("panos_api_requests_total",
+			"Number of PANOS API requests.", _metricCounter, nil),
+		apiErrors: newPromFamily("panos_api_errors_total",
+			"Number of PANOS API requests that failed, by PANOS error code.", _metricCounter, nil),
+		apiRetries: newPromFamily("panos_api_retries_total",
+			"Number of PANOS API requests that were retried.", _metricCounter, nil),
+		apiLatency: newPromFamily("panos_api_request_duration_seconds",
+			"Latency of PANOS API requests.", _metricHistogram, latencyBuckets),
+		uidPending: newPromFamily("panos_uid_pending_changes",
+			"Number of User-ID changes waiting to be flushed.", _metricGauge, nil),
+		uidBatchSize: newPromFamily("panos_uid_flush_batch_size",
+			"Number of entries in each User-ID flush.", _metricHistogram, batchBuckets),
+		uidFlushDuration: newPromFamily("panos_uid_flush_duration_seconds",
+			"Duration of User-ID flushes.", _metricHistogram, latencyBuckets),
+		uidFailures: newPromFamily("panos_uid_flush_failures_total",
+			"Number of User-ID flushes that failed.", _metricCounter, nil),
+	}
+}
+
+// Instrument adds the metrics middleware to the provided ApiConnector
+func (m *Metrics) Instrument(apiC *ApiConnector) {
+	apiC.Use(m.Middleware())
+}
+
+// Middleware returns an ApiMiddleware recording the number, latency and errors of API calls.
+// Requests are labeled with the device hostname and the request type. The UID series use the same
+// device label (the destination name for sinks other than ApiConnector).
+func (m *Metrics) Middleware() ApiMiddleware {
+	return func(next ApiHandler) ApiHandler {
+		return func(apiCall *ApiCall) *ApiResult {
+			result := next(apiCall)
+			m.lock.Lock()
+			m.apiRequests.with("device", apiCall.Host, "type", apiCall.Type).value++
+			m.apiLatency.with("device", apiCall.Host, "type", apiCall.Type).observe(latencyBuckets, result.Latency.Seconds())
+			if result.Err != nil {
+				m.apiErrors.with("device", apiCall.Host, "type", apiCall.Type, "code", _comsError).value++
+			} else if result.Status == STATUS_ERROR {
+				m.apiErrors.with("device", apiCall.Host, "type", apiCall.Type, "code", result.StatusCode).value++
+			}
+			m.lock.Unlock()
+			return result
+		}
+	}
+}
+
+// ObserveRetry records that a request of type reqType to device (the hostname, as in ApiCall.Host) is
+// being retried. UID counts the retries of its deliveries; callers retrying API calls themselves should
+// call it too, as the middleware can not tell a retry from a new request.
+func (m *Metrics) ObserveRetry(device, reqType string) {
+	m.lock.Lock()
+	m.apiRetries.with("device", device, "type", reqType).value++
+	m.lock.Unlock()
+}
+
+func (m *Metrics) setUidPending(device string, pending int) {
+	m.lock.Lock()
+	m.uidPending.with("device", device).value = float64(pending)
+	m.lock.Unlock()
+}
+
+func (m *Metrics) observeUidFlush(device string, batchSize int, duration time.Duration, failed bool) {
+	m.lock.Lock()
+	m.uidBatchSize.with("device", device).observe(batchBuckets, float64(batchSize))
+	m.uidFlushDuration.with("device", device).observe(latencyBuckets, duration.Seconds())
+	if failed {
+		m.uidFailures.with("device", device).value++
+	}
+	m.lock.Unlock()
+}
+
+// WritePrometheus dumps all collected values in the Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m.lock.Lock()
+	for _, f := range []*promFamily{m.apiRequests, m.apiErrors, m.apiRetries, m.apiLatency,
+		m.uidPending, m.uidBatchSize, m.uidFlushDuration, m.uidFailures} {
+		f.write(bw)
+	}
+	m.lock.Unlock()
+	return bw.Flush()
+}
+
+// ServeHTTP makes Metrics usable as a Prometheus scrape endpoint
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
@@ -0,0 +1,190 @@
+package gopanosapi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xhoms/gopanosapi/panostest"
+)
+
+const testExposition = `# HELP panos_api_requests_total Number of PANOS API requests.
+# TYPE panos_api_requests_total counter
+panos_api_requests_total{device="fw1",type="config"} 1
+panos_api_requests_total{device="fw1",type="op"} 2
+panos_api_requests_total{device="fw\"2\\\n",type="op"} 1
+# HELP panos_api_errors_total Number of PANOS API requests that failed, by PANOS error code.
+# TYPE panos_api_errors_total counter
+panos_api_errors_total{device="fw1",type="config",code="API_COMSERROR"} 1
+panos_api_errors_total{device="fw\"2\\\n",type="op",code="17"} 1
+# HELP panos_api_retries_total Number of PANOS API requests that were retried.
+# TYPE panos_api_retries_total counter
+panos_api_retries_total{device="fw1",type="user-id"} 2
+# HELP panos_api_request_duration_seconds Latency of PANOS API requests.
+# TYPE panos_api_request_duration_seconds histogram
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="0.005"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="0.01"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="0.025"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="0.05"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="0.1"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="0.25"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="0.5"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="1"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="2.5"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="5"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="10"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="config",le="+Inf"} 1
+panos_api_request_duration_seconds_sum{device="fw1",type="config"} 0
+panos_api_request_duration_seconds_count{device="fw1",type="config"} 1
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="0.005"} 0
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="0.01"} 0
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="0.025"} 0
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="0.05"} 2
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="0.1"} 2
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="0.25"} 2
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="0.5"} 2
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="1"} 2
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="2.5"} 2
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="5"} 2
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="10"} 2
+panos_api_request_duration_seconds_bucket{device="fw1",type="op",le="+Inf"} 2
+panos_api_request_duration_seconds_sum{device="fw1",type="op"} 0.08
+panos_api_request_duration_seconds_count{device="fw1",type="op"} 2
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="0.005"} 0
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="0.01"} 0
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="0.025"} 0
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="0.05"} 0
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="0.1"} 0
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="0.25"} 0
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="0.5"} 0
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="1"} 0
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="2.5"} 1
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="5"} 1
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="10"} 1
+panos_api_request_duration_seconds_bucket{device="fw\"2\\\n",type="op",le="+Inf"} 1
+panos_api_request_duration_seconds_sum{device="fw\"2\\\n",type="op"} 2
+panos_api_request_duration_seconds_count{device="fw\"2\\\n",type="op"} 1
+# HELP panos_uid_pending_changes Number of User-ID changes waiting to be flushed.
+# TYPE panos_uid_pending_changes gauge
+panos_uid_pending_changes{device="fw1"} 3
+# HELP panos_uid_flush_batch_size Number of entries in each User-ID flush.
+# TYPE panos_uid_flush_batch_size histogram
+panos_uid_flush_batch_size_bucket{device="fw1",le="1"} 0
+panos_uid_flush_batch_size_bucket{device="fw1",le="5"} 0
+panos_uid_flush_batch_size_bucket{device="fw1",le="10"} 1
+panos_uid_flush_batch_size_bucket{device="fw1",le="25"} 1
+panos_uid_flush_batch_size_bucket{device="fw1",le="50"} 1
+panos_uid_flush_batch_size_bucket{device="fw1",le="100"} 1
+panos_uid_flush_batch_size_bucket{device="fw1",le="250"} 1
+panos_uid_flush_batch_size_bucket{device="fw1",le="500"} 1
+panos_uid_flush_batch_size_bucket{device="fw1",le="1000"} 1
+panos_uid_flush_batch_size_bucket{device="fw1",le="+Inf"} 1
+panos_uid_flush_batch_size_sum{device="fw1"} 7
+panos_uid_flush_batch_size_count{device="fw1"} 1
+# HELP panos_uid_flush_duration_seconds Duration of User-ID flushes.
+# TYPE panos_uid_flush_duration_seconds histogram
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="0.005"} 0
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="0.01"} 0
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="0.025"} 0
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="0.05"} 0
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="0.1"} 0
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="0.25"} 1
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="0.5"} 1
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="1"} 1
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="2.5"} 1
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="5"} 1
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="10"} 1
+panos_uid_flush_duration_seconds_bucket{device="fw1",le="+Inf"} 1
+panos_uid_flush_duration_seconds_sum{device="fw1"} 0.15
+panos_uid_flush_duration_seconds_count{device="fw1"} 1
+# HELP panos_uid_flush_failures_total Number of User-ID flushes that failed.
+# TYPE panos_uid_flush_failures_total counter
+panos_uid_flush_failures_total{device="fw1"} 1
+`
+
+func TestWritePrometheus(t *testing.T) {
+	m := NewMetrics()
+	var empty bytes.Buffer
+	if err := m.WritePrometheus(&empty); err != nil || empty.Len() != 0 {
+		t.Errorf("WritePrometheus() without values = %q, %v", empty.String(), err)
+	}
+	handler := m.Middleware()(func(apiCall *ApiCall) *ApiResult {
+		switch {
+		case apiCall.Type == _TYPE_CONFIG:
+			return &ApiResult{Err: errors.New("connection refused")}
+		case apiCall.Host == "fw1":
+			return &ApiResult{Status: STATUS_OK, Latency: 40 * time.Millisecond}
+		}
+		return &ApiResult{Status: STATUS_ERROR, StatusCode: "17", Latency: 2 * time.Second}
+	})
+	handler(&ApiCall{Host: "fw1", Type: _TYPE_OP})
+	handler(&ApiCall{Host: "fw1", Type: _TYPE_OP})
+	handler(&ApiCall{Host: "fw1", Type: _TYPE_CONFIG})
+	handler(&ApiCall{Host: "fw\"2\\\n", Type: _TYPE_OP})
+	m.ObserveRetry("fw1", _TYPE_UID)
+	m.ObserveRetry("fw1", _TYPE_UID)
+	m.setUidPending("fw1", 3)
+	m.observeUidFlush("fw1", 7, 150*time.Millisecond, true)
+	var out bytes.Buffer
+	if err := m.WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != testExposition {
+		t.Errorf("WritePrometheus() =\n%s\nwant\n%s", got, testExposition)
+	}
+}
+
+// TestUidMetricsLabels checks the UID series of an ApiConnector sink are labeled like its API calls,
+// including the retried ones
+func TestUidMetricsLabels(t *testing.T) {
+	device := panostest.NewServer()
+	defer device.Close()
+	apiC := &ApiConnector{}
+	apiC.Init(device.Host)
+	if err := apiC.Keygen(device.User, device.Password); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	failures := 1
+	uid, _ := startTestUID(t, apiC, func(uid *UID) {
+		if err := uid.SetMetrics(m); err != nil {
+			t.Fatal(err)
+		}
+		// fails the first delivery after the metrics middleware saw it
+		uid.device.Use(func(next ApiHandler) ApiHandler {
+			return func(apiCall *ApiCall) *ApiResult {
+				if failures > 0 {
+					failures--
+					return &ApiResult{Err: errors.New("connection reset")}
+				}
+				return next(apiCall)
+			}
+		})
+		uid.SetRetryPolicy(1, time.Second, time.Second)
+		uid.AddDestination("backup", &fakeSink{})
+	})
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	flush(t, uid)
+	var out bytes.Buffer
+	if err := m.WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	host := `device="` + device.Host + `"`
+	for _, want := range []string{
+		`panos_api_requests_total{` + host + `,type="user-id"} 2`,
+		`panos_api_errors_total{` + host + `,type="user-id",code="API_COMSERROR"} 1`,
+		`panos_api_retries_total{` + host + `,type="user-id"} 1`,
+		`panos_uid_pending_changes{` + host + `} 0`,
+		`panos_uid_flush_batch_size_count{` + host + `} 1`,
+		`panos_uid_flush_batch_size_count{device="backup"} 1`,
+	} {
+		if !strings.Contains(out.String(), "\n"+want+"\n") {
+			t.Errorf("missing %s in\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), `device="test"`) {
+		t.Errorf("series labeled with the UID name:\n%s", out.String())
+	}
+}
@@ -0,0 +1,719 @@
+// Package panostest provides an in-process emulation of the PANOS XML API to test code
+// built on top of the gopanosapi package without a real device.
+//
+// The emulated device supports keygen, a few op commands, config show/get/set/edit/delete/move
+// against an in-memory configuration, configuration revert, save and load, commit, configuration
+// export, file import, User-ID uid-message ingestion (mappings, groups, tags and HIP reports) and
+// report/log jobs.
+package panostest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const _defaultConfig = "<config><devices><entry name=\"localhost.localdomain\"><vsys><entry name=\"vsys1\"></entry></vsys></entry></devices></config>"
+
+type job struct {
+	id       int
+	kind     string
+	started  time.Time
+	delay    time.Duration
+	response string
+}
+
+// Server is an emulated PANOS device listening on a local TLS port.
+// Exported fields may be changed at any time to tune the device behaviour.
+type Server struct {
+	*httptest.Server
+	// Host is the "host:port" value to be provided to ApiConnector.Init()
+	Host string
+	// Credentials accepted by type=keygen and the key it returns
+	User, Password, Key string
+	// Values reported by "show system info"
+	Hostname, Serial, Model, SwVersion string
+	// Time it takes for report, log and commit jobs to finish
+	ReportDelay, LogDelay, CommitDelay time.Duration
+	// Report is the XML returned inside the <report> element by any report request
+	Report string
+
+	lock      sync.Mutex
+	candidate *node
+	running   *node
+	mappings  map[string]string
+	groups    map[string][]string
+	ipTags    map[string]map[string]struct{}
+	userTags  map[string]map[string]struct{}
+	hip       map[string]string
+	logs      map[string][]string
+	messages  []string
+	refreshes []string
+	files     map[string]string
+	saved     map[string]*node
+	jobs      map[int]*job
+	lastJob   int
+	requests  int
+}
+
+// NewServer starts an emulated device with a default configuration.
+// Callers must invoke "Close()" once done.
+func NewServer() *Server {
+	s := &Server{
+		User:      "admin",
+		Password:  "admin",
+		Key:       "LUFRPT14MW5xOEo1R09KVlBZNnpnemh0VHRBOWl6TGM9bXcwM3JHUGVhRlNiY0dCR0srNERUQT09",
+		Hostname:  "PA-VM",
+		Serial:    "007000000000001",
+		Model:     "PA-VM",
+		SwVersion: "10.1.0",
+		mappings:  make(map[string]string),
+		groups:    make(map[string][]string),
+		ipTags:    make(map[string]map[string]struct{}),
+		userTags:  make(map[string]map[string]struct{}),
+		hip:       make(map[string]string),
+		logs:      make(map[string][]string),
+		jobs:      make(map[int]*job),
+		files:     make(map[string]string),
+		saved:     make(map[string]*node),
+	}
+	s.candidate, _ = s.parseConfig(_defaultConfig)
+	s.running = s.candidate.clone()
+	s.Server = httptest.NewTLSServer(s)
+	s.Host = strings.TrimPrefix(s.Server.URL, "https://")
+	return s
+}
+
+func (s *Server) parseConfig(data string) (*node, error) {
+	roots, err := parseNodes(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) != 1 || roots[0].tag != "config" {
+		return nil, fmt.Errorf("configuration root must be a single <config> element")
+	}
+	return roots[0], nil
+}
+
+// SetConfig replaces both the running and the candidate configuration
+func (s *Server) SetConfig(data string) error {
+	root, err := s.parseConfig(data)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.candidate = root
+	s.running = root.clone()
+	s.lock.Unlock()
+	return nil
+}
+
+// CandidateConfig returns the current candidate configuration
+func (s *Server) CandidateConfig() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.candidate.String()
+}
+
+// RunningConfig returns the current running configuration
+func (s *Server) RunningConfig() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.running.String()
+}
+
+// Mappings returns the IP to user mappings learnt through the User-ID API
+func (s *Server) Mappings() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	m := make(map[string]string, len(s.mappings))
+	for ip, user := range s.mappings {
+		m[ip] = user
+	}
+	return m
+}
+
+// Groups returns the group memberships learnt through the User-ID API
+func (s *Server) Groups() map[string][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	g := make(map[string][]string, len(s.groups))
+	for name, members := range s.groups {
+		g[name] = append([]string{}, members...)
+	}
+	return g
+}
+
+func tagSnapshot(tags map[string]map[string]struct{}) map[string][]string {
+	snapshot := make(map[string][]string, len(tags))
+	for key, keyTags := range tags {
+		for tag := range keyTags {
+			snapshot[key] = append(snapshot[key], tag)
+		}
+		sort.Strings(snapshot[key])
+	}
+	return snapshot
+}
+
+// RegisteredIps returns the tags registered to each IP address through the User-ID API
+func (s *Server) RegisteredIps() map[string][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return tagSnapshot(s.ipTags)
+}
+
+// UserTags returns the tags registered to each user through the User-ID API
+func (s *Server) UserTags() map[string][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return tagSnapshot(s.userTags)
+}
+
+// HipReports returns the last HIP report received for each IP address
+func (s *Server) HipReports() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h := make(map[string]string, len(s.hip))
+	for ip, report := range s.hip {
+		h[ip] = report
+	}
+	return h
+}
+
+// UidMessages returns every uid-message payload received so far
+func (s *Server) UidMessages() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+// ExternalListRefreshes returns the External Dynamic Lists refreshed so far ("type/name")
+func (s *Server) ExternalListRefreshes() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.refreshes...)
+}
+
+// ImportedFiles returns the files received by type=import requests, keyed by "category/filename"
+func (s *Server) ImportedFiles() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	files := make(map[string]string, len(s.files))
+	for name, content := range s.files {
+		files[name] = content
+	}
+	return files
+}
+
+// Requests returns the number of API requests served so far
+func (s *Server) Requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+// SetLogs sets the entries (XML <entry> elements) returned by log queries of the provided type
+func (s *Server) SetLogs(logType string, entries ...string) {
+	s.lock.Lock()
+	s.logs[logType] = entries
+	s.lock.Unlock()
+}
+
+func success(body string) string {
+	return "<response status=\"success\">" + body + "</response>"
+}
+
+func failure(code, msg string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(msg))
+	return "<response status=\"error\" code=\"" + code + "\"><msg><line>" + b.String() + "</line></msg></response>"
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/" && r.URL.Path != "/api" {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	s.requests++
+	response := s.dispatch(r)
+	s.lock.Unlock()
+	w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+	fmt.Fprint(w, response)
+}
+
+func (s *Server) dispatch(r *http.Request) string {
+	apiType := r.Form.Get("type")
+	if apiType == "keygen" {
+		if r.Form.Get("user") != s.User || r.Form.Get("password") != s.Password {
+			return "<response status=\"error\" code=\"403\"><result><msg>Invalid Credential</msg></result></response>"
+		}
+		return success("<result><key>" + s.Key + "</key></result>")
+	}
+	if r.Form.Get("key") != s.Key {
+		return "<response status=\"error\" code=\"403\"><result><msg>Invalid Credential</msg></result></response>"
+	}
+	switch apiType {
+	case "op":
+		return s.op(r.Form.Get("cmd"))
+	case "config":
+		if r.Form.Get("action") == "move" {
+			return s.move(r.Form.Get("xpath"), r.Form.Get("where"), r.Form.Get("dst"))
+		}
+		return s.config(r.Form.Get("action"), r.Form.Get("xpath"), r.Form.Get("element"))
+	case "export":
+		if r.Form.Get("category") != "configuration" {
+			return failure("12", "Unsupported export category "+r.Form.Get("category"))
+		}
+		return s.running.String()
+	case "import":
+		return s.importFile(r)
+	case "commit":
+		s.running = s.candidate.clone()
+		return s.enqueue("commit", s.CommitDelay, success("<result><msg><line>Configuration committed successfully</line></msg></result>"))
+	case "user-id":
+		return s.userId(r.Form.Get("cmd"))
+	case "report":
+		return s.report(r)
+	case "log":
+		return s.log(r)
+	}
+	return failure("12", "Invalid type "+apiType)
+}
+
+// enqueue registers a job and returns the "job enqueued" response
+func (s *Server) enqueue(kind string, delay time.Duration, response string) string {
+	s.lastJob++
+	s.jobs[s.lastJob] = &job{id: s.lastJob, kind: kind, started: time.Now(), delay: delay, response: response}
+	id := strconv.Itoa(s.lastJob)
+	return success("<result><msg><line>" + kind + " job enqueued with jobid " + id + "</line></msg><job>" + id + "</job></result>")
+}
+
+func (j *job) finished() bool {
+	return time.Since(j.started) >= j.delay
+}
+
+func (j *job) status() string {
+	if j.finished() {
+		return "FIN"
+	}
+	return "ACT"
+}
+
+func (j *job) percent() string {
+	if j.finished() || j.delay == 0 {
+		return "100"
+	}
+	return strconv.Itoa(int(100 * time.Since(j.started) / j.delay))
+}
+
+func (s *Server) lookupJob(kind, id string) *job {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil
+	}
+	j, ok := s.jobs[n]
+	if !ok || (kind != "" && j.kind != kind) {
+		return nil
+	}
+	return j
+}
+
+func (s *Server) op(cmd string) string {
+	roots, err := parseNodes(cmd)
+	if err != nil || len(roots) != 1 {
+		return failure("17", "Malformed command")
+	}
+	root := roots[0]
+	path := []string{root.tag}
+	for n := root; len(n.children) == 1 && n.children[0].tag != "entry"; {
+		n = n.children[0]
+		path = append(path, n.tag)
+	}
+	switch strings.Join(path, " ") {
+	case "show system info":
+		return success("<result><system><hostname>" + s.Hostname + "</hostname><serial>" + s.Serial +
+			"</serial><model>" + s.Model + "</model><sw-version>" + s.SwVersion + "</sw-version></system></result>")
+	case "request system external-list refresh type ip name", "request system external-list refresh type domain name",
+		"request system external-list refresh type url name":
+		name := find(root, []step{{tag: "request"}, {tag: "system"}, {tag: "external-list"}, {tag: "refresh"}, {tag: "type"},
+			{tag: path[5]}, {tag: "name"}})[0].text
+		s.refreshes = append(s.refreshes, path[5]+"/"+name)
+		return success("<result>EDL refresh job enqueued</result>")
+	case "revert config":
+		s.candidate = s.running.clone()
+		return success("<result>Candidate configuration reverted</result>")
+	case "save config to":
+		name := find(root, []step{{tag: "save"}, {tag: "config"}, {tag: "to"}})[0].text
+		s.saved[name] = s.candidate.clone()
+		return success("<result>Config saved to " + name + "</result>")
+	case "load config from":
+		name := find(root, []step{{tag: "load"}, {tag: "config"}, {tag: "from"}})[0].text
+		saved, ok := s.saved[name]
+		if name == "running-config.xml" {
+			saved, ok = s.running, true
+		}
+		if !ok {
+			return failure("17", name+" not found")
+		}
+		s.candidate = saved.clone()
+		return success("<result><msg><line>Config loaded from " + name + "</line></msg></result>")
+	case "show clock":
+		return success("<result>" + time.Now().UTC().Format("Mon Jan 2 15:04:05 MST 2006") + "\n</result>")
+	case "show jobs id":
+		j := s.lookupJob("", find(root, []step{{tag: "show"}, {tag: "jobs"}, {tag: "id"}})[0].text)
+		if j == nil {
+			return failure("17", "job not found")
+		}
+		return success(fmt.Sprintf("<result><job><id>%d</id><type>%s</type><status>%s</status><progress>%s</progress><result>OK</result></job></result>",
+			j.id, strings.ToUpper(j.kind[:1])+j.kind[1:], j.status(), j.percent()))
+	case "show user ip-user-mapping all":
+		var ips []string
+		for ip := range s.mappings {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		var b bytes.Buffer
+		for _, ip := range page(root, ips) {
+			writeMapping(&b, ip, s.mappings[ip])
+		}
+		fmt.Fprintf(&b, "<count>%d</count>", len(s.mappings))
+		return success("<result>" + b.String() + "</result>")
+	case "show user ip-user-mapping ip":
+		ip := find(root, []step{{tag: "show"}, {tag: "user"}, {tag: "ip-user-mapping"}, {tag: "ip"}})[0].text
+		var b bytes.Buffer
+		user, ok := s.mappings[ip]
+		if ok {
+			writeMapping(&b, ip, user)
+		}
+		return success("<result>" + b.String() + "</result>")
+	case "show user group list":
+		var names []string
+		for name := range s.groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return success(fmt.Sprintf("<result><![CDATA[\n%s\n\nTotal: %d\n* : Custom Group\n]]></result>",
+			strings.Join(names, "\n"), len(names)))
+	case "show user user-ids":
+		userGroups := make(map[string][]string)
+		for name, members := range s.groups {
+			for _, member := range members {
+				userGroups[member] = append(userGroups[member], name)
+			}
+		}
+		var users []string
+		for user := range userGroups {
+			users = append(users, user)
+			sort.Strings(userGroups[user])
+		}
+		sort.Strings(users)
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "\n%-30s %-6s %s\n%s\n", "User Name", "Vsys", "Groups", strings.Repeat("-", 66))
+		for _, user := range users {
+			for i, group := range userGroups[user] {
+				if i == 0 {
+					fmt.Fprintf(&b, "%-30s %-6s %s\n", user, "vsys1", group)
+				} else {
+					fmt.Fprintf(&b, "%-37s %s\n", "", group)
+				}
+			}
+		}
+		fmt.Fprintf(&b, "\nTotal: %d\n", len(users))
+		return success("<result><![CDATA[" + b.String() + "]]></result>")
+	case "show object registered-ip all":
+		var ips []string
+		for ip := range s.ipTags {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		tags := tagSnapshot(s.ipTags)
+		var b bytes.Buffer
+		for _, ip := range page(root, ips) {
+			fmt.Fprintf(&b, "<entry ip=\"%s\" from_agent=\"0\" persistent=\"1\"><tag>", ip)
+			for _, tag := range tags[ip] {
+				b.WriteString("<member>")
+				xml.EscapeText(&b, []byte(tag))
+				b.WriteString("</member>")
+			}
+			b.WriteString("</tag></entry>")
+		}
+		fmt.Fprintf(&b, "<count>%d</count>", len(ips))
+		return success("<result>" + b.String() + "</result>")
+	case "show user group name":
+		name := find(root, []step{{tag: "show"}, {tag: "user"}, {tag: "group"}, {tag: "name"}})[0].text
+		members, ok := s.groups[name]
+		if !ok {
+			return failure("17", "No such group "+name)
+		}
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "\nshort name:  %s\nsource type: xmlapi\n\n", name)
+		for i, member := range members {
+			fmt.Fprintf(&b, "[%-6d] %s\n", i+1, member)
+		}
+		return success("<result><![CDATA[" + b.String() + "]]></result>")
+	}
+	return failure("17", "Unknown command: "+strings.Join(path, " "))
+}
+
+func writeMapping(b *bytes.Buffer, ip, user string) {
+	b.WriteString("<entry><ip>" + ip + "</ip><vsys>vsys1</vsys><type>XMLAPI</type><user>")
+	xml.EscapeText(b, []byte(user))
+	b.WriteString("</user><idle_timeout>Never</idle_timeout><timeout>Never</timeout></entry>")
+}
+
+// page applies the start-point (1 based) and limit elements of a query to the sorted keys of a table
+func page(cmd *node, keys []string) []string {
+	start, limit := 1, len(keys)
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, c := range n.children {
+			switch c.tag {
+			case "start-point":
+				start, _ = strconv.Atoi(c.text)
+			case "limit":
+				limit, _ = strconv.Atoi(c.text)
+			}
+			walk(c)
+		}
+	}
+	walk(cmd)
+	if start < 1 || start > len(keys) {
+		return nil
+	}
+	keys = keys[start-1:]
+	if limit >= 0 && limit < len(keys) {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+func (s *Server) config(action, xpath, element string) string {
+	steps, err := parseXpath(xpath)
+	if err != nil {
+		return failure("12", err.Error())
+	}
+	switch action {
+	case "show", "get":
+		root := s.candidate
+		if action == "show" {
+			root = s.running
+		}
+		var b bytes.Buffer
+		matches := find(root, steps)
+		for _, n := range matches {
+			n.write(&b)
+		}
+		if action == "show" {
+			if len(matches) == 0 {
+				return failure("7", "No such node")
+			}
+			return success("<result>" + b.String() + "</result>")
+		}
+		return success(fmt.Sprintf("<result total-count=\"%d\" count=\"%d\">%s</result>", len(matches), len(matches), b.String()))
+	case "set":
+		elements, err := parseNodes("<element>" + element + "</element>")
+		if err != nil {
+			return failure("12", "Malformed element: "+err.Error())
+		}
+		target, err := ensure(s.candidate, steps)
+		if err != nil {
+			return failure("12", err.Error())
+		}
+		target.merge(elements[0])
+	case "edit":
+		elements, err := parseNodes(element)
+		if err != nil || len(elements) != 1 || !steps[len(steps)-1].matches(elements[0]) {
+			return failure("12", "Edit breaks config validity")
+		}
+		target, err := ensure(s.candidate, steps)
+		if err != nil {
+			return failure("12", err.Error())
+		}
+		*target = *elements[0]
+	case "delete":
+		matches := find(s.candidate, steps)
+		if len(matches) == 0 {
+			return "<response status=\"success\" code=\"7\"><msg>Object doesn't exist</msg></response>"
+		}
+		s.candidate.remove(matches)
+	default:
+		return failure("12", "Invalid action "+action)
+	}
+	return "<response status=\"success\" code=\"20\"><msg>command succeeded</msg></response>"
+}
+
+// move implements config action=move among the siblings of the node at xpath
+func (s *Server) move(xpath, where, dst string) string {
+	steps, err := parseXpath(xpath)
+	if err != nil {
+		return failure("12", err.Error())
+	}
+	matches := find(s.candidate, steps)
+	if len(matches) != 1 || len(steps) < 2 {
+		return failure("7", "No such node")
+	}
+	for _, parent := range find(s.candidate, steps[:len(steps)-1]) {
+		if err := parent.move(matches[0], where, dst); err == nil {
+			return "<response status=\"success\" code=\"20\"><msg>command succeeded</msg></response>"
+		} else if err != errNotChild {
+			return failure("12", err.Error())
+		}
+	}
+	return failure("7", "No such node")
+}
+
+func (s *Server) importFile(r *http.Request) string {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return failure("12", "Malformed import: "+err.Error())
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return failure("12", "Missing file")
+	}
+	defer file.Close()
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return failure("12", err.Error())
+	}
+	s.files[r.Form.Get("category")+"/"+header.Filename] = string(content)
+	return "<response status=\"success\"><msg>" + header.Filename + " saved</msg></response>"
+}
+
+type uidTagEntry struct {
+	Ip   string   `xml:"ip,attr"`
+	User string   `xml:"user,attr"`
+	Tags []string `xml:"tag>member"`
+}
+
+type uidMessage struct {
+	Login []struct {
+		Name string `xml:"name,attr"`
+		Ip   string `xml:"ip,attr"`
+	} `xml:"payload>login>entry"`
+	Logout []struct {
+		Name string `xml:"name,attr"`
+		Ip   string `xml:"ip,attr"`
+	} `xml:"payload>logout>entry"`
+	Groups []struct {
+		Name    string `xml:"name,attr"`
+		Members []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"members>entry"`
+	} `xml:"payload>groups>entry"`
+	Register       []uidTagEntry `xml:"payload>register>entry"`
+	Unregister     []uidTagEntry `xml:"payload>unregister>entry"`
+	RegisterUser   []uidTagEntry `xml:"payload>register-user>entry"`
+	UnregisterUser []uidTagEntry `xml:"payload>unregister-user>entry"`
+	HipReports     []struct {
+		Ip     string `xml:"ip,attr"`
+		Report string `xml:",innerxml"`
+	} `xml:"payload>hip-report>entry"`
+}
+
+func applyTags(tags map[string]map[string]struct{}, key string, add bool, names []string) {
+	if _, ok := tags[key]; !ok {
+		tags[key] = make(map[string]struct{})
+	}
+	for _, name := range names {
+		if add {
+			tags[key][name] = struct{}{}
+		} else {
+			delete(tags[key], name)
+		}
+	}
+	if len(tags[key]) == 0 {
+		delete(tags, key)
+	}
+}
+
+func (s *Server) userId(cmd string) string {
+	var msg uidMessage
+	if err := xml.Unmarshal([]byte(cmd), &msg); err != nil {
+		return failure("17", "Malformed uid-message: "+err.Error())
+	}
+	s.messages = append(s.messages, cmd)
+	for _, e := range msg.Login {
+		s.mappings[e.Ip] = e.Name
+	}
+	for _, e := range msg.Logout {
+		if s.mappings[e.Ip] == e.Name {
+			delete(s.mappings, e.Ip)
+		}
+	}
+	for _, g := range msg.Groups {
+		members := []string{}
+		for _, m := range g.Members {
+			members = append(members, m.Name)
+		}
+		s.groups[g.Name] = members
+	}
+	for _, e := range msg.Register {
+		applyTags(s.ipTags, e.Ip, true, e.Tags)
+	}
+	for _, e := range msg.Unregister {
+		applyTags(s.ipTags, e.Ip, false, e.Tags)
+	}
+	for _, e := range msg.RegisterUser {
+		applyTags(s.userTags, e.User, true, e.Tags)
+	}
+	for _, e := range msg.UnregisterUser {
+		applyTags(s.userTags, e.User, false, e.Tags)
+	}
+	for _, h := range msg.HipReports {
+		s.hip[h.Ip] = h.Report
+	}
+	return success("<result><uid-response><version>2.0</version><payload></payload></uid-response></result>")
+}
+
+func (s *Server) report(r *http.Request) string {
+	if r.Form.Get("action") == "get" {
+		j := s.lookupJob("report", r.Form.Get("job-id"))
+		if j == nil {
+			return failure("17", "job not found")
+		}
+		body := "<result><job><id>" + strconv.Itoa(j.id) + "</id><status>" + j.status() + "</status><percent>" + j.percent() + "</percent></job>"
+		if j.finished() {
+			body += "<report>" + j.response + "</report>"
+		}
+		return success(body + "</result>")
+	}
+	if r.Form.Get("async") == "yes" {
+		return s.enqueue("report", s.ReportDelay, s.Report)
+	}
+	return success("<report>" + s.Report + "</report>")
+}
+
+func (s *Server) log(r *http.Request) string {
+	if r.Form.Get("action") == "get" {
+		j := s.lookupJob("log", r.Form.Get("job-id"))
+		if j == nil {
+			return failure("17", "job not found")
+		}
+		body := "<result><job><id>" + strconv.Itoa(j.id) + "</id><status>" + j.status() + "</status></job>"
+		if j.finished() {
+			body += "<log>" + j.response + "</log>"
+		} else {
+			body += "<log><logs count=\"0\" progress=\"" + j.percent() + "\"/></log>"
+		}
+		return success(body + "</result>")
+	}
+	entries := s.logs[r.Form.Get("log-type")]
+	if n, err := strconv.Atoi(r.Form.Get("nlogs")); err == nil && n < len(entries) {
+		entries = entries[:n]
+	}
+	logs := fmt.Sprintf("<logs count=\"%d\" progress=\"100\">%s</logs>", len(entries), strings.Join(entries, ""))
+	return s.enqueue("log", s.LogDelay, logs)
+}
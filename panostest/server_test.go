@@ -0,0 +1,157 @@
+package panostest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// call posts the name/value pairs of params to the API of s and returns the response
+func call(t *testing.T, s *Server, params ...string) string {
+	t.Helper()
+	form := url.Values{}
+	for i := 0; i+1 < len(params); i += 2 {
+		form.Set(params[i], params[i+1])
+	}
+	res, err := s.Client().PostForm(s.URL+"/api/", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func expectResponse(t *testing.T, response string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if !strings.Contains(response, w) {
+			t.Errorf("response %s does not contain %s", response, w)
+		}
+	}
+}
+
+func TestKeygen(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	expectResponse(t, call(t, s, "type", "keygen", "user", s.User, "password", "wrong"), `status="error" code="403"`)
+	expectResponse(t, call(t, s, "type", "keygen", "user", s.User, "password", s.Password), "<key>"+s.Key+"</key>")
+	expectResponse(t, call(t, s, "type", "op", "cmd", "<show><system><info/></system></show>"), `code="403"`)
+	expectResponse(t, call(t, s, "type", "op", "key", s.Key, "cmd", "<show><system><info/></system></show>"),
+		`status="success"`, "<hostname>"+s.Hostname+"</hostname>", "<serial>"+s.Serial+"</serial>")
+	expectResponse(t, call(t, s, "type", "bogus", "key", s.Key), `code="12"`)
+	expectResponse(t, call(t, s, "type", "op", "key", s.Key, "cmd", "<show><bogus/></show>"), `code="17"`)
+	if requests := s.Requests(); requests != 6 {
+		t.Errorf("Requests() = %d, want 6", requests)
+	}
+	res, err := s.Client().Get(s.URL + "/other/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /other/ = %s", res.Status)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	const xpath = "/config/shared/address"
+	config := func(action, xpath string, params ...string) string {
+		t.Helper()
+		return call(t, s, append([]string{"type", "config", "key", s.Key, "action", action, "xpath", xpath}, params...)...)
+	}
+	expectResponse(t, config("set", xpath, "element", `<entry name="web"><ip-netmask>10.0.0.1/32</ip-netmask></entry>`), `code="20"`)
+	expectResponse(t, config("set", xpath, "element", `<entry name="db"><fqdn>db.local</fqdn></entry>`), `code="20"`)
+	expectResponse(t, config("get", xpath+"/entry"), `total-count="2"`,
+		`<entry name="web"><ip-netmask>10.0.0.1/32</ip-netmask></entry>`, `<entry name="db"><fqdn>db.local</fqdn></entry>`)
+	expectResponse(t, config("get", xpath+"/entry[@name='db']/fqdn"), `total-count="1"`, "<fqdn>db.local</fqdn>")
+	// show reads the running configuration
+	expectResponse(t, config("show", xpath), `code="7"`)
+	expectResponse(t, call(t, s, "type", "commit", "key", s.Key, "cmd", "<commit></commit>"), "<job>1</job>")
+	expectResponse(t, call(t, s, "type", "op", "key", s.Key, "cmd", "<show><jobs><id>1</id></jobs></show>"),
+		"<type>Commit</type>", "<status>FIN</status>", "<progress>100</progress>")
+	expectResponse(t, config("show", xpath+"/entry[@name='web']"), `<entry name="web"><ip-netmask>10.0.0.1/32</ip-netmask></entry>`)
+	// edit replaces the node, which must keep its name
+	expectResponse(t, config("edit", xpath+"/entry[@name='web']", "element", `<entry name="web"><fqdn>web.local</fqdn></entry>`), `code="20"`)
+	expectResponse(t, config("edit", xpath+"/entry[@name='web']", "element", `<entry name="www"/>`), `code="12"`)
+	expectResponse(t, config("delete", xpath+"/entry[@name='db']"), `code="20"`)
+	expectResponse(t, config("delete", xpath+"/entry[@name='db']"), `code="7"`)
+	expectResponse(t, config("set", xpath, "element", `<entry name="bad">`), `code="12"`)
+	expectResponse(t, config("set", "address[", "element", `<entry name="bad"/>`), `code="12"`)
+	candidate := s.CandidateConfig()
+	if !strings.Contains(candidate, `<entry name="web"><fqdn>web.local</fqdn></entry>`) || strings.Contains(candidate, "db.local") {
+		t.Errorf("CandidateConfig() = %s", candidate)
+	}
+	if running := s.RunningConfig(); !strings.Contains(running, "db.local") {
+		t.Errorf("RunningConfig() = %s", running)
+	}
+	// the configuration can be replaced; revert restores the running one
+	if err := s.SetConfig("<config><shared/>"); err == nil {
+		t.Error("SetConfig() accepted malformed XML")
+	}
+	expectResponse(t, call(t, s, "type", "op", "key", s.Key, "cmd", "<revert><config></config></revert>"), `status="success"`)
+	if candidate := s.CandidateConfig(); candidate != s.RunningConfig() {
+		t.Errorf("CandidateConfig() after revert = %s", candidate)
+	}
+}
+
+func TestUserId(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	message := `<uid-message><version>2.0</version><type>update</type><payload>` +
+		`<login><entry name="acme\bob" ip="10.0.0.1" timeout="60"/><entry name="acme\alice" ip="10.0.0.2"/></login>` +
+		`<groups><entry name="admins"><members><entry name="acme\bob"/></members></entry><entry name="empty"><members/></entry></groups>` +
+		`<register><entry ip="10.0.0.1"><tag><member>blocklist</member><member timeout="60">quarantine</member></tag></entry></register>` +
+		`<register-user><entry user="acme\bob"><tag><member>vip</member></tag></entry></register-user>` +
+		`<hip-report><entry name="acme\bob" ip="10.0.0.1"><md5-sum>x</md5-sum></entry></hip-report>` +
+		`</payload></uid-message>`
+	uid := func(message string) string {
+		t.Helper()
+		return call(t, s, "type", "user-id", "key", s.Key, "cmd", message)
+	}
+	expectResponse(t, uid(message), `status="success"`, "<uid-response>")
+	expectResponse(t, uid(`<uid-message><version>2.0</version><type>update</type><payload>`+
+		`<logout><entry name="acme\alice" ip="10.0.0.2"/><entry name="acme\carol" ip="10.0.0.1"/></logout>`+
+		`<unregister><entry ip="10.0.0.1"><tag><member>quarantine</member></tag></entry></unregister>`+
+		`<unregister-user><entry user="acme\bob"><tag><member>vip</member></tag></entry></unregister-user>`+
+		`</payload></uid-message>`), `status="success"`)
+	expectResponse(t, uid("<uid-message>"), `code="17"`)
+	// a logout of another user keeps the mapping
+	if mappings := s.Mappings(); !reflect.DeepEqual(mappings, map[string]string{"10.0.0.1": `acme\bob`}) {
+		t.Errorf("Mappings() = %v", mappings)
+	}
+	if groups := s.Groups(); !reflect.DeepEqual(groups, map[string][]string{"admins": {`acme\bob`}, "empty": {}}) {
+		t.Errorf("Groups() = %v", groups)
+	}
+	if ips := s.RegisteredIps(); !reflect.DeepEqual(ips, map[string][]string{"10.0.0.1": {"blocklist"}}) {
+		t.Errorf("RegisteredIps() = %v", ips)
+	}
+	if tags := s.UserTags(); len(tags[`acme\bob`]) != 0 {
+		t.Errorf("UserTags() = %v", tags)
+	}
+	if reports := s.HipReports(); reports["10.0.0.1"] != "<md5-sum>x</md5-sum>" {
+		t.Errorf("HipReports() = %v", reports)
+	}
+	if messages := s.UidMessages(); len(messages) != 2 || messages[0] != message {
+		t.Errorf("UidMessages() = %q", messages)
+	}
+	// the uid-message changes are visible through the op commands
+	op := func(cmd string) string {
+		t.Helper()
+		return call(t, s, "type", "op", "key", s.Key, "cmd", cmd)
+	}
+	expectResponse(t, op("<show><user><ip-user-mapping><all></all></ip-user-mapping></user></show>"),
+		`<ip>10.0.0.1</ip>`, `acme\bob`, "<count>1</count>")
+	expectResponse(t, op("<show><object><registered-ip><all></all></registered-ip></object></show>"),
+		`ip="10.0.0.1"`, "<member>blocklist</member>")
+	expectResponse(t, op("<show><user><group><name>admins</name></group></user></show>"), `acme\bob`)
+	expectResponse(t, op("<show><user><group><name>missing</name></group></user></show>"), `code="17"`)
+}
@@ -0,0 +1,321 @@
+package panostest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// node is a minimal mutable XML tree used to emulate the device configuration
+type node struct {
+	tag      string
+	attrs    []xml.Attr
+	text     string
+	children []*node
+}
+
+func (n *node) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *node) clone() *node {
+	c := &node{tag: n.tag, text: n.text, attrs: append([]xml.Attr(nil), n.attrs...)}
+	for _, child := range n.children {
+		c.children = append(c.children, child.clone())
+	}
+	return c
+}
+
+// parseNodes parses a sequence of sibling XML elements
+func parseNodes(data string) ([]*node, error) {
+	dec := xml.NewDecoder(strings.NewReader(data))
+	var roots []*node
+	var stack []*node
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{tag: t.Name.Local}
+			for _, a := range t.Attr {
+				n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: a.Name.Local}, Value: a.Value})
+			}
+			if len(stack) == 0 {
+				roots = append(roots, n)
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("no element found")
+	}
+	for _, r := range roots {
+		r.trim()
+	}
+	return roots, nil
+}
+
+// trim drops the indentation text of non leaf nodes
+func (n *node) trim() {
+	if len(n.children) > 0 {
+		n.text = ""
+		for _, c := range n.children {
+			c.trim()
+		}
+	}
+}
+
+func (n *node) write(b *bytes.Buffer) {
+	b.WriteString("<" + n.tag)
+	for _, a := range n.attrs {
+		b.WriteString(" " + a.Name.Local + "=\"")
+		xml.EscapeText(b, []byte(a.Value))
+		b.WriteString("\"")
+	}
+	b.WriteString(">")
+	if len(n.children) > 0 {
+		for _, c := range n.children {
+			c.write(b)
+		}
+	} else {
+		xml.EscapeText(b, []byte(n.text))
+	}
+	b.WriteString("</" + n.tag + ">")
+}
+
+func (n *node) String() string {
+	var b bytes.Buffer
+	n.write(&b)
+	return b.String()
+}
+
+// step is a single xpath location step such as entry[@name='x']
+type step struct {
+	tag, attr, value string
+}
+
+func (s step) matches(n *node) bool {
+	return (s.tag == "*" || s.tag == n.tag) && (s.attr == "" || n.attr(s.attr) == s.value)
+}
+
+// parseXpath supports the absolute location paths used by the PANOS API:
+// tag steps with an optional [@attr='value'] predicate
+func parseXpath(xpath string) ([]step, error) {
+	if !strings.HasPrefix(xpath, "/") {
+		return nil, errors.New("xpath must be absolute")
+	}
+	var steps []step
+	var current strings.Builder
+	var quote rune
+	inPredicate := false
+	flush := func() error {
+		raw := current.String()
+		current.Reset()
+		if raw == "" {
+			return nil
+		}
+		s := step{tag: raw}
+		if i := strings.Index(raw, "["); i >= 0 {
+			if !strings.HasSuffix(raw, "]") {
+				return errors.New("malformed predicate in " + raw)
+			}
+			s.tag = raw[:i]
+			pred := strings.TrimSpace(raw[i+1 : len(raw)-1])
+			eq := strings.Index(pred, "=")
+			if !strings.HasPrefix(pred, "@") || eq < 0 {
+				return errors.New("unsupported predicate in " + raw)
+			}
+			s.attr = strings.TrimSpace(pred[1:eq])
+			s.value = strings.Trim(strings.TrimSpace(pred[eq+1:]), `'"`)
+		}
+		steps = append(steps, s)
+		return nil
+	}
+	for _, r := range xpath[1:] {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '[':
+			inPredicate = true
+		case r == ']':
+			inPredicate = false
+		case r == '/' && !inPredicate:
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("empty xpath")
+	}
+	return steps, nil
+}
+
+// find returns the nodes matched by steps starting at root (root must match the first step)
+func find(root *node, steps []step) []*node {
+	if !steps[0].matches(root) {
+		return nil
+	}
+	current := []*node{root}
+	for _, s := range steps[1:] {
+		var next []*node
+		for _, n := range current {
+			for _, c := range n.children {
+				if s.matches(c) {
+					next = append(next, c)
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// ensure returns the node at steps creating any missing one
+func ensure(root *node, steps []step) (*node, error) {
+	if !steps[0].matches(root) {
+		return nil, errors.New("xpath does not start at /" + root.tag)
+	}
+	current := root
+	for _, s := range steps[1:] {
+		var found *node
+		for _, c := range current.children {
+			if s.matches(c) {
+				found = c
+				break
+			}
+		}
+		if found == nil {
+			if s.tag == "*" {
+				return nil, errors.New("cannot create wildcard node")
+			}
+			found = &node{tag: s.tag}
+			if s.attr != "" {
+				found.attrs = []xml.Attr{{Name: xml.Name{Local: s.attr}, Value: s.value}}
+			}
+			current.children = append(current.children, found)
+		}
+		current = found
+	}
+	return current, nil
+}
+
+// merge implements the "set" semantics: entries are matched by tag and name,
+// member lists are extended and any other leaf is replaced
+func (n *node) merge(add *node) {
+	for _, a := range add.attrs {
+		if n.attr(a.Name.Local) == "" {
+			n.attrs = append(n.attrs, a)
+		}
+	}
+	if len(add.children) == 0 {
+		n.text = add.text
+		return
+	}
+	for _, child := range add.children {
+		var match *node
+		for _, existing := range n.children {
+			if existing.tag != child.tag || existing.attr("name") != child.attr("name") {
+				continue
+			}
+			if child.tag == "member" && existing.text != child.text {
+				continue
+			}
+			match = existing
+			break
+		}
+		if match == nil {
+			n.children = append(n.children, child.clone())
+		} else if child.tag != "member" {
+			match.merge(child)
+		}
+	}
+}
+
+// remove deletes the provided nodes from the tree
+func (n *node) remove(targets []*node) {
+	kept := n.children[:0]
+	for _, c := range n.children {
+		drop := false
+		for _, t := range targets {
+			if c == t {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			kept = append(kept, c)
+			c.remove(targets)
+		}
+	}
+	n.children = kept
+}
+
+var errNotChild = errors.New("not a child")
+
+// move places child at where ("top", "bottom", "before" or "after" the sibling entry named dst)
+func (n *node) move(child *node, where, dst string) error {
+	index := -1
+	for i, c := range n.children {
+		if c == child {
+			index = i
+		}
+	}
+	if index < 0 {
+		return errNotChild
+	}
+	siblings := append(append([]*node(nil), n.children[:index]...), n.children[index+1:]...)
+	position := -1
+	switch where {
+	case "top":
+		position = 0
+	case "bottom":
+		position = len(siblings)
+	case "before", "after":
+		for i, c := range siblings {
+			if c.attr("name") == dst {
+				position = i
+				if where == "after" {
+					position++
+				}
+			}
+		}
+		if position < 0 {
+			return errors.New("No such destination " + dst)
+		}
+	default:
+		return errors.New("Invalid where " + where)
+	}
+	n.children = append(siblings[:position], append([]*node{child}, siblings[position:]...)...)
+	return nil
+}
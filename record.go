@@ -0,0 +1,203 @@
+package gopanosapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+)
+
+const _redacted = "REDACTED"
+
+// parameters never written to fixture files nor taken into account when matching requests
+var redactedParams = [...]string{"key", "password"}
+var redactedKeyNode = regexp.MustCompile(`<key>[^<]*</key>`)
+
+// Fixture is a recorded API interaction. Secrets (API keys and passwords) are redacted.
+type Fixture struct {
+	Params     url.Values `json:"params"`
+	StatusCode int        `json:"status"`
+	Body       string     `json:"body"`
+}
+
+func redactParams(q url.Values) url.Values {
+	redacted := url.Values{}
+	for k, v := range q {
+		redacted[k] = append([]string(nil), v...)
+	}
+	for _, k := range redactedParams {
+		if _, ok := redacted[k]; ok {
+			redacted.Set(k, _redacted)
+		}
+	}
+	return redacted
+}
+
+// fixtureKey identifies a request regardless of the secrets it carries
+func fixtureKey(q url.Values) string {
+	stripped := url.Values{}
+	for k, v := range q {
+		stripped[k] = v
+	}
+	for _, k := range redactedParams {
+		stripped.Del(k)
+	}
+	return stripped.Encode()
+}
+
+// requestParams extracts the API parameters from an outgoing request leaving its body untouched
+func requestParams(req *http.Request) (url.Values, error) {
+	q := req.URL.Query()
+	// only form bodies carry parameters (imports send them in the query string)
+	if req.Body == nil || req.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		return q, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range form {
+		q[k] = append(q[k], v...)
+	}
+	return q, nil
+}
+
+// Recorder is an http.RoundTripper that captures every API interaction going through it.
+// Use "ApiConnector.Record()" to start recording and "Save()" to write the fixture file.
+type Recorder struct {
+	next     http.RoundTripper
+	lock     sync.Mutex
+	fixtures []Fixture
+}
+
+// NewRecorder returns a Recorder forwarding requests to next
+func NewRecorder(next http.RoundTripper) *Recorder {
+	return &Recorder{next: next}
+}
+
+// Record wraps the ApiConnector transport with a Recorder and returns it. It must be called after "Init()".
+func (apiC *ApiConnector) Record() (*Recorder, error) {
+	if apiC.httpcon == nil {
+		return nil, errors.New("ApiConnector not initialized: call Init() before Record()")
+	}
+	next := apiC.Transport()
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	rec := NewRecorder(next)
+	apiC.SetTransport(rec)
+	return rec, nil
+}
+
+func (rec *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	q, err := requestParams(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := rec.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	rec.lock.Lock()
+	rec.fixtures = append(rec.fixtures, Fixture{
+		Params:     redactParams(q),
+		StatusCode: res.StatusCode,
+		Body:       redactedKeyNode.ReplaceAllString(string(body), "<key>"+_redacted+"</key>"),
+	})
+	rec.lock.Unlock()
+	return res, nil
+}
+
+// Fixtures returns the interactions recorded so far
+func (rec *Recorder) Fixtures() []Fixture {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return append([]Fixture(nil), rec.fixtures...)
+}
+
+// Save writes the recorded interactions to a fixture file
+func (rec *Recorder) Save(path string) error {
+	data, err := json.MarshalIndent(rec.Fixtures(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Replayer is an http.RoundTripper serving recorded fixtures back, so code using an ApiConnector
+// can be exercised without a device. Requests are matched on their parameters (secrets excluded).
+// Identical requests get the matching fixtures in recording order, the last one being served
+// again once exhausted (i.e. report job polling).
+type Replayer struct {
+	lock    sync.Mutex
+	pending map[string][]Fixture
+}
+
+// NewReplayer returns a Replayer serving the provided fixtures
+func NewReplayer(fixtures []Fixture) *Replayer {
+	rep := &Replayer{pending: make(map[string][]Fixture)}
+	for _, f := range fixtures {
+		k := fixtureKey(f.Params)
+		rep.pending[k] = append(rep.pending[k], f)
+	}
+	return rep
+}
+
+// LoadReplayer returns a Replayer serving the fixtures found in a file written by "Recorder.Save()"
+func LoadReplayer(path string) (*Replayer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []Fixture
+	if err = json.Unmarshal(data, &fixtures); err != nil {
+		return nil, err
+	}
+	return NewReplayer(fixtures), nil
+}
+
+func (rep *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	q, err := requestParams(req)
+	if err != nil {
+		return nil, err
+	}
+	k := fixtureKey(q)
+	rep.lock.Lock()
+	candidates := rep.pending[k]
+	if len(candidates) == 0 {
+		rep.lock.Unlock()
+		return nil, errors.New("Replayer: no fixture for request " + k)
+	}
+	f := candidates[0]
+	if len(candidates) > 1 {
+		rep.pending[k] = candidates[1:]
+	}
+	rep.lock.Unlock()
+	return &http.Response{
+		Status:        http.StatusText(f.StatusCode),
+		StatusCode:    f.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/xml"}},
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(f.Body))),
+		ContentLength: int64(len(f.Body)),
+		Request:       req,
+	}, nil
+}
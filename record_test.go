@@ -0,0 +1,85 @@
+package gopanosapi_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xhoms/gopanosapi"
+	"github.com/xhoms/gopanosapi/panostest"
+)
+
+func TestRecordBeforeInit(t *testing.T) {
+	var apiC gopanosapi.ApiConnector
+	if _, err := apiC.Record(); err == nil {
+		t.Fatal("Record() before Init() did not fail")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	device := panostest.NewServer()
+	defer device.Close()
+	device.Password = "Pa55-w0rd"
+	var apiC gopanosapi.ApiConnector
+	apiC.Init(device.Host)
+	rec, err := apiC.Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apiC.Keygen(device.User, device.Password); err != nil {
+		t.Fatal(err)
+	}
+	clock, err := apiC.Op("<show><clock></clock></show>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "fixtures.json")
+	if err := rec.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{device.Key, device.Password} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("fixture file contains the secret %q", secret)
+		}
+	}
+	for _, fixture := range rec.Fixtures() {
+		for _, param := range []string{"key", "password"} {
+			if value, ok := fixture.Params[param]; ok && (len(value) != 1 || value[0] != "REDACTED") {
+				t.Errorf("parameter %s not redacted: %v", param, value)
+			}
+		}
+	}
+
+	replayer, err := gopanosapi.LoadReplayer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replayed gopanosapi.ApiConnector
+	replayed.Init(device.Host)
+	replayed.SetTransport(replayer)
+	// the password is not part of the match, so a different one gets the recorded response
+	if err := replayed.Keygen(device.User, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.GetKey() != "REDACTED" {
+		t.Errorf("replayed key = %q", replayed.GetKey())
+	}
+	if replayed.PanosVersion != device.SwVersion {
+		t.Errorf("replayed version = %q, want %q", replayed.PanosVersion, device.SwVersion)
+	}
+	result, err := replayed.Op("<show><clock></clock></show>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != string(clock) {
+		t.Errorf("replayed result = %q, want %q", result, clock)
+	}
+	if _, err := replayed.Op("<show><jobs><all></all></jobs></show>"); err == nil {
+		t.Error("request without fixture did not fail")
+	}
+}
@@ -0,0 +1,468 @@
+package gopanosapi
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Node is an element of a result document parsed by "ParseResult()". Values are selected with a subset
+// of XPath:
+//   - steps are element names or "*", separated by "/" ("//" selects descendants at any depth)
+//   - "." and ".." select the node and its parent, a leading "/" starts from the document
+//   - "@name" (or "@*") and "text()" as last step select attributes and text
+//   - predicates filter each step: [@name], [@name='x'], [child], [child='x'], [.='x'], [2], [last()]
+//     ("!=" can be used instead of "=")
+//
+// For instance, from the result of "Config()" with action get on the address objects:
+//
+//	doc, err := gopanosapi.ParseResult(data)
+//	ip := doc.Value("address/entry[@name='web']/ip-netmask")
+//	for _, entry := range doc.Find("address").Entries() {
+//		fmt.Println(entry.Attr["name"], entry.Value("ip-netmask"))
+//	}
+type Node struct {
+	// Name is the element name (empty for the document, "@name" for attributes and "#text" for text)
+	Name string
+	// Attr holds the attributes of the element
+	Attr map[string]string
+	// Text is the text of the element, without surrounding spaces
+	Text     string
+	Children []*Node
+	parent   *Node
+}
+
+// ParseResult parses an XML fragment (i.e. the result of "Op()" or "Config()") into a document node
+// whose children are the top level elements of the fragment
+func ParseResult(data []byte) (*Node, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	doc := &Node{Attr: map[string]string{}}
+	current := doc
+	var text bytes.Buffer
+	texts := []*bytes.Buffer{&text}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			child := &Node{Name: t.Name.Local, Attr: make(map[string]string, len(t.Attr)), parent: current}
+			for _, attr := range t.Attr {
+				child.Attr[attr.Name.Local] = attr.Value
+			}
+			current.Children = append(current.Children, child)
+			current = child
+			texts = append(texts, &bytes.Buffer{})
+		case xml.EndElement:
+			current.Text = strings.TrimSpace(texts[len(texts)-1].String())
+			texts = texts[:len(texts)-1]
+			current = current.parent
+		case xml.CharData:
+			texts[len(texts)-1].Write(t)
+		}
+	}
+	doc.Text = strings.TrimSpace(text.String())
+	return doc, nil
+}
+
+// Query returns the nodes selected by path, in document order
+func (n *Node) Query(path string) ([]*Node, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []*Node{n}
+	if strings.HasPrefix(strings.TrimSpace(path), "/") {
+		root := n
+		for root.parent != nil {
+			root = root.parent
+		}
+		nodes = []*Node{root}
+	}
+	for _, s := range steps {
+		var selected []*Node
+		seen := make(map[*Node]bool)
+		for _, context := range nodes {
+			for _, node := range s.apply(context) {
+				if !seen[node] {
+					seen[node] = true
+					selected = append(selected, node)
+				}
+			}
+		}
+		nodes = selected
+	}
+	return nodes, nil
+}
+
+// Find returns the first node selected by path (nil if there is none or path is not valid)
+func (n *Node) Find(path string) *Node {
+	nodes, err := n.Query(path)
+	if err != nil || len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+// Value returns the text of the first node selected by path ("" if there is none)
+func (n *Node) Value(path string) string {
+	if node := n.Find(path); node != nil {
+		return node.Text
+	}
+	return ""
+}
+
+// Int returns the value selected by path as an integer
+func (n *Node) Int(path string) (int, error) {
+	node, err := n.first(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(node.Text)
+}
+
+// Float returns the value selected by path as a floating point number
+func (n *Node) Float(path string) (float64, error) {
+	node, err := n.first(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(node.Text, 64)
+}
+
+// Bool returns the value selected by path as a boolean ("yes", "no" and the values of strconv.ParseBool)
+func (n *Node) Bool(path string) (bool, error) {
+	node, err := n.first(path)
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(node.Text) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return strconv.ParseBool(node.Text)
+}
+
+// Members returns the texts of the "member" children of the node selected by path (i.e. the tags of an object)
+func (n *Node) Members(path string) []string {
+	nodes, _ := n.Query(path + "/member")
+	members := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		members = append(members, node.Text)
+	}
+	return members
+}
+
+// Entries returns the "entry" children of the node
+func (n *Node) Entries() []*Node {
+	var entries []*Node
+	for _, child := range n.Children {
+		if child.Name == "entry" {
+			entries = append(entries, child)
+		}
+	}
+	return entries
+}
+
+// Entry returns the "entry" child of the node with the name attribute provided (nil if there is none)
+func (n *Node) Entry(name string) *Node {
+	for _, child := range n.Children {
+		if child.Name == "entry" && child.Attr["name"] == name {
+			return child
+		}
+	}
+	return nil
+}
+
+func (n *Node) first(path string) (*Node, error) {
+	nodes, err := n.Query(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("no value at " + path)
+	}
+	return nodes[0], nil
+}
+
+// Kinds of path steps
+const (
+	_STEP_CHILD = iota
+	_STEP_SELF
+	_STEP_PARENT
+	_STEP_ATTR
+	_STEP_TEXT
+)
+
+type pathStep struct {
+	kind       int
+	name       string
+	descendant bool
+	predicates []pathPredicate
+}
+
+type pathPredicate struct {
+	position int
+	last     bool
+	// attr or child name tested ("" for the text of the node)
+	attr, child string
+	op, value   string
+}
+
+// parsePath splits path into steps
+func parsePath(path string) ([]pathStep, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, errors.New("empty path")
+	}
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		// the document itself
+		return nil, nil
+	}
+	var steps []pathStep
+	descendant := strings.HasPrefix(path, "/")
+	if descendant {
+		path = path[1:]
+	}
+	for _, raw := range splitPath(path) {
+		if raw == "" {
+			if descendant {
+				return nil, errors.New("invalid path " + path)
+			}
+			descendant = true
+			continue
+		}
+		s, err := parseStep(raw)
+		if err != nil {
+			return nil, err
+		}
+		s.descendant, descendant = descendant, false
+		steps = append(steps, s)
+	}
+	if descendant {
+		return nil, errors.New("path ending in / " + path)
+	}
+	return steps, nil
+}
+
+// splitPath splits path on the "/" outside predicates
+func splitPath(path string) []string {
+	var parts []string
+	depth, quote, start := 0, byte(0), 0
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '/' && depth == 0:
+			parts = append(parts, path[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, path[start:])
+}
+
+func parseStep(raw string) (pathStep, error) {
+	var s pathStep
+	name := raw
+	if i := strings.Index(raw, "["); i >= 0 {
+		name = raw[:i]
+		for rest := raw[i:]; rest != ""; {
+			end := predicateEnd(rest)
+			if rest[0] != '[' || end < 0 {
+				return s, errors.New("invalid predicate in " + raw)
+			}
+			p, err := parsePredicate(strings.TrimSpace(rest[1:end]))
+			if err != nil {
+				return s, err
+			}
+			s.predicates = append(s.predicates, p)
+			rest = strings.TrimSpace(rest[end+1:])
+		}
+	}
+	name = strings.TrimSpace(name)
+	switch {
+	case name == ".":
+		s.kind = _STEP_SELF
+	case name == "..":
+		s.kind = _STEP_PARENT
+	case name == "text()":
+		s.kind = _STEP_TEXT
+	case strings.HasPrefix(name, "@") && len(name) > 1:
+		s.kind, s.name = _STEP_ATTR, name[1:]
+	case name != "" && !strings.ContainsAny(name, "@()='\"[] "):
+		s.kind, s.name = _STEP_CHILD, name
+	default:
+		return s, errors.New("invalid step " + raw)
+	}
+	return s, nil
+}
+
+// predicateEnd returns the index of the "]" closing the predicate at the start of s
+func predicateEnd(s string) int {
+	quote := byte(0)
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+func parsePredicate(expr string) (pathPredicate, error) {
+	var p pathPredicate
+	if expr == "last()" {
+		p.last = true
+		return p, nil
+	}
+	if position, err := strconv.Atoi(expr); err == nil {
+		if position < 1 {
+			return p, errors.New("invalid position " + expr)
+		}
+		p.position = position
+		return p, nil
+	}
+	lhs := expr
+	if i := strings.Index(expr, "="); i > 0 {
+		lhs, p.op, p.value = expr[:i], "=", strings.TrimSpace(expr[i+1:])
+		if strings.HasSuffix(lhs, "!") {
+			lhs, p.op = lhs[:len(lhs)-1], "!="
+		}
+		if n := len(p.value); n >= 2 && (p.value[0] == '\'' || p.value[0] == '"') && p.value[n-1] == p.value[0] {
+			p.value = p.value[1 : n-1]
+		} else if _, err := strconv.ParseFloat(p.value, 64); err != nil {
+			return p, errors.New("invalid value in predicate " + expr)
+		}
+	}
+	switch lhs = strings.TrimSpace(lhs); {
+	case lhs == "." || lhs == "text()":
+	case strings.HasPrefix(lhs, "@") && len(lhs) > 1:
+		p.attr = lhs[1:]
+	case lhs != "" && !strings.ContainsAny(lhs, "@()='\"[] /"):
+		p.child = lhs
+	default:
+		return p, errors.New("invalid predicate " + expr)
+	}
+	return p, nil
+}
+
+// apply returns the nodes selected by the step from context
+func (s pathStep) apply(context *Node) []*Node {
+	contexts := []*Node{context}
+	if s.descendant {
+		contexts = descendants(context, nil)
+	}
+	var selected []*Node
+	for _, c := range contexts {
+		var nodes []*Node
+		switch s.kind {
+		case _STEP_SELF:
+			nodes = []*Node{c}
+		case _STEP_PARENT:
+			if c.parent != nil {
+				nodes = []*Node{c.parent}
+			}
+		case _STEP_TEXT:
+			if c.Text != "" {
+				nodes = []*Node{{Name: "#text", Text: c.Text, parent: c}}
+			}
+		case _STEP_ATTR:
+			names := make([]string, 0, len(c.Attr))
+			for name := range c.Attr {
+				if s.name == "*" || s.name == name {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				nodes = append(nodes, &Node{Name: "@" + name, Text: c.Attr[name], parent: c})
+			}
+		case _STEP_CHILD:
+			for _, child := range c.Children {
+				if s.name == "*" || s.name == child.Name {
+					nodes = append(nodes, child)
+				}
+			}
+		}
+		for _, p := range s.predicates {
+			nodes = p.filter(nodes)
+		}
+		selected = append(selected, nodes...)
+	}
+	return selected
+}
+
+func descendants(n *Node, nodes []*Node) []*Node {
+	nodes = append(nodes, n)
+	for _, child := range n.Children {
+		nodes = descendants(child, nodes)
+	}
+	return nodes
+}
+
+func (p pathPredicate) filter(nodes []*Node) []*Node {
+	var kept []*Node
+	for i, n := range nodes {
+		switch {
+		case p.position > 0:
+			if i+1 == p.position {
+				kept = append(kept, n)
+			}
+		case p.last:
+			if i == len(nodes)-1 {
+				kept = append(kept, n)
+			}
+		case p.attr != "":
+			if value, ok := n.Attr[p.attr]; ok && p.match(value) {
+				kept = append(kept, n)
+			}
+		case p.child != "":
+			for _, child := range n.Children {
+				if child.Name == p.child && p.match(child.Text) {
+					kept = append(kept, n)
+					break
+				}
+			}
+		default:
+			if (p.op != "" || n.Text != "") && p.match(n.Text) {
+				kept = append(kept, n)
+			}
+		}
+	}
+	return kept
+}
+
+func (p pathPredicate) match(value string) bool {
+	switch p.op {
+	case "=":
+		return value == p.value
+	case "!=":
+		return value != p.value
+	}
+	return true
+}
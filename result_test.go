@@ -0,0 +1,142 @@
+package gopanosapi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testResult = `<address>
+  <entry name="web"><ip-netmask>10.0.0.1/32</ip-netmask><tag><member>prod</member><member>dmz</member></tag></entry>
+  <entry name="db" loc="shared"><ip-netmask>10.0.0.2/32</ip-netmask><description>db server</description></entry>
+  <entry name="mail"><fqdn>mail.example.com</fqdn><tag><member>prod</member></tag></entry>
+</address>
+<count>3</count><enabled>yes</enabled><ratio>0.5</ratio>`
+
+// describe returns "name(entry name)" for entries and "name=text" for the other nodes
+func describe(nodes []*Node) string {
+	var described []string
+	for _, node := range nodes {
+		if name, ok := node.Attr["name"]; ok {
+			described = append(described, node.Name+"("+name+")")
+		} else {
+			described = append(described, node.Name+"="+node.Text)
+		}
+	}
+	return strings.Join(described, " ")
+}
+
+func TestQuery(t *testing.T) {
+	doc, err := ParseResult([]byte(testResult))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ path, want string }{
+		{"*", "address= count=3 enabled=yes ratio=0.5"},
+		{"address/entry", "entry(web) entry(db) entry(mail)"},
+		{"address/entry[@name='db']/ip-netmask", "ip-netmask=10.0.0.2/32"},
+		{`address/entry[@name="db"]/description`, "description=db server"},
+		{"address/entry[@loc]", "entry(db)"},
+		{"address/entry[@name!='web']", "entry(db) entry(mail)"},
+		{"address/entry[fqdn]", "entry(mail)"},
+		{"address/entry[ip-netmask='10.0.0.1/32']", "entry(web)"},
+		{"address/entry[2]", "entry(db)"},
+		{"address/entry[last()]", "entry(mail)"},
+		{"address/entry[tag][2]", "entry(mail)"},
+		{"address/entry[5]", ""},
+		{"count[.=3]", "count=3"},
+		{"count[text()='4']", ""},
+		{"//member", "member=prod member=dmz member=prod"},
+		{"address//member[2]", "member=dmz"},
+		{"//member[.='prod']/../..", "entry(web) entry(mail)"},
+		{"address/entry/@name", "@name=web @name=db @name=mail"},
+		{"address/entry[@name='db']/@*", "@loc=shared @name=db"},
+		{"address/entry[1]/ip-netmask/text()", "#text=10.0.0.1/32"},
+		{"address/entry[1]/tag/text()", ""},
+		{"address/./entry[3]/.", "entry(mail)"},
+		{"/", "="},
+		{"missing/entry", ""},
+	} {
+		nodes, err := doc.Query(test.path)
+		if err != nil || describe(nodes) != test.want {
+			t.Errorf("Query(%q) = %q, %v; want %q", test.path, describe(nodes), err, test.want)
+		}
+	}
+	// absolute paths start from the document whatever the node queried
+	if nodes, err := doc.Find("address/entry[2]").Query("/count"); err != nil || describe(nodes) != "count=3" {
+		t.Errorf("Query(/count) from an entry = %q, %v", describe(nodes), err)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	doc, err := ParseResult([]byte(testResult))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		"",
+		"  ",
+		"//",
+		"address/",
+		"address///entry",
+		"address/entry[",
+		"address/entry]",
+		"address/entry[]",
+		"address/entry[0]",
+		"address/entry[-1]",
+		"address/entry[@]",
+		"address/entry[@name=web]",
+		"address/entry[@name='web]",
+		"address/entry[@name='web'",
+		"address/entry[tag/member]",
+		"address/entry[count(tag)]",
+		"address/entry[@name='web']x",
+		"address/@",
+		"address/entry()",
+		"address/en try",
+		"[1]",
+		"@",
+		"text()[",
+		"address/entry[@name='a'][",
+	} {
+		nodes, err := doc.Query(path)
+		if err == nil {
+			t.Errorf("Query(%q) = %q, want an error", path, describe(nodes))
+		}
+		if doc.Find(path) != nil || doc.Value(path) != "" {
+			t.Errorf("Find(%q) selected a node", path)
+		}
+	}
+	if _, err := ParseResult([]byte("<a><b></a>")); err == nil {
+		t.Error("ParseResult() accepted malformed XML")
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+	doc, err := ParseResult([]byte(testResult))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := doc.Int("count"); err != nil || count != 3 {
+		t.Errorf("Int(count) = %d, %v", count, err)
+	}
+	if ratio, err := doc.Float("ratio"); err != nil || ratio != 0.5 {
+		t.Errorf("Float(ratio) = %v, %v", ratio, err)
+	}
+	if enabled, err := doc.Bool("enabled"); err != nil || !enabled {
+		t.Errorf("Bool(enabled) = %v, %v", enabled, err)
+	}
+	if _, err := doc.Int("missing"); err == nil {
+		t.Error("Int(missing) succeeded")
+	}
+	if _, err := doc.Bool("address/entry[1]/ip-netmask"); err == nil {
+		t.Error("Bool() accepted an IP address")
+	}
+	if members := doc.Members("address/entry[@name='web']/tag"); !reflect.DeepEqual(members, []string{"prod", "dmz"}) {
+		t.Errorf("Members() = %q", members)
+	}
+	address := doc.Find("address")
+	if len(address.Entries()) != 3 || address.Entry("db").Value("description") != "db server" || address.Entry("ftp") != nil {
+		t.Errorf("Entries() = %q", describe(address.Entries()))
+	}
+}
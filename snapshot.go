@@ -0,0 +1,303 @@
+package gopanosapi
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configurations captured by "Snapshot()"
+const (
+	CONFIG_RUNNING = iota
+	CONFIG_CANDIDATE
+)
+
+// Kinds of configuration changes
+const (
+	CHANGE_ADDED    = "added"
+	CHANGE_REMOVED  = "removed"
+	CHANGE_MODIFIED = "modified"
+	// the entries of a list are in a different order (i.e. security rules moved)
+	CHANGE_MOVED = "moved"
+)
+
+// Attributes the device adds to the candidate configuration to track changes, ignored by the diffs
+var volatileAttrs = map[string]bool{"admin": true, "dirtyId": true, "time": true}
+
+// ConfigSnapshot is the configuration at an xpath captured at a given time
+type ConfigSnapshot struct {
+	// Source is CONFIG_RUNNING or CONFIG_CANDIDATE
+	Source int
+	Xpath  string
+	Time   time.Time
+	// Xml is the configuration element at Xpath (empty if there is none)
+	Xml []byte
+}
+
+// ConfigChange is a difference between two configurations
+type ConfigChange struct {
+	// Type is CHANGE_ADDED, CHANGE_REMOVED, CHANGE_MODIFIED or CHANGE_MOVED
+	Type string
+	// Xpath of the node changed, with entries keyed by name (i.e. ".../address/entry[@name='web']")
+	Xpath string
+	// Old and New are the XML of removed and added nodes, the text of modified nodes and attributes
+	// or the entry names of moved lists (comma separated)
+	Old, New string
+}
+
+// Snapshot captures the running (config show) or the candidate (config get) configuration at xpath
+// ("/config" if empty)
+func (apiC *ApiConnector) Snapshot(source int, xpath string) (*ConfigSnapshot, error) {
+	if xpath == "" {
+		xpath = "/config"
+	}
+	action := CONFIG_GET
+	if source == CONFIG_RUNNING {
+		action = CONFIG_SHOW
+	} else if source != CONFIG_CANDIDATE {
+		return nil, errors.New("unknown configuration source " + strconv.Itoa(source))
+	}
+	snapshot := &ConfigSnapshot{Source: source, Xpath: xpath, Time: time.Now()}
+	data, err := apiC.Config(action, xpath, "")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case apiC.LastStatus == STATUS_OK:
+		snapshot.Xml = data
+	case apiC.LastStatusCode != "7":
+		// code 7 is "No such node"
+		return nil, errors.New("config snapshot failed: " + strings.TrimSpace(apiC.LastResponseMessage))
+	}
+	return snapshot, nil
+}
+
+// Diff returns the changes from the snapshot to newer (i.e. from the running to the candidate configuration)
+func (snapshot *ConfigSnapshot) Diff(newer *ConfigSnapshot) ([]ConfigChange, error) {
+	changes, err := DiffConfig(snapshot.Xml, newer.Xml)
+	if err != nil {
+		return nil, err
+	}
+	// the xpaths of DiffConfig start at the element of the snapshot, which the xpath already names
+	steps := splitPath(strings.TrimPrefix(snapshot.Xpath, "/"))
+	parent := ""
+	if len(steps) > 1 {
+		parent = "/" + strings.Join(steps[:len(steps)-1], "/")
+	}
+	for i := range changes {
+		changes[i].Xpath = parent + changes[i].Xpath
+	}
+	return changes, nil
+}
+
+// PendingChanges returns the changes of the candidate configuration at xpath ("/config" if empty) not
+// committed yet
+func (apiC *ApiConnector) PendingChanges(xpath string) ([]ConfigChange, error) {
+	running, err := apiC.Snapshot(CONFIG_RUNNING, xpath)
+	if err != nil {
+		return nil, err
+	}
+	candidate, err := apiC.Snapshot(CONFIG_CANDIDATE, xpath)
+	if err != nil {
+		return nil, err
+	}
+	return running.Diff(candidate)
+}
+
+// RevertConfig discards the changes of the candidate configuration, which becomes the running one again
+func (apiC *ApiConnector) RevertConfig() error {
+	_, err := apiC.query("<revert><config></config></revert>", nil)
+	return err
+}
+
+// SaveConfig saves the candidate configuration in the device under name
+func (apiC *ApiConnector) SaveConfig(name string) error {
+	_, err := apiC.query("<save><config><to>"+escapeText(name)+"</to></config></save>", nil)
+	return err
+}
+
+// LoadConfig replaces the candidate configuration with the one saved under name
+// (i.e. "running-config.xml" or a name used in "SaveConfig()")
+func (apiC *ApiConnector) LoadConfig(name string) error {
+	_, err := apiC.query("<load><config><from>"+escapeText(name)+"</from></config></load>", nil)
+	return err
+}
+
+// DiffConfig compares two XML configuration fragments and returns the changes from before to after, in
+// document order. Xpaths start at the top element of the fragments. Entries are matched by name and
+// members by value, so only the ones added or removed are reported.
+func DiffConfig(before, after []byte) ([]ConfigChange, error) {
+	beforeDoc, err := ParseResult(before)
+	if err != nil {
+		return nil, err
+	}
+	afterDoc, err := ParseResult(after)
+	if err != nil {
+		return nil, err
+	}
+	var changes []ConfigChange
+	diffChildren(beforeDoc, afterDoc, "", &changes)
+	return changes, nil
+}
+
+// FormatChanges renders changes as text, one per line: "+" for added nodes, "-" for removed ones,
+// "~" for modified values and ">" for moved entries. The XML of added and removed nodes follows indented.
+func FormatChanges(changes []ConfigChange) string {
+	var b strings.Builder
+	for _, change := range changes {
+		switch change.Type {
+		case CHANGE_ADDED:
+			b.WriteString("+ " + change.Xpath + "\n    " + change.New + "\n")
+		case CHANGE_REMOVED:
+			b.WriteString("- " + change.Xpath + "\n    " + change.Old + "\n")
+		case CHANGE_MODIFIED:
+			b.WriteString("~ " + change.Xpath + ": " + strconv.Quote(change.Old) + " -> " + strconv.Quote(change.New) + "\n")
+		case CHANGE_MOVED:
+			b.WriteString("> " + change.Xpath + ": " + change.Old + " -> " + change.New + "\n")
+		}
+	}
+	return b.String()
+}
+
+func diffNodes(before, after *Node, path string, changes *[]ConfigChange) {
+	for _, name := range attrNames(before, after) {
+		if before.Attr[name] != after.Attr[name] {
+			*changes = append(*changes, ConfigChange{Type: CHANGE_MODIFIED, Xpath: path + "/@" + name,
+				Old: before.Attr[name], New: after.Attr[name]})
+		}
+	}
+	if before.Text != after.Text {
+		*changes = append(*changes, ConfigChange{Type: CHANGE_MODIFIED, Xpath: path, Old: before.Text, New: after.Text})
+	}
+	diffChildren(before, after, path, changes)
+}
+
+func diffChildren(before, after *Node, path string, changes *[]ConfigChange) {
+	oldKeys, oldChildren := keyedChildren(before)
+	newKeys, newChildren := keyedChildren(after)
+	var oldCommon, newCommon []string
+	for _, key := range oldKeys {
+		if child, ok := newChildren[key]; ok {
+			diffNodes(oldChildren[key], child, path+"/"+key, changes)
+			oldCommon = append(oldCommon, key)
+		} else {
+			*changes = append(*changes, ConfigChange{Type: CHANGE_REMOVED, Xpath: path + "/" + key,
+				Old: configXml(oldChildren[key])})
+		}
+	}
+	for _, key := range newKeys {
+		if _, ok := oldChildren[key]; !ok {
+			*changes = append(*changes, ConfigChange{Type: CHANGE_ADDED, Xpath: path + "/" + key,
+				New: configXml(newChildren[key])})
+		} else {
+			newCommon = append(newCommon, key)
+		}
+	}
+	if moved := entryOrder(oldCommon, oldChildren); moved != entryOrder(newCommon, newChildren) {
+		*changes = append(*changes, ConfigChange{Type: CHANGE_MOVED, Xpath: path + "/entry", Old: moved,
+			New: entryOrder(newCommon, newChildren)})
+	}
+}
+
+// keyedChildren returns the children of n keyed by their xpath step, in document order. Entries are
+// keyed by name, members by value and other repeated elements by position.
+func keyedChildren(n *Node) ([]string, map[string]*Node) {
+	count := make(map[string]int, len(n.Children))
+	for _, child := range n.Children {
+		count[child.Name]++
+	}
+	keys := make([]string, 0, len(n.Children))
+	children := make(map[string]*Node, len(n.Children))
+	position := make(map[string]int, len(n.Children))
+	for _, child := range n.Children {
+		key := child.Name
+		position[child.Name]++
+		if name, ok := child.Attr["name"]; ok {
+			key += "[@name=" + xpathLiteral(name) + "]"
+		} else if child.Name == "member" {
+			key += "[.=" + xpathLiteral(child.Text) + "]"
+		} else if count[child.Name] > 1 {
+			key += "[" + strconv.Itoa(position[child.Name]) + "]"
+		}
+		if _, duplicate := children[key]; !duplicate {
+			keys = append(keys, key)
+			children[key] = child
+		}
+	}
+	return keys, children
+}
+
+// entryOrder returns the names of the entries among keys, comma separated
+func entryOrder(keys []string, children map[string]*Node) string {
+	var names []string
+	for _, key := range keys {
+		if child := children[key]; child.Name == "entry" {
+			names = append(names, child.Attr["name"])
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func attrNames(before, after *Node) []string {
+	var names []string
+	for _, attrs := range []map[string]string{before.Attr, after.Attr} {
+		for name := range attrs {
+			if name != "name" && !volatileAttrs[name] {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	unique := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// xpathLiteral quotes value as an XPath string literal. XPath has no escapes, so values with both
+// kinds of quotes are built with concat().
+func xpathLiteral(value string) string {
+	switch {
+	case !strings.Contains(value, "'"):
+		return "'" + value + "'"
+	case !strings.Contains(value, "\""):
+		return "\"" + value + "\""
+	}
+	return "concat('" + strings.Join(strings.Split(value, "'"), "', \"'\", '") + "')"
+}
+
+// configXml returns the XML of n without the volatile attributes
+func configXml(n *Node) string {
+	var b bytes.Buffer
+	writeConfigNode(&b, n)
+	return b.String()
+}
+
+func writeConfigNode(b *bytes.Buffer, n *Node) {
+	b.WriteString("<" + n.Name)
+	names := make([]string, 0, len(n.Attr))
+	for name := range n.Attr {
+		if !volatileAttrs[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(" " + name + "=\"")
+		xml.EscapeText(b, []byte(n.Attr[name]))
+		b.WriteString("\"")
+	}
+	b.WriteString(">")
+	xml.EscapeText(b, []byte(n.Text))
+	for _, child := range n.Children {
+		writeConfigNode(b, child)
+	}
+	b.WriteString("</" + n.Name + ">")
+}
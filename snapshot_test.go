@@ -0,0 +1,130 @@
+package gopanosapi
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/xhoms/gopanosapi/panostest"
+)
+
+func TestDiffConfig(t *testing.T) {
+	const addresses = `<address><entry name="web"><ip-netmask>10.0.0.1/32</ip-netmask><tag><member>a</member><member>b</member></tag></entry>` +
+		`<entry name="db"><fqdn>db.local</fqdn></entry></address>`
+	for _, test := range []struct{ name, before, after, want string }{
+		{"unchanged", addresses, addresses, ""},
+		{"added", addresses,
+			`<address><entry name="web"><ip-netmask>10.0.0.1/32</ip-netmask><tag><member>a</member><member>b</member></tag></entry>` +
+				`<entry name="db"><fqdn>db.local</fqdn></entry><entry name="mail"><fqdn>mail.local</fqdn></entry></address>`,
+			"+ /address/entry[@name='mail']\n    <entry name=\"mail\"><fqdn>mail.local</fqdn></entry>\n"},
+		{"removed", addresses,
+			`<address><entry name="web"><ip-netmask>10.0.0.1/32</ip-netmask><tag><member>a</member><member>b</member></tag></entry></address>`,
+			"- /address/entry[@name='db']\n    <entry name=\"db\"><fqdn>db.local</fqdn></entry>\n"},
+		{"changed", addresses,
+			`<address><entry name="web"><ip-netmask>10.0.0.2/32</ip-netmask><tag><member>a</member><member>c</member></tag></entry>` +
+				`<entry name="db"><fqdn>db.local</fqdn></entry></address>`,
+			"~ /address/entry[@name='web']/ip-netmask: \"10.0.0.1/32\" -> \"10.0.0.2/32\"\n" +
+				"- /address/entry[@name='web']/tag/member[.='b']\n    <member>b</member>\n" +
+				"+ /address/entry[@name='web']/tag/member[.='c']\n    <member>c</member>\n"},
+		{"moved",
+			`<rules><entry name="r1"/><entry name="r2"/><entry name="r3"/></rules>`,
+			`<rules><entry name="r3"/><entry name="r1"/><entry name="r2"/></rules>`,
+			"> /rules/entry: r1, r2, r3 -> r3, r1, r2\n"},
+		{"moved and added",
+			`<rules><entry name="r1"/><entry name="r2"/></rules>`,
+			`<rules><entry name="r2"/><entry name="new"/><entry name="r1"/></rules>`,
+			"+ /rules/entry[@name='new']\n    <entry name=\"new\"></entry>\n> /rules/entry: r1, r2 -> r2, r1\n"},
+		{"attributes",
+			`<rules><entry name="r1" loc="a" admin="bob" dirtyId="1"/></rules>`,
+			`<rules><entry name="r1" loc="b" admin="alice" dirtyId="2" time="now"/></rules>`,
+			"~ /rules/entry[@name='r1']/@loc: \"a\" -> \"b\"\n"},
+		{"repeated elements",
+			`<list><item>x</item><item>y</item></list>`,
+			`<list><item>x</item><item>z</item></list>`,
+			"~ /list/item[2]: \"y\" -> \"z\"\n"},
+		{"quotes",
+			`<address><entry name="it's"/><entry name='say "hi"'/><entry name="it's &quot;x&quot;"/></address>`,
+			`<address/>`,
+			"- /address/entry[@name=\"it's\"]\n    <entry name=\"it&#39;s\"></entry>\n" +
+				"- /address/entry[@name='say \"hi\"']\n    <entry name=\"say &#34;hi&#34;\"></entry>\n" +
+				"- /address/entry[@name=concat('it', \"'\", 's \"x\"')]\n    <entry name=\"it&#39;s &#34;x&#34;\"></entry>\n"},
+	} {
+		changes, err := DiffConfig([]byte(test.before), []byte(test.after))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := FormatChanges(changes); got != test.want {
+			t.Errorf("%s: FormatChanges() =\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+	if _, err := DiffConfig([]byte("<a>"), []byte("<a/>")); err == nil {
+		t.Error("DiffConfig() accepted malformed XML")
+	}
+}
+
+func TestXpathLiteral(t *testing.T) {
+	for value, want := range map[string]string{
+		"web":      `'web'`,
+		"it's":     `"it's"`,
+		`say "hi"`: `'say "hi"'`,
+		`it's "x"`: `concat('it', "'", 's "x"')`,
+		`'"`:       `concat('', "'", '"')`,
+		`a'b'c"`:   `concat('a', "'", 'b', "'", 'c"')`,
+		"":         `''`,
+	} {
+		if got := xpathLiteral(value); got != want {
+			t.Errorf("xpathLiteral(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestPendingChangesAndRevert(t *testing.T) {
+	device := panostest.NewServer()
+	defer device.Close()
+	if err := device.SetConfig(`<config><shared><address><entry name="web"><ip-netmask>10.0.0.1/32</ip-netmask></entry></address></shared></config>`); err != nil {
+		t.Fatal(err)
+	}
+	apiC := &ApiConnector{}
+	apiC.Init(device.Host)
+	if err := apiC.Keygen(device.User, device.Password); err != nil {
+		t.Fatal(err)
+	}
+	const xpath = "/config/shared/address"
+	added := []ConfigChange{{Type: CHANGE_ADDED, Xpath: xpath + "/entry[@name='db']", New: `<entry name="db"><fqdn>db.local</fqdn></entry>`}}
+	pending := func() []ConfigChange {
+		t.Helper()
+		changes, err := apiC.PendingChanges(xpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	}
+	if _, err := apiC.Config(CONFIG_SET, xpath, `<entry name="db"><fqdn>db.local</fqdn></entry>`); err != nil {
+		t.Fatal(err)
+	}
+	if changes := pending(); !reflect.DeepEqual(changes, added) {
+		t.Errorf("PendingChanges() = %+v", changes)
+	}
+	if err := apiC.SaveConfig("with-db.xml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := apiC.RevertConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if changes := pending(); len(changes) != 0 {
+		t.Errorf("PendingChanges() after RevertConfig() = %+v", changes)
+	}
+	if err := apiC.LoadConfig("with-db.xml"); err != nil {
+		t.Fatal(err)
+	}
+	if changes := pending(); !reflect.DeepEqual(changes, added) {
+		t.Errorf("PendingChanges() after LoadConfig() = %+v", changes)
+	}
+	if err := apiC.LoadConfig("missing.xml"); err == nil {
+		t.Error("LoadConfig() of a missing configuration succeeded")
+	}
+	snapshot, err := apiC.Snapshot(CONFIG_RUNNING, "/config/shared/service")
+	if err != nil || len(snapshot.Xml) != 0 {
+		t.Errorf("Snapshot() of a missing node = %+v, %v", snapshot, err)
+	}
+}
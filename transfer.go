@@ -0,0 +1,77 @@
+package gopanosapi
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"net/url"
+)
+
+// ExportFile exports a file of category ("configuration", "certificate", "tech-support", ...) and returns its
+// content. params holds the additional parameters of the category (i.e. "certificate-name" and "format").
+func (apiC *ApiConnector) ExportFile(category string, params map[string]string) ([]byte, error) {
+	if apiC.apikey == "" {
+		return nil, apiC.reportUninit()
+	}
+	apiC.trace("ApiConnector.ExportFile: called with category = " + category)
+	q := url.Values{}
+	q.Set("type", _TYPE_EXPORT)
+	q.Add("category", category)
+	for k, v := range params {
+		q.Add(k, v)
+	}
+	q.Add("key", apiC.apikey)
+	apiC.addParams(&q)
+	content, err := apiC.call(q)
+	if err != nil {
+		return nil, err
+	}
+	// files are returned as they are, failures as a <response status="error"> document
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("<response")) {
+		var eResp genericResp
+		if xml.Unmarshal(content, &eResp) == nil && eResp.Status == STATUS_ERROR {
+			apiC.LastStatus = eResp.Status
+			apiC.LastStatusCode = eResp.Code
+			apiC.LastResponseMessage = eResp.normalizeError()
+			return nil, errors.New("export failed: " + apiC.LastResponseMessage)
+		}
+	}
+	apiC.LastStatus = STATUS_OK
+	return content, nil
+}
+
+// Import uploads content as filename to category ("configuration", "certificate", "software", ...).
+// params holds the additional parameters of the category (i.e. "certificate-name" and "format").
+func (apiC *ApiConnector) Import(category, filename string, content []byte, params map[string]string) error {
+	if apiC.apikey == "" {
+		return apiC.reportUninit()
+	}
+	apiC.trace("ApiConnector.Import: called with category = " + category + " and filename = " + filename)
+	q := url.Values{}
+	q.Set("type", _TYPE_IMPORT)
+	q.Add("category", category)
+	for k, v := range params {
+		q.Add(k, v)
+	}
+	q.Add("key", apiC.apikey)
+	apiC.addParams(&q)
+	xmlresponse, err := apiC.upload(q, &ApiFile{Name: filename, Content: content})
+	if err != nil {
+		return err
+	}
+	apiC.trace("ApiConnector.Import: response\n...\n" + string(xmlresponse) + "\n...\n")
+	var iResp genericResp
+	apiC.LastUnmarshallError = xml.Unmarshal(xmlresponse, &iResp)
+	if apiC.LastUnmarshallError != nil {
+		apiC.trace("ApiConnector.Import: Error parsing last response")
+		return apiC.LastUnmarshallError
+	}
+	apiC.LastStatus = iResp.Status
+	apiC.LastStatusCode = iResp.Code
+	apiC.LastResponseMessage = iResp.normalizeError()
+	apiC.traceResponse()
+	if iResp.Status != STATUS_OK {
+		return errors.New("import failed: " + apiC.LastResponseMessage)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package gopanosapi
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source of UID: time based flushes, retry backoffs, reconciliation, refresh
+// and mapping expiry. The default one is the system clock; ManualClock allows tests to control time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// Ticker is the ticker of a Clock (see time.Ticker)
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+type systemClock struct{}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) NewTicker(d time.Duration) Ticker       { return systemTicker{time.NewTicker(d)} }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// SystemClock returns the Clock based on the time package (the default one of UID)
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+// ManualClock is a Clock that only moves forward when told to. Tickers and timers fire during "Advance()"
+// and, like the ones of the time package, drop ticks while their channel is full.
+type ManualClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	clock  *ManualClock
+	c      chan time.Time
+	next   time.Time
+	period time.Duration
+}
+
+// NewManualClock returns a ManualClock set to now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (clock *ManualClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for ManualClock.NewTicker")
+	}
+	return clock.add(d, d)
+}
+
+func (clock *ManualClock) After(d time.Duration) <-chan time.Time {
+	return clock.add(d, 0).c
+}
+
+// Sleep advances the clock by d, so code sleeping on a ManualClock never blocks
+func (clock *ManualClock) Sleep(d time.Duration) {
+	clock.Advance(d)
+}
+
+// Advance moves the clock forward by d, firing the tickers and timers due in order
+func (clock *ManualClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	target := clock.now.Add(d)
+	for {
+		var next *manualTimer
+		for _, timer := range clock.timers {
+			if !timer.next.After(target) && (next == nil || timer.next.Before(next.next)) {
+				next = timer
+			}
+		}
+		if next == nil {
+			break
+		}
+		clock.now = next.next
+		select {
+		case next.c <- clock.now:
+		default:
+		}
+		if next.period > 0 {
+			next.next = next.next.Add(next.period)
+		} else {
+			clock.remove(next)
+		}
+	}
+	clock.now = target
+}
+
+func (clock *ManualClock) add(d, period time.Duration) *manualTimer {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	timer := &manualTimer{clock: clock, c: make(chan time.Time, 1), next: clock.now.Add(d), period: period}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+// remove drops timer from the clock. lock must be held.
+func (clock *ManualClock) remove(timer *manualTimer) {
+	for i, t := range clock.timers {
+		if t == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (timer *manualTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *manualTimer) Reset(d time.Duration) {
+	timer.clock.lock.Lock()
+	defer timer.clock.lock.Unlock()
+	timer.clock.remove(timer)
+	timer.next, timer.period = timer.clock.now.Add(d), d
+	timer.clock.timers = append(timer.clock.timers, timer)
+}
+
+func (timer *manualTimer) Stop() {
+	timer.clock.lock.Lock()
+	defer timer.clock.lock.Unlock()
+	timer.clock.remove(timer)
+}
+
+// SetClock replaces the system clock used by UID. It must be called before "Init()".
+func (uid *UID) SetClock(clock Clock) {
+	uid.dataLock.Lock()
+	uid.clock = clock
+	uid.dataLock.Unlock()
+}
+
+// SetSynchronous enables the synchronous mode, meant for unit tests: no background tasks are started,
+// changes reaching the flush policy thresholds are delivered by the call queuing them, "Flush()" delivers
+// the pending changes before returning, retry backoffs sleep on the clock and periodic tasks are run
+// by "Tick()". It must be called before "Init()".
+func (uid *UID) SetSynchronous(synchronous bool) {
+	uid.dataLock.Lock()
+	uid.synchronous = synchronous
+	uid.dataLock.Unlock()
+}
+
+// getClock returns the clock in use. dataLock must be held.
+func (uid *UID) getClock() Clock {
+	if uid.clock == nil {
+		return systemClock{}
+	}
+	return uid.clock
+}
+
+// Tick runs the periodic tasks due according to the clock: time based flush, reconciliation and
+// refresh of the expiring logins. It is only needed in synchronous mode.
+func (uid *UID) Tick() {
+	uid.dataLock.Lock()
+	if !uid.isRunning || !uid.synchronous {
+		uid.dataLock.Unlock()
+		return
+	}
+	now := uid.getClock().Now()
+	flush := due(&uid.lastFlushTick, now, uid.flushInterval)
+	reconcile := due(&uid.lastReconcile, now, uid.reconcileInterval)
+	refresh := uid.refreshBefore > 0 && due(&uid.lastRefresh, now, refreshPeriod(uid.refreshBefore))
+	uid.dataLock.Unlock()
+	if reconcile {
+		if err := uid.Reconcile(); err != nil {
+			uid.traceUnlocked("UID: reconciliation error: " + err.Error())
+		}
+	}
+	if refresh {
+		uid.refresh(now)
+	}
+	// flushing last delivers the logins refreshed above in the same tick
+	uid.dataLock.Lock()
+	flush = flush && uid.shouldFlush(true)
+	uid.dataLock.Unlock()
+	if flush {
+		uid.flush()
+		uid.drain()
+	}
+}
+
+// due tells whether a task run every interval since *last is due at now, updating *last if so
+func due(last *time.Time, now time.Time, interval time.Duration) bool {
+	if interval <= 0 || now.Sub(*last) < interval {
+		return false
+	}
+	*last = now
+	return true
+}
+
+// drain processes the jobs queued to every destination in the calling goroutine (synchronous mode)
+func (uid *UID) drain() {
+	uid.dataLock.Lock()
+	destinations := append([]*uidDestination(nil), uid.destinations...)
+	uid.dataLock.Unlock()
+	for _, dest := range destinations {
+		for queued := dest.pop(); queued != nil; queued = dest.pop() {
+			uid.process(dest, queued)
+		}
+	}
+}
+
+// sleep waits d on the clock. It returns false if UID is closed meanwhile.
+func (uid *UID) sleep(d time.Duration) bool {
+	uid.dataLock.Lock()
+	clock, synchronous := uid.getClock(), uid.synchronous
+	uid.dataLock.Unlock()
+	if synchronous {
+		clock.Sleep(d)
+		return true
+	}
+	select {
+	case <-uid.flusherQuit:
+		return false
+	case <-clock.After(d):
+		return true
+	}
+}
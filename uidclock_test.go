@@ -0,0 +1,114 @@
+package gopanosapi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTimeBasedFlush(t *testing.T) {
+	sink := &fakeSink{}
+	uid, clock := startTestUID(t, sink, func(uid *UID) { uid.SetFlushInterval(10 * time.Second) })
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	uid.Tick()
+	clock.Advance(9 * time.Second)
+	uid.Tick()
+	if got := len(sink.received()); got != 0 {
+		t.Fatalf("flushed %d payloads before the flush interval", got)
+	}
+	clock.Advance(time.Second)
+	uid.Tick()
+	if got := len(sink.received()); got != 1 {
+		t.Fatalf("sink received %d payloads after the flush interval, want 1", got)
+	}
+	// nothing pending: the next interval does not send anything
+	clock.Advance(10 * time.Second)
+	uid.Tick()
+	if got := len(sink.received()); got != 1 {
+		t.Errorf("sink received %d payloads, want 1", got)
+	}
+	// the interval is kept when an invalid one is provided
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := uid.SetFlushInterval(interval); err == nil {
+			t.Errorf("SetFlushInterval(%v) accepted", interval)
+		}
+	}
+	uid.AddLogin("acme\\alice", "10.0.0.2", time.Hour)
+	clock.Advance(10 * time.Second)
+	uid.Tick()
+	if got := len(sink.received()); got != 2 {
+		t.Errorf("sink received %d payloads, want 2", got)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	sink := &fakeSink{failures: 3}
+	uid, clock := startTestUID(t, sink, func(uid *UID) { uid.SetRetryPolicy(3, time.Second, 2*time.Second) })
+	start := clock.Now()
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	results, err := uid.Flush(context.Background())
+	if err != nil || len(results) != 1 || results[0].Attempts != 4 {
+		t.Fatalf("Flush() = %+v, %v", results, err)
+	}
+	// backoffs of 1s, 2s and 2s (capped)
+	if elapsed := clock.Now().Sub(start); elapsed != 5*time.Second {
+		t.Errorf("retries slept %v, want 5s", elapsed)
+	}
+}
+
+func TestLoginRefresh(t *testing.T) {
+	sink := &fakeSink{}
+	uid, clock := startTestUID(t, sink, func(uid *UID) {
+		uid.SetRefresh(5*time.Minute, func(mapping UidMapping) bool { return mapping.User != "acme\\alice" })
+	})
+	start := clock.Now()
+	uid.AddLogin("acme\\bob", "10.0.0.1", 10*time.Minute)
+	uid.AddLogin("acme\\alice", "10.0.0.2", 10*time.Minute)
+	uid.AddLogin("acme\\carol", "10.0.0.3", 0)
+	if _, err := uid.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(4 * time.Minute)
+	uid.Tick()
+	if got := len(sink.received()); got != 1 {
+		t.Fatalf("refreshed before the refresh margin: %d payloads", got)
+	}
+	clock.Advance(2 * time.Minute)
+	uid.Tick()
+	payloads := sent(t, sink)
+	if len(payloads) != 2 {
+		t.Fatalf("sink received %d payloads, want 2", len(payloads))
+	}
+	if got := logins(payloads[1]); len(got) != 1 || got[0] != "acme\\bob@10.0.0.1" {
+		t.Errorf("refreshed logins = %q", got)
+	}
+	clock.Advance(4 * time.Minute)
+	mappings := make(map[string]UidMapping)
+	for _, mapping := range uid.Mappings() {
+		mappings[mapping.User] = mapping
+	}
+	if _, ok := mappings["acme\\alice"]; ok || len(mappings) != 2 {
+		t.Errorf("Mappings() = %+v", mappings)
+	}
+	if expires := mappings["acme\\bob"].Expires; !expires.Equal(start.Add(16 * time.Minute)) {
+		t.Errorf("refreshed login expires at %v, want %v", expires, start.Add(16*time.Minute))
+	}
+}
+
+func TestInvalidFlushIntervalWhileRunning(t *testing.T) {
+	uid, err := NewUID(&fakeSink{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uid.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer uid.Close(context.Background())
+	// the running ticker would panic on a non-positive interval
+	if err := uid.SetFlushInterval(0); err == nil {
+		t.Error("SetFlushInterval(0) accepted")
+	}
+	if err := uid.SetFlushInterval(time.Minute); err != nil {
+		t.Error(err)
+	}
+}
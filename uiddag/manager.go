@@ -0,0 +1,325 @@
+// Package uiddag manages the tags of Dynamic Address Groups on top of the UID register/unregister operations.
+//
+// A Manager holds the desired set of tags of every IP address, expires the entries after their TTL and
+// periodically reconciles them against the "show object registered-ip" output of the device, sending
+// only the difference:
+//
+//	tags := uiddag.NewManager(&uid, &device)
+//	tags.Manage("blocklist")
+//	tags.Add("198.51.100.7", 24*time.Hour, "blocklist")
+//	tags.Start(10 * time.Minute)
+//
+// Registrations of the managed tags not declared to the Manager (i.e. left by a previous run) are removed
+// during the reconciliation. Tags not managed are never unregistered.
+package uiddag
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+// Longest registration timeout accepted by the device. Longer TTLs are registered again once the
+// device ages them out.
+const _maxTimeout = 30 * 24 * time.Hour
+
+// Sink receives the tag registrations (*gopanosapi.UID implements it)
+type Sink interface {
+	RegisterTags(ipaddr string, timeout time.Duration, tags ...string)
+	UnregisterTags(ipaddr string, tags ...string)
+}
+
+// Source reports the IP addresses registered in the device (*gopanosapi.ApiConnector implements it)
+type Source interface {
+	AllRegisteredIps() ([]gopanosapi.RegisteredIp, error)
+}
+
+var _ Sink = (*gopanosapi.UID)(nil)
+var _ Source = (*gopanosapi.ApiConnector)(nil)
+
+// Manager keeps the tags registered in the device in line with the desired ones
+type Manager struct {
+	sink    Sink
+	source  Source
+	clock   gopanosapi.Clock
+	lock    sync.Mutex
+	entries map[string]map[string]time.Time
+	managed map[string]struct{}
+	lastErr error
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewManager returns a Manager registering tags through sink. If source is nil there is no
+// reconciliation against the device and "Reconcile()" only expires entries.
+func NewManager(sink Sink, source Source) *Manager {
+	return &Manager{
+		sink:    sink,
+		source:  source,
+		clock:   gopanosapi.SystemClock(),
+		entries: make(map[string]map[string]time.Time),
+		managed: make(map[string]struct{}),
+	}
+}
+
+// SetClock replaces the clock used for the TTLs and the periodic reconciliation (i.e. the one of UID in tests)
+func (m *Manager) SetClock(clock gopanosapi.Clock) {
+	m.lock.Lock()
+	m.clock = clock
+	m.lock.Unlock()
+}
+
+// Manage declares tags as owned by the Manager, so their registrations not desired are removed by
+// "Reconcile()". Tags used in "Set()" or "Add()" are managed too.
+func (m *Manager) Manage(tags ...string) {
+	m.lock.Lock()
+	for _, tag := range tags {
+		m.managed[tag] = struct{}{}
+	}
+	m.lock.Unlock()
+}
+
+// Set replaces the tags of ip. The tags expire after ttl (zero means never).
+func (m *Manager) Set(ip string, ttl time.Duration, tags ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	keep := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		keep[tag] = struct{}{}
+	}
+	var removed []string
+	for tag := range m.entries[ip] {
+		if _, ok := keep[tag]; !ok {
+			removed = append(removed, tag)
+		}
+	}
+	m.unregister(ip, removed)
+	m.add(ip, ttl, tags)
+}
+
+// Add tags ip with tags, which expire after ttl (zero means never). Tags already set get the new TTL.
+func (m *Manager) Add(ip string, ttl time.Duration, tags ...string) {
+	m.lock.Lock()
+	m.add(ip, ttl, tags)
+	m.lock.Unlock()
+}
+
+// Remove removes tags from ip (all of them if none is provided)
+func (m *Manager) Remove(ip string, tags ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(tags) == 0 {
+		for tag := range m.entries[ip] {
+			tags = append(tags, tag)
+		}
+	}
+	var removed []string
+	for _, tag := range tags {
+		if _, ok := m.entries[ip][tag]; ok {
+			removed = append(removed, tag)
+		}
+	}
+	m.unregister(ip, removed)
+}
+
+// Tags returns the desired tags of every IP address
+func (m *Manager) Tags() map[string][]string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.expire()
+	tags := make(map[string][]string, len(m.entries))
+	for ip, entries := range m.entries {
+		tags[ip] = sortedTags(entries)
+	}
+	return tags
+}
+
+// Expire unregisters the tags whose TTL elapsed
+func (m *Manager) Expire() {
+	m.lock.Lock()
+	m.expire()
+	m.lock.Unlock()
+}
+
+// LastError returns the error of the last reconciliation (nil if it succeeded)
+func (m *Manager) LastError() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.lastErr
+}
+
+// Reconcile expires the entries whose TTL elapsed and compares the desired tags with the ones registered
+// in the device, registering the missing ones and unregistering the managed tags not desired
+func (m *Manager) Reconcile() error {
+	m.Expire()
+	if m.source == nil {
+		return nil
+	}
+	registered, err := m.source.AllRegisteredIps()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.lastErr = err; err != nil {
+		return err
+	}
+	now := m.clock.Now()
+	current := make(map[string]map[string]struct{}, len(registered))
+	for _, entry := range registered {
+		if current[entry.Ip] == nil {
+			current[entry.Ip] = make(map[string]struct{})
+		}
+		for _, tag := range entry.Tags {
+			current[entry.Ip][tag] = struct{}{}
+		}
+	}
+	for _, ip := range sortedIps(m.entries) {
+		byTimeout := make(map[time.Duration][]string)
+		for _, tag := range sortedTags(m.entries[ip]) {
+			if _, ok := current[ip][tag]; !ok {
+				timeout := registerTimeout(m.entries[ip][tag], now)
+				byTimeout[timeout] = append(byTimeout[timeout], tag)
+			}
+		}
+		for timeout, tags := range byTimeout {
+			m.sink.RegisterTags(ip, timeout, tags...)
+		}
+	}
+	for _, entry := range registered {
+		var stale []string
+		for _, tag := range entry.Tags {
+			_, managed := m.managed[tag]
+			if _, desired := m.entries[entry.Ip][tag]; managed && !desired {
+				stale = append(stale, tag)
+			}
+		}
+		if len(stale) > 0 {
+			m.sink.UnregisterTags(entry.Ip, stale...)
+		}
+	}
+	return nil
+}
+
+// Start runs "Reconcile()" now and every interval until "Stop()" is called
+func (m *Manager) Start(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("non-positive reconciliation interval")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop != nil {
+		return errors.New("reconciliation already started")
+	}
+	stop := make(chan struct{})
+	m.stop = stop
+	ticker := m.clock.NewTicker(interval)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer ticker.Stop()
+		for {
+			m.Reconcile()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C():
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends the periodic reconciliation started by "Start()"
+func (m *Manager) Stop() {
+	m.lock.Lock()
+	stop := m.stop
+	m.stop = nil
+	m.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		m.wg.Wait()
+	}
+}
+
+// add sets the expiry of the tags of ip and registers them. lock must be held.
+func (m *Manager) add(ip string, ttl time.Duration, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = m.clock.Now().Add(ttl)
+	}
+	if m.entries[ip] == nil {
+		m.entries[ip] = make(map[string]time.Time)
+	}
+	for _, tag := range tags {
+		m.entries[ip][tag] = expires
+		m.managed[tag] = struct{}{}
+	}
+	m.sink.RegisterTags(ip, registerTimeout(expires, m.clock.Now()), tags...)
+}
+
+// unregister drops the tags of ip and unregisters them. lock must be held.
+func (m *Manager) unregister(ip string, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	for _, tag := range tags {
+		delete(m.entries[ip], tag)
+	}
+	if len(m.entries[ip]) == 0 {
+		delete(m.entries, ip)
+	}
+	sort.Strings(tags)
+	m.sink.UnregisterTags(ip, tags...)
+}
+
+// expire unregisters the tags whose TTL elapsed. lock must be held.
+func (m *Manager) expire() {
+	now := m.clock.Now()
+	for _, ip := range sortedIps(m.entries) {
+		var expired []string
+		for tag, expires := range m.entries[ip] {
+			if !expires.IsZero() && !expires.After(now) {
+				expired = append(expired, tag)
+			}
+		}
+		m.unregister(ip, expired)
+	}
+}
+
+// registerTimeout returns the timeout (whole seconds, rounded up) of a registration expiring at expires
+// (zero if it never expires)
+func registerTimeout(expires, now time.Time) time.Duration {
+	if expires.IsZero() {
+		return 0
+	}
+	remaining := expires.Sub(now)
+	if remaining > _maxTimeout {
+		remaining = _maxTimeout
+	}
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	return (remaining + time.Second - 1) / time.Second * time.Second
+}
+
+func sortedTags(tags map[string]time.Time) []string {
+	sorted := make([]string, 0, len(tags))
+	for tag := range tags {
+		sorted = append(sorted, tag)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func sortedIps(entries map[string]map[string]time.Time) []string {
+	sorted := make([]string, 0, len(entries))
+	for ip := range entries {
+		sorted = append(sorted, ip)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
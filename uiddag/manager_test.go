@@ -0,0 +1,194 @@
+package uiddag
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+// recorder is a Sink and Source keeping the registered tags like a device would
+type recorder struct {
+	lock       sync.Mutex
+	operations []string
+	registered map[string]map[string]struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{registered: make(map[string]map[string]struct{})}
+}
+
+func (r *recorder) RegisterTags(ipaddr string, timeout time.Duration, tags ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.operations = append(r.operations, "register "+ipaddr+" "+timeout.String()+" "+strings.Join(tags, ","))
+	if r.registered[ipaddr] == nil {
+		r.registered[ipaddr] = make(map[string]struct{})
+	}
+	for _, tag := range tags {
+		r.registered[ipaddr][tag] = struct{}{}
+	}
+}
+
+func (r *recorder) UnregisterTags(ipaddr string, tags ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.operations = append(r.operations, "unregister "+ipaddr+" "+strings.Join(tags, ","))
+	for _, tag := range tags {
+		delete(r.registered[ipaddr], tag)
+	}
+	if len(r.registered[ipaddr]) == 0 {
+		delete(r.registered, ipaddr)
+	}
+}
+
+func (r *recorder) AllRegisteredIps() ([]gopanosapi.RegisteredIp, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ips []gopanosapi.RegisteredIp
+	for ip, tags := range r.registered {
+		entry := gopanosapi.RegisteredIp{Ip: ip}
+		for tag := range tags {
+			entry.Tags = append(entry.Tags, tag)
+		}
+		sort.Strings(entry.Tags)
+		ips = append(ips, entry)
+	}
+	return ips, nil
+}
+
+// flushed returns the operations received since the last call
+func (r *recorder) flushed() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	operations := r.operations
+	r.operations = nil
+	return operations
+}
+
+// unavailable is a Source failing like an unreachable device
+type unavailable struct{}
+
+func (unavailable) AllRegisteredIps() ([]gopanosapi.RegisteredIp, error) {
+	return nil, errors.New("connection refused")
+}
+
+func newTestManager(sink Sink, source Source) (*Manager, *gopanosapi.ManualClock) {
+	m := NewManager(sink, source)
+	clock := gopanosapi.NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	m.SetClock(clock)
+	return m, clock
+}
+
+func expectOperations(t *testing.T, r *recorder, want ...string) {
+	t.Helper()
+	if got := r.flushed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("operations = %q, want %q", got, want)
+	}
+}
+
+func TestAddAndExpire(t *testing.T) {
+	r := newRecorder()
+	m, clock := newTestManager(r, nil)
+	m.Add("10.0.0.1", time.Hour, "b", "a")
+	expectOperations(t, r, "register 10.0.0.1 1h0m0s b,a")
+	clock.Advance(30 * time.Minute)
+	m.Add("10.0.0.1", 0, "c")
+	m.Add("10.0.0.2", 90*time.Minute, "a")
+	expectOperations(t, r, "register 10.0.0.1 0s c", "register 10.0.0.2 1h30m0s a")
+	clock.Advance(30 * time.Minute)
+	if err := m.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	expectOperations(t, r, "unregister 10.0.0.1 a,b")
+	want := map[string][]string{"10.0.0.1": {"c"}, "10.0.0.2": {"a"}}
+	if tags := m.Tags(); !reflect.DeepEqual(tags, want) {
+		t.Errorf("Tags() = %v, want %v", tags, want)
+	}
+	// Set replaces the tags: the ones not provided are unregistered
+	m.Set("10.0.0.1", time.Minute, "d")
+	expectOperations(t, r, "unregister 10.0.0.1 c", "register 10.0.0.1 1m0s d")
+	clock.Advance(time.Hour)
+	if tags := m.Tags(); len(tags) != 0 {
+		t.Errorf("Tags() = %v after every TTL elapsed", tags)
+	}
+	expectOperations(t, r, "unregister 10.0.0.1 d", "unregister 10.0.0.2 a")
+}
+
+func TestReconcile(t *testing.T) {
+	device := newRecorder()
+	m, clock := newTestManager(device, device)
+	m.Manage("blocklist")
+	m.Add("10.0.0.1", 2*time.Hour, "blocklist")
+	m.Add("10.0.0.2", 0, "quarantine")
+	// left by a previous run, and registered by someone else
+	device.RegisterTags("10.0.0.9", 0, "blocklist", "other")
+	device.flushed()
+	if err := m.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	expectOperations(t, device, "unregister 10.0.0.9 blocklist")
+	// the device lost the registrations (i.e. after a reboot): they are registered again with the remaining
+	// TTL, rounded up to whole seconds
+	clock.Advance(30*time.Minute + 500*time.Millisecond)
+	device.UnregisterTags("10.0.0.1", "blocklist")
+	device.UnregisterTags("10.0.0.2", "quarantine")
+	device.flushed()
+	if err := m.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	expectOperations(t, device, "register 10.0.0.1 1h30m0s blocklist", "register 10.0.0.2 0s quarantine")
+	if err := m.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	expectOperations(t, device)
+}
+
+func TestReregisterLongTTL(t *testing.T) {
+	device := newRecorder()
+	m, clock := newTestManager(device, device)
+	m.Add("10.0.0.1", 40*24*time.Hour, "blocklist")
+	expectOperations(t, device, "register 10.0.0.1 720h0m0s blocklist")
+	// the device ages the registration out after the longest timeout it accepts
+	clock.Advance(_maxTimeout)
+	device.UnregisterTags("10.0.0.1", "blocklist")
+	device.flushed()
+	if err := m.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	expectOperations(t, device, "register 10.0.0.1 240h0m0s blocklist")
+}
+
+func TestReconcileError(t *testing.T) {
+	r := newRecorder()
+	m, clock := newTestManager(r, unavailable{})
+	m.Add("10.0.0.1", time.Minute, "blocklist")
+	r.flushed()
+	clock.Advance(time.Minute)
+	if err := m.Reconcile(); err == nil || m.LastError() != err {
+		t.Errorf("Reconcile() = %v, LastError() = %v", err, m.LastError())
+	}
+	// entries expire even if the device is unreachable
+	expectOperations(t, r, "unregister 10.0.0.1 blocklist")
+}
+
+func TestStart(t *testing.T) {
+	m := NewManager(newRecorder(), nil)
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		if err := m.Start(interval); err == nil {
+			t.Errorf("Start(%v) accepted", interval)
+		}
+	}
+	if err := m.Start(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(time.Minute); err == nil {
+		t.Error("Start() accepted twice")
+	}
+	m.Stop()
+}
@@ -0,0 +1,136 @@
+package gopanosapi
+
+import (
+	"strings"
+	"time"
+)
+
+// UidGroupSource reports the current membership of a User-ID group. Destinations implementing it
+// (like ApiConnector) are checked by "UID.Reconcile()".
+type UidGroupSource interface {
+	UserGroupMembers(group string) ([]string, error)
+}
+
+// SetGroupMembers replaces the membership of group with members. The group is only sent
+// if its membership changed. An empty list of members keeps the group without members.
+// UID only sends the groups changed since the last flush; use "Reconcile()" (or "SetReconcileInterval()")
+// to push again the groups that differ from the membership reported by the devices.
+func (uid *UID) SetGroupMembers(group string, members []string) {
+	uid.queue(uidOp{Op: _uidOpGroupSet, Group: group, Members: members})
+}
+
+// RemoveGroup stops managing group. It is sent without members in the next flush and no longer reconciled.
+func (uid *UID) RemoveGroup(group string) {
+	uid.queue(uidOp{Op: _uidOpGroupDelete, Group: group})
+}
+
+// markGroup queues group to be sent in the next flush. dataLock must be held.
+func (uid *UID) markGroup(group string) {
+	uid.dirtyGroups[group] = struct{}{}
+}
+
+// Reconcile compares the membership of the groups managed by UID with the one reported by the destinations
+// implementing UidGroupSource and queues the groups that differ to be sent in the next flush.
+// Groups already pending are not checked. Groups whose membership cannot be retrieved are queued too,
+// and the first error found is returned.
+func (uid *UID) Reconcile() error {
+	uid.dataLock.Lock()
+	uid.initState()
+	desired := make(map[string]map[string]struct{})
+	for gName, gMembers := range uid.groups {
+		if _, dirty := uid.dirtyGroups[gName]; !dirty {
+			desired[gName] = lowerMembers(gMembers)
+		}
+	}
+	var sources []UidGroupSource
+	for _, dest := range uid.destinations {
+		if dest.groups != nil {
+			sources = append(sources, dest.groups)
+		}
+	}
+	uid.dataLock.Unlock()
+	var firstErr error
+	var outOfSync []string
+	for gName, gMembers := range desired {
+		for _, source := range sources {
+			members, err := source.UserGroupMembers(gName)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			reported := make(map[string]struct{}, len(members))
+			for _, member := range members {
+				reported[member] = struct{}{}
+			}
+			if err != nil || !sameMembers(gMembers, lowerMembers(reported)) {
+				outOfSync = append(outOfSync, gName)
+				break
+			}
+		}
+	}
+	uid.dataLock.Lock()
+	for _, gName := range outOfSync {
+		_, managed := uid.groups[gName]
+		if _, dirty := uid.dirtyGroups[gName]; managed && !dirty {
+			uid.trace("UID: group " + gName + " out of sync")
+			uid.incChange(1)
+			uid.markGroup(gName)
+		}
+	}
+	uid.dataLock.Unlock()
+	return firstErr
+}
+
+// lowerMembers returns the members in lower case (usernames are case insensitive)
+func lowerMembers(members map[string]struct{}) map[string]struct{} {
+	lower := make(map[string]struct{}, len(members))
+	for member := range members {
+		lower[strings.ToLower(member)] = struct{}{}
+	}
+	return lower
+}
+
+// SetReconcileInterval enables the periodic reconciliation of the group membership (see "Reconcile()").
+// Zero (default) disables it.
+func (uid *UID) SetReconcileInterval(interval time.Duration) {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
+	uid.reconcileInterval = interval
+	switch {
+	case uid.reconciling != nil && interval > 0:
+		uid.reconciling.Reset(interval)
+	case uid.reconciling != nil:
+		uid.reconciling.Stop()
+	case uid.isRunning:
+		uid.startReconciler()
+	}
+}
+
+// startReconciler launches the periodic reconciliation if enabled. dataLock must be held.
+func (uid *UID) startReconciler() {
+	if uid.reconcileInterval <= 0 || uid.synchronous {
+		return
+	}
+	select {
+	case <-uid.tickerQuit:
+		return
+	default:
+	}
+	uid.reconciling = uid.getClock().NewTicker(uid.reconcileInterval)
+	uid.wg.Add(1)
+	go uid.reconcileRcvr(uid.reconciling)
+}
+
+func (uid *UID) reconcileRcvr(ticker Ticker) {
+	defer uid.wg.Done()
+	for {
+		select {
+		case <-ticker.C():
+			if err := uid.Reconcile(); err != nil {
+				uid.traceUnlocked("UID: reconciliation error: " + err.Error())
+			}
+		case <-uid.tickerQuit:
+			ticker.Stop()
+			return
+		}
+	}
+}
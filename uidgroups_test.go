@@ -0,0 +1,141 @@
+package gopanosapi
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// groupSink is a fakeSink reporting the group membership set in members. Groups missing from members
+// fail to be retrieved.
+type groupSink struct {
+	fakeSink
+	lock    sync.Mutex
+	members map[string][]string
+	queried []string
+}
+
+func (sink *groupSink) UserGroupMembers(group string) ([]string, error) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.queried = append(sink.queried, group)
+	members, ok := sink.members[group]
+	if !ok {
+		return nil, errors.New("group " + group + " not found")
+	}
+	return members, nil
+}
+
+func (sink *groupSink) report(group string, members ...string) {
+	sink.lock.Lock()
+	sink.members[group] = members
+	sink.queried = nil
+	sink.lock.Unlock()
+}
+
+// groups returns the groups sent in the payloads received since the last call as "group: member,member"
+func (sink *groupSink) groups(t *testing.T) []string {
+	t.Helper()
+	var groups []string
+	for _, payload := range sent(t, &sink.fakeSink) {
+		for _, entry := range payload.GroupEntries {
+			var members []string
+			for _, member := range entry.Members.Entries {
+				members = append(members, member.Name)
+			}
+			sort.Strings(members)
+			groups = append(groups, entry.Name+": "+strings.Join(members, ","))
+		}
+	}
+	sort.Strings(groups)
+	sink.fakeSink.lock.Lock()
+	sink.payloads = nil
+	sink.fakeSink.lock.Unlock()
+	return groups
+}
+
+func expectGroups(t *testing.T, sink *groupSink, want ...string) {
+	t.Helper()
+	if got := sink.groups(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("groups sent = %q, want %q", got, want)
+	}
+}
+
+func TestSetGroupMembers(t *testing.T) {
+	sink := &groupSink{members: make(map[string][]string)}
+	uid, _ := startTestUID(t, sink, nil)
+	uid.SetGroupMembers("admins", []string{"acme\\bob", "acme\\alice"})
+	uid.SetGroupMembers("users", []string{"acme\\carol"})
+	flush(t, uid)
+	expectGroups(t, sink, "admins: acme\\alice,acme\\bob", "users: acme\\carol")
+	// the same membership is not sent again
+	uid.SetGroupMembers("admins", []string{"acme\\alice", "acme\\bob"})
+	if results := flush(t, uid); len(results) != 0 {
+		t.Errorf("unchanged group flushed: %+v", results)
+	}
+	// a changed group is sent with its whole membership, an empty one without members
+	uid.SetGroupMembers("admins", []string{"acme\\alice", "acme\\dave"})
+	uid.SetGroupMembers("users", nil)
+	flush(t, uid)
+	expectGroups(t, sink, "admins: acme\\alice,acme\\dave", "users: ")
+	// deltas apply to the membership set
+	uid.AddGroupMember("users", "acme\\erin")
+	uid.RemoveGroupMember("admins", "acme\\dave")
+	flush(t, uid)
+	expectGroups(t, sink, "admins: acme\\alice", "users: acme\\erin")
+	uid.RemoveGroup("users")
+	flush(t, uid)
+	expectGroups(t, sink, "users: ")
+	// removed groups are no longer reconciled
+	sink.report("admins", "acme\\alice")
+	if err := uid.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sink.queried, []string{"admins"}) {
+		t.Errorf("groups queried = %q", sink.queried)
+	}
+}
+
+func TestReconcileGroups(t *testing.T) {
+	sink := &groupSink{members: make(map[string][]string)}
+	uid, _ := startTestUID(t, sink, nil)
+	uid.SetGroupMembers("admins", []string{"acme\\bob", "acme\\alice"})
+	uid.SetGroupMembers("users", []string{"acme\\carol"})
+	uid.SetGroupMembers("guests", nil)
+	// pending groups are not checked
+	if err := uid.Reconcile(); err != nil || len(sink.queried) != 0 {
+		t.Errorf("Reconcile() = %v, queried %q", err, sink.queried)
+	}
+	flush(t, uid)
+	sink.groups(t)
+	// the device lost a member of admins, reports an extra one in users and the same (case insensitive)
+	// members in guests
+	sink.report("admins", "acme\\bob")
+	sink.report("users", "acme\\carol", "acme\\mallory")
+	sink.report("guests")
+	if err := uid.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	flush(t, uid)
+	expectGroups(t, sink, "admins: acme\\alice,acme\\bob", "users: acme\\carol")
+	sink.report("admins", "ACME\\Alice", "acme\\bob")
+	sink.report("users", "acme\\carol")
+	if err := uid.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if results := flush(t, uid); len(results) != 0 {
+		t.Errorf("groups in sync flushed: %+v", results)
+	}
+	// a group that cannot be retrieved is sent again and the error reported
+	sink.lock.Lock()
+	delete(sink.members, "guests")
+	sink.lock.Unlock()
+	if err := uid.Reconcile(); err == nil {
+		t.Error("Reconcile() ignored a query error")
+	}
+	flush(t, uid)
+	expectGroups(t, sink, "guests: ")
+}
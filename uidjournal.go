@@ -0,0 +1,323 @@
+package gopanosapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const _uidOpLogin = "login"
+const _uidOpLogout = "logout"
+const _uidOpGroupAdd = "group-add"
+const _uidOpGroupRemove = "group-remove"
+const _uidOpGroupSet = "group-set"
+const _uidOpGroupSynced = "group-synced"
+const _uidOpGroupDelete = "group-delete"
+const _uidOpRegister = "register"
+const _uidOpUnregister = "unregister"
+const _uidOpRegisterUser = "register-user"
+const _uidOpUnregisterUser = "unregister-user"
+const _uidOpHip = "hip-report"
+
+// uidOp is a single User-ID change. Every change goes through "UID.apply()" so it can be
+// journaled to disk and replayed after a restart.
+type uidOp struct {
+	Op      string     `json:"op"`
+	User    string     `json:"user,omitempty"`
+	Ip      string     `json:"ip,omitempty"`
+	Group   string     `json:"group,omitempty"`
+	Members []string   `json:"members,omitempty"`
+	Tags    []string   `json:"tags,omitempty"`
+	Timeout string     `json:"timeout,omitempty"`
+	Hip     *HipReport `json:"hip,omitempty"`
+}
+
+// SetJournal enables a write-ahead journal for the pending User-ID changes stored in the file at path.
+// Changes found in an existing journal are queued again so they are sent in the next flush.
+// Every change is appended (and synced) to the journal before being queued, and the journal is
+// compacted after each flush so it only holds the changes not yet delivered to every destination
+// (including batches that failed after exhausting all retries, which are queued again instead of dropped).
+// Batches rejected by the device are dropped: replaying them would be rejected again.
+// Use "JournalError()" to check for write errors; a failed append is recovered by the next compaction.
+func (uid *UID) SetJournal(path string) error {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
+	uid.initState()
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var op uidOp
+			// a truncated last record (crash while appending) is skipped
+			if json.Unmarshal(scanner.Bytes(), &op) == nil {
+				uid.apply(op)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	uid.journalPath = path
+	return uid.compactJournal()
+}
+
+// JournalError returns the last error found writing the journal (nil if the last write succeeded)
+func (uid *UID) JournalError() error {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
+	return uid.journalErr
+}
+
+// journalAppend writes op to the journal. dataLock must be held.
+func (uid *UID) journalAppend(op uidOp) {
+	if uid.journal == nil {
+		return
+	}
+	data, err := json.Marshal(op)
+	if err == nil {
+		_, err = uid.journal.Write(append(data, '\n'))
+	}
+	if err == nil {
+		err = uid.journal.Sync()
+	}
+	uid.journalErr = err
+	if err != nil {
+		uid.trace("UID: unable to write journal: " + err.Error())
+	}
+}
+
+// compactJournal rewrites the journal with the current pending changes. dataLock must be held.
+func (uid *UID) compactJournal() error {
+	if uid.journalPath == "" {
+		return nil
+	}
+	err := uid.writeJournal()
+	uid.journalErr = err
+	if err != nil {
+		uid.trace("UID: unable to compact journal: " + err.Error())
+	}
+	return err
+}
+
+func (uid *UID) writeJournal() error {
+	tmpPath := uid.journalPath + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	// batches still being delivered go first so the pending changes replace them on replay
+	var ops []uidOp
+	for _, job := range uid.inflight {
+		for i := range job.batches {
+			ops = append(ops, payloadOps(&job.batches[i])...)
+		}
+	}
+	for _, op := range append(ops, uid.snapshot()...) {
+		data, _ := json.Marshal(op)
+		w.Write(append(data, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	if uid.journal != nil {
+		uid.journal.Close()
+		uid.journal = nil
+	}
+	if err = os.Rename(tmpPath, uid.journalPath); err != nil {
+		return err
+	}
+	uid.journal, err = os.OpenFile(uid.journalPath, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+func (uid *UID) closeJournal() {
+	uid.dataLock.Lock()
+	if uid.journal != nil {
+		uid.journal.Close()
+		uid.journal = nil
+	}
+	uid.journalPath = ""
+	uid.dataLock.Unlock()
+}
+
+// snapshot returns the list of operations rebuilding the current pending changes. dataLock must be held.
+func (uid *UID) snapshot() []uidOp {
+	var ops []uidOp
+	for _, entry := range uid.ip2uTransactions {
+		if entry.isLogin {
+			ops = append(ops, uidOp{Op: _uidOpLogin, User: entry.username, Ip: entry.ipaddr, Timeout: entry.timeout})
+		} else {
+			ops = append(ops, uidOp{Op: _uidOpLogout, User: entry.username, Ip: entry.ipaddr})
+		}
+	}
+	for gName, gMembers := range uid.groups {
+		// groups already sent are kept to be reconciled with the device
+		op := uidOp{Op: _uidOpGroupSynced, Group: gName}
+		if _, dirty := uid.dirtyGroups[gName]; dirty {
+			op.Op = _uidOpGroupSet
+		}
+		for member := range gMembers {
+			op.Members = append(op.Members, member)
+		}
+		ops = append(ops, op)
+	}
+	for gName := range uid.dirtyGroups {
+		if _, ok := uid.groups[gName]; !ok {
+			ops = append(ops, uidOp{Op: _uidOpGroupDelete, Group: gName})
+		}
+	}
+	ops = append(ops, tagOps(uid.ipTags, _uidOpRegister, _uidOpUnregister, false)...)
+	ops = append(ops, tagOps(uid.userTags, _uidOpRegisterUser, _uidOpUnregisterUser, true)...)
+	for _, report := range uid.hipReports {
+		hip := report
+		ops = append(ops, uidOp{Op: _uidOpHip, Hip: &hip})
+	}
+	return ops
+}
+
+func tagOps(pending map[string]map[string]tagPendingEntry, registerOp, unregisterOp string, byUser bool) []uidOp {
+	var ops []uidOp
+	for key, tags := range pending {
+		for tag, entry := range tags {
+			op := uidOp{Op: unregisterOp, Tags: []string{tag}}
+			if entry.register {
+				op.Op, op.Timeout = registerOp, entry.timeout
+			}
+			if byUser {
+				op.User = key
+			} else {
+				op.Ip = key
+			}
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// payloadOps returns the list of operations contained in a payload
+func payloadOps(p *payloadElement) []uidOp {
+	var ops []uidOp
+	for _, e := range p.LoginEntries {
+		ops = append(ops, uidOp{Op: _uidOpLogin, User: e.Name, Ip: e.Ip, Timeout: e.Timeout})
+	}
+	for _, e := range p.LogoutEntries {
+		ops = append(ops, uidOp{Op: _uidOpLogout, User: e.Name, Ip: e.Ip})
+	}
+	for _, e := range p.GroupEntries {
+		op := uidOp{Op: _uidOpGroupSet, Group: e.Name}
+		for _, m := range e.Members.Entries {
+			op.Members = append(op.Members, m.Name)
+		}
+		ops = append(ops, op)
+	}
+	for _, e := range p.RegisterEntries {
+		for _, m := range e.Tags {
+			ops = append(ops, uidOp{Op: _uidOpRegister, Ip: e.Ip, Timeout: m.Timeout, Tags: []string{m.Name}})
+		}
+	}
+	for _, e := range p.UnregisterEntries {
+		for _, m := range e.Tags {
+			ops = append(ops, uidOp{Op: _uidOpUnregister, Ip: e.Ip, Tags: []string{m.Name}})
+		}
+	}
+	for _, e := range p.RegisterUserEntries {
+		for _, m := range e.Tags {
+			ops = append(ops, uidOp{Op: _uidOpRegisterUser, User: e.User, Timeout: m.Timeout, Tags: []string{m.Name}})
+		}
+	}
+	for _, e := range p.UnregisterUserEntries {
+		for _, m := range e.Tags {
+			ops = append(ops, uidOp{Op: _uidOpUnregisterUser, User: e.User, Tags: []string{m.Name}})
+		}
+	}
+	for _, e := range p.HipReports {
+		hip := e
+		ops = append(ops, uidOp{Op: _uidOpHip, Hip: &hip})
+	}
+	return ops
+}
+
+// opKey identifies the entity an operation changes: operations with the same key replace each other
+func (uid *UID) opKey(op uidOp) string {
+	if isGroupOp(op) {
+		return "g\x00" + op.Group
+	}
+	switch op.Op {
+	case _uidOpLogin, _uidOpLogout:
+		return "m\x00" + uid.ip2uKey(op.User, op.Ip)
+	case _uidOpRegister, _uidOpUnregister:
+		return "t\x00" + op.Ip + "\x00" + strings.Join(op.Tags, "\x00")
+	case _uidOpRegisterUser, _uidOpUnregisterUser:
+		return "u\x00" + op.User + "\x00" + strings.Join(op.Tags, "\x00")
+	case _uidOpHip:
+		return "h\x00" + op.Hip.User + "\x00" + op.Hip.Ip
+	}
+	return op.Op
+}
+
+// superseded drops the undelivered operations replaced by the ones of the batches still being delivered,
+// so a newer change is not overridden when the older one is sent again. dataLock must be held.
+func (uid *UID) superseded(ops []uidOp) []uidOp {
+	newer := make(map[string]struct{})
+	for _, job := range uid.inflight {
+		for i := range job.batches {
+			for _, op := range payloadOps(&job.batches[i]) {
+				newer[uid.opKey(op)] = struct{}{}
+			}
+		}
+	}
+	kept := ops[:0]
+	for _, op := range ops {
+		if _, ok := newer[uid.opKey(op)]; !ok {
+			kept = append(kept, op)
+		}
+	}
+	return kept
+}
+
+// requeue queues again undelivered operations. Changes queued after the failed flush
+// take precedence over them. Groups are sent again with their current membership. dataLock must be held.
+func (uid *UID) requeue(ops []uidOp) {
+	var newer []uidOp
+	for _, op := range uid.snapshot() {
+		if !isGroupOp(op) {
+			newer = append(newer, op)
+		}
+	}
+	uid.ip2uTransactions = make(map[string]userPendingEntries)
+	uid.resetTags()
+	uid.cumChanges = len(uid.dirtyGroups)
+	for _, op := range ops {
+		if isGroupOp(op) {
+			if _, dirty := uid.dirtyGroups[op.Group]; !dirty {
+				uid.incChange(1)
+				uid.markGroup(op.Group)
+			}
+			continue
+		}
+		uid.apply(op)
+	}
+	for _, op := range newer {
+		uid.apply(op)
+	}
+	uid.trace("UID: " + strconv.Itoa(len(ops)) + " undelivered changes queued again")
+}
+
+func isGroupOp(op uidOp) bool {
+	switch op.Op {
+	case _uidOpGroupAdd, _uidOpGroupRemove, _uidOpGroupSet, _uidOpGroupSynced, _uidOpGroupDelete:
+		return true
+	}
+	return false
+}
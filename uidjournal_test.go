@@ -0,0 +1,193 @@
+package gopanosapi
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// describeOps returns the operations as sorted "op user ip group members tags timeout" strings,
+// leaving out the empty fields
+func describeOps(ops []uidOp) []string {
+	var described []string
+	for _, op := range ops {
+		members := append([]string(nil), op.Members...)
+		sort.Strings(members)
+		var fields []string
+		for _, field := range []string{op.Op, op.User, op.Ip, op.Group, strings.Join(members, ","), strings.Join(op.Tags, ","), op.Timeout} {
+			if field != "" {
+				fields = append(fields, field)
+			}
+		}
+		described = append(described, strings.Join(fields, " "))
+	}
+	sort.Strings(described)
+	return described
+}
+
+// pending returns the pending changes of uid
+func pending(uid *UID) []string {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
+	return describeOps(uid.snapshot())
+}
+
+// journaled returns the operations stored in the journal at path, failing on records that cannot be decoded
+func journaled(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []uidOp
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var op uidOp
+		if err := json.Unmarshal([]byte(line), &op); err != nil {
+			t.Fatalf("journal record %q: %v", line, err)
+		}
+		ops = append(ops, op)
+	}
+	return describeOps(ops)
+}
+
+// reopen replays the journal at path in a new UID
+func reopen(t *testing.T, path string) *UID {
+	t.Helper()
+	uid, err := NewUID(&fakeSink{}, UidName("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uid.SetJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(uid.closeJournal)
+	return uid
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uid.journal")
+	uid, _ := startTestUID(t, &fakeSink{}, func(uid *UID) {
+		if err := uid.SetJournal(path); err != nil {
+			t.Fatal(err)
+		}
+	})
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	uid.AddLogin("acme\\alice", "10.0.0.1", 90*time.Second)
+	uid.AddLogout("acme\\carol", "10.0.0.2")
+	uid.SetGroupMembers("admins", []string{"acme\\bob", "acme\\alice"})
+	uid.RemoveGroupMember("admins", "acme\\bob")
+	uid.RegisterTags("10.0.0.1", time.Minute, "blocklist")
+	uid.UnregisterUserTags("acme\\carol", "vip")
+	want := []string{
+		"group-set admins acme\\alice",
+		"login acme\\alice 10.0.0.1 2",
+		"logout acme\\carol 10.0.0.2",
+		"register 10.0.0.1 blocklist 60",
+		"unregister-user acme\\carol vip",
+	}
+	if got := pending(uid); !reflect.DeepEqual(got, want) {
+		t.Fatalf("pending changes = %q, want %q", got, want)
+	}
+	// every change is appended before it is queued
+	if got := journaled(t, path); len(got) != 7 {
+		t.Errorf("journal = %q, want 7 records", got)
+	}
+	if got := pending(reopen(t, path)); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed changes = %q, want %q", got, want)
+	}
+	// the journal is compacted when opened
+	if got := journaled(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("compacted journal = %q, want %q", got, want)
+	}
+	// delivered changes are removed, groups are kept to be reconciled
+	flush(t, uid)
+	want = []string{"group-synced admins acme\\alice"}
+	if got := journaled(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("journal after Flush() = %q, want %q", got, want)
+	}
+	reopened := reopen(t, path)
+	if got := pending(reopened); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed changes after Flush() = %q, want %q", got, want)
+	}
+	if reopened.cumChanges != 0 {
+		t.Errorf("synced groups replayed as %d changes", reopened.cumChanges)
+	}
+}
+
+func TestJournalTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uid.journal")
+	journal := `{"op":"login","user":"acme\\bob","ip":"10.0.0.1","timeout":"60"}` + "\n" +
+		`{"op":"register","ip":"10.0.0.1","tags":["blocklist"]}` + "\n" +
+		`{"op":"logout","user":"acme\\bob","ip":"10.0.`
+	if err := ioutil.WriteFile(path, []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"login acme\\bob 10.0.0.1 60", "register 10.0.0.1 blocklist"}
+	uid := reopen(t, path)
+	if got := pending(uid); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed changes = %q, want %q", got, want)
+	}
+	// the truncated record is dropped by the compaction, so new records are not appended to it
+	uid.AddLogout("acme\\bob", "10.0.0.1")
+	want = []string{"login acme\\bob 10.0.0.1 60", "logout acme\\bob 10.0.0.1", "register 10.0.0.1 blocklist"}
+	if got := journaled(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("journal = %q, want %q", got, want)
+	}
+	if err := uid.JournalError(); err != nil {
+		t.Errorf("JournalError() = %v", err)
+	}
+}
+
+func TestJournalRequeue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uid.journal")
+	sink := &fakeSink{failures: 1}
+	uid, _ := startTestUID(t, sink, func(uid *UID) {
+		if err := uid.SetJournal(path); err != nil {
+			t.Fatal(err)
+		}
+		uid.SetRetryPolicy(0, time.Second, time.Second)
+	})
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	uid.AddLogin("acme\\alice", "10.0.0.2", time.Hour)
+	if _, err := uid.Flush(context.Background()); err == nil {
+		t.Fatal("Flush() succeeded with an unreachable device")
+	}
+	// changes queued after the failed flush take precedence over the undelivered ones
+	uid.AddLogout("acme\\alice", "10.0.0.2")
+	want := []string{"login acme\\bob 10.0.0.1 60", "logout acme\\alice 10.0.0.2"}
+	if got := pending(uid); !reflect.DeepEqual(got, want) {
+		t.Errorf("pending changes = %q, want %q", got, want)
+	}
+	if got := pending(reopen(t, path)); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed changes = %q, want %q", got, want)
+	}
+	flush(t, uid)
+	payloads := sent(t, sink)
+	if len(payloads) != 2 || !reflect.DeepEqual(logins(payloads[1]), []string{"acme\\bob@10.0.0.1"}) ||
+		!reflect.DeepEqual(logouts(payloads[1]), []string{"acme\\alice@10.0.0.2"}) {
+		t.Errorf("sink received %q", sink.received())
+	}
+	if got := journaled(t, path); len(got) != 0 {
+		t.Errorf("journal after delivery = %q", got)
+	}
+}
+
+func TestJournalWithoutFile(t *testing.T) {
+	dir := t.TempDir()
+	uid := reopen(t, filepath.Join(dir, "uid.journal"))
+	if got := pending(uid); len(got) != 0 {
+		t.Errorf("pending changes of a new journal = %q", got)
+	}
+	if err := (&UID{}).SetJournal(filepath.Join(dir, "missing", "uid.journal")); err == nil {
+		t.Error("SetJournal() accepted a journal in a missing directory")
+	}
+}
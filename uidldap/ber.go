@@ -0,0 +1,172 @@
+package uidldap
+
+import (
+	"errors"
+	"io"
+)
+
+// BER tags used by the LDAP messages
+const (
+	_tagBoolean     = 0x01
+	_tagInteger     = 0x02
+	_tagOctetString = 0x04
+	_tagEnumerated  = 0x0a
+	_tagSequence    = 0x30
+	_tagSet         = 0x31
+)
+
+// Maximum size of a BER element read from the network
+const _maxElement = 16 * 1024 * 1024
+
+// ber is a decoded BER element: primitive elements have a value, constructed ones have children
+type ber struct {
+	tag      byte
+	value    []byte
+	children []*ber
+}
+
+func (e *ber) constructed() bool {
+	return e.tag&0x20 != 0
+}
+
+func newConstructed(tag byte, children ...*ber) *ber {
+	return &ber{tag: tag, children: children}
+}
+
+func newString(tag byte, value string) *ber {
+	return &ber{tag: tag, value: []byte(value)}
+}
+
+func newInt(tag byte, n int) *ber {
+	var value []byte
+	for {
+		value = append([]byte{byte(n)}, value...)
+		if (n >= -128 && n < 128) || len(value) == 8 {
+			break
+		}
+		n >>= 8
+	}
+	return &ber{tag: tag, value: value}
+}
+
+func newBool(value bool) *ber {
+	if value {
+		return &ber{tag: _tagBoolean, value: []byte{0xff}}
+	}
+	return &ber{tag: _tagBoolean, value: []byte{0}}
+}
+
+func (e *ber) add(children ...*ber) *ber {
+	e.children = append(e.children, children...)
+	return e
+}
+
+func (e *ber) int() int {
+	n := 0
+	for i, b := range e.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+func (e *ber) str() string {
+	return string(e.value)
+}
+
+// child returns the i-th child (an empty element if missing, so malformed messages do not panic)
+func (e *ber) child(i int) *ber {
+	if i < len(e.children) {
+		return e.children[i]
+	}
+	return &ber{}
+}
+
+func (e *ber) encode() []byte {
+	content := e.value
+	if e.constructed() {
+		content = nil
+		for _, c := range e.children {
+			content = append(content, c.encode()...)
+		}
+	}
+	out := []byte{e.tag}
+	if len(content) < 128 {
+		out = append(out, byte(len(content)))
+	} else {
+		var size []byte
+		for n := len(content); n > 0; n >>= 8 {
+			size = append([]byte{byte(n)}, size...)
+		}
+		out = append(append(out, 0x80|byte(len(size))), size...)
+	}
+	return append(out, content...)
+}
+
+// readBer reads a single element from r
+func readBer(r io.Reader) (*ber, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := int(header[1])
+	if size&0x80 != 0 {
+		octets := size & 0x7f
+		if octets == 0 || octets > 4 {
+			return nil, errors.New("ber: unsupported length")
+		}
+		long := make([]byte, octets)
+		if _, err := io.ReadFull(r, long); err != nil {
+			return nil, err
+		}
+		size = 0
+		for _, b := range long {
+			size = size<<8 | int(b)
+		}
+	}
+	if size > _maxElement {
+		return nil, errors.New("ber: element too large")
+	}
+	content := make([]byte, size)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return parseBer(header[0], content)
+}
+
+func parseBer(tag byte, content []byte) (*ber, error) {
+	e := &ber{tag: tag}
+	if !e.constructed() {
+		e.value = content
+		return e, nil
+	}
+	for len(content) > 0 {
+		if len(content) < 2 {
+			return nil, errors.New("ber: truncated element")
+		}
+		childTag, size, header := content[0], int(content[1]), 2
+		if size&0x80 != 0 {
+			octets := size & 0x7f
+			if octets == 0 || octets > 4 || len(content) < 2+octets {
+				return nil, errors.New("ber: unsupported length")
+			}
+			size = 0
+			for _, b := range content[2 : 2+octets] {
+				size = size<<8 | int(b)
+			}
+			header += octets
+		}
+		if size < 0 || len(content) < header+size {
+			return nil, errors.New("ber: truncated element")
+		}
+		child, err := parseBer(childTag, content[header:header+size])
+		if err != nil {
+			return nil, err
+		}
+		e.children = append(e.children, child)
+		content = content[header+size:]
+	}
+	return e, nil
+}
@@ -0,0 +1,100 @@
+package uidldap
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBerRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, 1 << 31, -1, -128, -129, -65536} {
+		e, err := readBer(bytes.NewReader(newInt(_tagInteger, n).encode()))
+		if err != nil || e.int() != n {
+			t.Errorf("integer %d: got %d, %v", n, e.int(), err)
+		}
+	}
+	long := strings.Repeat("x", 70000)
+	msg := message(7, newConstructed(_appSearchRequest, newString(_tagOctetString, long), newBool(true),
+		newConstructed(_tagSet, newString(_tagOctetString, ""), newInt(_tagEnumerated, 2))),
+		newConstructed(_tagControls, newPagedControl(500, "cookie")))
+	e, err := readBer(bytes.NewReader(msg.encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.encode(), msg.encode()) {
+		t.Error("message changed after decoding")
+	}
+	if e.child(0).int() != 7 || e.child(1).child(0).str() != long || e.child(1).child(2).child(1).int() != 2 {
+		t.Errorf("decoded message: id %d, %d bytes string", e.child(0).int(), len(e.child(1).child(0).str()))
+	}
+	if size, cookie, ok := pagedControl(e.child(2)); !ok || size != 500 || cookie != "cookie" {
+		t.Errorf("paged control = %d, %q, %v", size, cookie, ok)
+	}
+	// truncated messages are errors, not panics
+	data := msg.encode()
+	for _, size := range []int{1, 2, 10, len(data) - 1} {
+		if _, err := readBer(bytes.NewReader(data[:size])); err == nil {
+			t.Errorf("%d bytes of %d: no error", size, len(data))
+		}
+	}
+	if _, err := parseBer(_tagSequence, []byte{0x04, 0x85, 1, 2, 3, 4, 5}); err == nil {
+		t.Error("unsupported length: no error")
+	}
+}
+
+func TestFilterRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"(objectClass=*)",
+		"cn=vpn*",
+		`(&(objectClass=group)(|(cn=vpn-*)(cn=*admins*)(cn=a*b*c)))`,
+		`(!(sAMAccountName>=m))`,
+		`(&(uidNumber<=1000)(cn=Smith\2c John\29))`,
+	} {
+		f, err := parseFilter(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		e, err := readBer(bytes.NewReader(f.encode().encode()))
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		decoded, err := decodeFilter(e)
+		if err != nil || !reflect.DeepEqual(decoded, f) {
+			t.Errorf("%s: decoded %+v, %v, want %+v", s, decoded, err, f)
+		}
+	}
+	for _, s := range []string{"", "(cn=a", "(&(cn=a)", "(cn=a))", `(cn=\zz)`} {
+		if _, err := parseFilter(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+	if _, err := decodeFilter(newConstructed(_filterNot)); err == nil {
+		t.Error("not filter without subfilter: no error")
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	entry := &Entry{DN: "cn=vpn users,dc=acme", Attributes: map[string][]string{
+		"objectClass": {"top", "group"}, "cn": {"VPN Users"}, "uidNumber": {"500"}}}
+	for s, want := range map[string]bool{
+		"(objectclass=GROUP)":                 true,
+		"(cn=vpn*)":                           true,
+		"(cn=*users)":                         true,
+		"(cn=v*n*s)":                          true,
+		"(cn=*admins*)":                       false,
+		"(&(objectClass=group)(!(cn=other)))": true,
+		"(|(member=*)(uidNumber<=600))":       true,
+		"(cn=" + EscapeFilter("VPN*") + ")":   false,
+	} {
+		f, err := parseFilter(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if got := f.match(entry); got != want {
+			t.Errorf("%s: match = %v, want %v", s, got, want)
+		}
+	}
+}
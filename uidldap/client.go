@@ -0,0 +1,306 @@
+package uidldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LDAP protocol operations and controls (RFC 4511)
+const (
+	_appBindRequest     = 0x60
+	_appBindResponse    = 0x61
+	_appUnbindRequest   = 0x42
+	_appSearchRequest   = 0x63
+	_appSearchEntry     = 0x64
+	_appSearchDone      = 0x65
+	_appSearchReference = 0x73
+	_tagControls        = 0xa0
+	_tagSimpleAuth      = 0x80
+	_pagedResultsOID    = "1.2.840.113556.1.4.319"
+)
+
+// LDAP result codes
+const (
+	_resultSuccess            = 0
+	_resultProtocolError      = 2
+	_resultNoSuchObject       = 32
+	_resultInvalidCredentials = 49
+	_resultOther              = 80
+)
+
+// Default number of entries requested per page and timeout of every request
+const _defaultPageSize = 500
+const _defaultTimeout = 30 * time.Second
+
+// ResultError is a non successful LDAP result
+type ResultError struct {
+	Code    int
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	return "ldap: result code " + strconv.Itoa(e.Code) + ": " + e.Message
+}
+
+func message(id int, op, controls *ber) *ber {
+	msg := newConstructed(_tagSequence, newInt(_tagInteger, id), op)
+	if controls != nil {
+		msg.add(controls)
+	}
+	return msg
+}
+
+func result(tag byte, code int, diagnostic string) *ber {
+	return newConstructed(tag, newInt(_tagEnumerated, code), newString(_tagOctetString, ""),
+		newString(_tagOctetString, diagnostic))
+}
+
+func newPagedControl(size int, cookie string) *ber {
+	value := newConstructed(_tagSequence, newInt(_tagInteger, size), newString(_tagOctetString, cookie))
+	return newConstructed(_tagSequence, newString(_tagOctetString, _pagedResultsOID),
+		&ber{tag: _tagOctetString, value: value.encode()})
+}
+
+// pagedControl returns the size and cookie of the paged results control found in controls
+func pagedControl(controls *ber) (int, string, bool) {
+	for _, control := range controls.children {
+		if control.child(0).str() != _pagedResultsOID || len(control.children) < 2 {
+			continue
+		}
+		encoded := control.children[len(control.children)-1]
+		value, err := parseBer(_tagSequence, skipHeader(encoded.value))
+		if err != nil {
+			return 0, "", false
+		}
+		return value.child(0).int(), value.child(1).str(), true
+	}
+	return 0, "", false
+}
+
+// skipHeader returns the content of an encoded element
+func skipHeader(encoded []byte) []byte {
+	if len(encoded) < 2 {
+		return nil
+	}
+	header := 2
+	if encoded[1]&0x80 != 0 {
+		header += int(encoded[1] & 0x7f)
+	}
+	if header > len(encoded) {
+		return nil
+	}
+	return encoded[header:]
+}
+
+// Client is a minimal LDAPv3 client supporting simple binds and (paged) searches.
+// Clients created by "Dial()" reconnect and bind again when a request fails to be sent or answered
+// (i.e. Active Directory drops the connections idle for 15 minutes), retrying the request once.
+type Client struct {
+	conn  net.Conn
+	lock  sync.Mutex
+	msgID int
+	// dial opens a new connection (nil if the client can not reconnect)
+	dial func() (net.Conn, error)
+	// credentials of the last successful bind, provided again after reconnecting
+	bound            bool
+	bindDN, password string
+	// PageSize is the number of entries requested per page (paged results control). Zero disables paging.
+	PageSize int
+	// Timeout limits the duration of every request
+	Timeout time.Duration
+}
+
+// Dial connects to an LDAP server given as "ldap://host[:port]" or "ldaps://host[:port]".
+// config is used for ldaps (nil uses the default configuration).
+func Dial(url string, config *tls.Config) (*Client, error) {
+	var dial func() (net.Conn, error)
+	switch {
+	case strings.HasPrefix(url, "ldaps://"):
+		address := withPort(strings.TrimPrefix(url, "ldaps://"), "636")
+		dial = func() (net.Conn, error) { return tls.Dial("tcp", address, config) }
+	case strings.HasPrefix(url, "ldap://"):
+		address := withPort(strings.TrimPrefix(url, "ldap://"), "389")
+		dial = func() (net.Conn, error) { return net.Dial("tcp", address) }
+	default:
+		return nil, errors.New("ldap: unsupported URL " + url)
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	c := NewClient(conn)
+	c.dial = dial
+	return c, nil
+}
+
+func withPort(host, port string) string {
+	host = strings.TrimSuffix(host, "/")
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// NewClient returns a Client talking over an already established connection. It does not reconnect.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn, PageSize: _defaultPageSize, Timeout: _defaultTimeout}
+}
+
+// Bind authenticates with a simple bind
+func (c *Client) Bind(dn, password string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.retry(func() error { return c.bind(dn, password) })
+	if err == nil {
+		c.bound, c.bindDN, c.password = true, dn, password
+	}
+	return err
+}
+
+func (c *Client) bind(dn, password string) error {
+	op := newConstructed(_appBindRequest, newInt(_tagInteger, 3), newString(_tagOctetString, dn),
+		newString(_tagSimpleAuth, password))
+	return c.roundTrip(op, nil, func(msg *ber) (bool, error) {
+		if msg.child(1).tag != _appBindResponse {
+			return false, nil
+		}
+		return true, checkResult(msg.child(1))
+	})
+}
+
+// retry runs request and, if it failed for a reason other than an LDAP result, runs it again over a new
+// connection bound with the last credentials. lock must be held.
+func (c *Client) retry(request func() error) error {
+	err := request()
+	if _, ok := err.(*ResultError); err == nil || ok || c.dial == nil {
+		return err
+	}
+	if err = c.reconnect(); err != nil {
+		return err
+	}
+	return request()
+}
+
+// reconnect replaces the connection and binds again if needed. lock must be held.
+func (c *Client) reconnect() error {
+	c.conn.Close()
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	c.conn, c.msgID = conn, 0
+	if c.bound {
+		return c.bind(c.bindDN, c.password)
+	}
+	return nil
+}
+
+// Search returns the entries found under baseDN with scope matching filter.
+// All attributes are returned if attributes is empty.
+func (c *Client) Search(baseDN string, scope int, filter string, attributes []string) ([]*Entry, error) {
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var entries []*Entry
+	// a search interrupted by a connection failure is run again from the first page
+	err = c.retry(func() error {
+		entries, err = c.search(baseDN, scope, f, attributes)
+		return err
+	})
+	return entries, err
+}
+
+func (c *Client) search(baseDN string, scope int, f *filter, attributes []string) ([]*Entry, error) {
+	var entries []*Entry
+	cookie := ""
+	for {
+		attrs := newConstructed(_tagSequence)
+		for _, attr := range attributes {
+			attrs.add(newString(_tagOctetString, attr))
+		}
+		op := newConstructed(_appSearchRequest, newString(_tagOctetString, baseDN), newInt(_tagEnumerated, scope),
+			newInt(_tagEnumerated, 0), newInt(_tagInteger, 0), newInt(_tagInteger, 0), newBool(false),
+			f.encode(), attrs)
+		var controls *ber
+		if c.PageSize > 0 {
+			controls = newConstructed(_tagControls, newPagedControl(c.PageSize, cookie))
+		}
+		cookie = ""
+		err := c.roundTrip(op, controls, func(msg *ber) (bool, error) {
+			switch msg.child(1).tag {
+			case _appSearchEntry:
+				entries = append(entries, decodeEntry(msg.child(1)))
+			case _appSearchDone:
+				if len(msg.children) > 2 {
+					_, cookie, _ = pagedControl(msg.child(2))
+				}
+				return true, checkResult(msg.child(1))
+			}
+			return false, nil
+		})
+		if err != nil || cookie == "" {
+			return entries, err
+		}
+	}
+}
+
+// Close unbinds and closes the connection
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.msgID++
+	c.conn.Write(message(c.msgID, &ber{tag: _appUnbindRequest}, nil).encode())
+	return c.conn.Close()
+}
+
+// roundTrip sends a request and passes every response to handle until it reports the operation is done
+func (c *Client) roundTrip(op, controls *ber, handle func(msg *ber) (bool, error)) error {
+	c.msgID++
+	id := c.msgID
+	if c.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.Timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+	if _, err := c.conn.Write(message(id, op, controls).encode()); err != nil {
+		return err
+	}
+	for {
+		msg, err := readBer(c.conn)
+		if err != nil {
+			return err
+		}
+		if msg.child(0).int() != id {
+			continue
+		}
+		if done, err := handle(msg); done || err != nil {
+			return err
+		}
+	}
+}
+
+func checkResult(op *ber) error {
+	if code := op.child(0).int(); code != _resultSuccess {
+		return &ResultError{Code: code, Message: op.child(2).str()}
+	}
+	return nil
+}
+
+func decodeEntry(op *ber) *Entry {
+	entry := &Entry{DN: op.child(0).str(), Attributes: make(map[string][]string)}
+	for _, attr := range op.child(1).children {
+		var values []string
+		for _, value := range attr.child(1).children {
+			values = append(values, value.str())
+		}
+		entry.Attributes[attr.child(0).str()] = values
+	}
+	return entry
+}
@@ -0,0 +1,104 @@
+package uidldap
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// trackingListener keeps the connections accepted so tests can drop them
+type trackingListener struct {
+	net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.lock.Lock()
+		l.conns = append(l.conns, conn)
+		l.lock.Unlock()
+	}
+	return conn, err
+}
+
+// drop closes the connections accepted and returns how many there were
+func (l *trackingListener) drop() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	accepted := len(l.conns)
+	l.conns = nil
+	return accepted
+}
+
+func serve(t *testing.T, d *MemoryDirectory) *trackingListener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracking := &trackingListener{Listener: l}
+	go d.Serve(tracking)
+	t.Cleanup(func() { l.Close() })
+	return tracking
+}
+
+func TestClientSearch(t *testing.T) {
+	d := newTestDirectory()
+	d.SetPassword("cn=svc,"+_users, "secret")
+	l := serve(t, d)
+	c, err := Dial("ldap://"+l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Bind("cn=svc,"+_users, "wrong"); err == nil {
+		t.Error("bind with a wrong password did not fail")
+	}
+	if err := c.Bind("cn=svc,"+_users, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	c.PageSize = 1
+	entries, err := c.Search("dc=acme,dc=local", SCOPE_SUB, "(&(objectClass=user)(|(sAMAccountName=b*)(cn=eve)))",
+		[]string{"sAMAccountName"})
+	if err != nil || len(entries) != 2 || entries[0].Value("sAMAccountName") != "Bob" || len(entries[0].Attributes) != 1 {
+		t.Errorf("Search() = %v, %v", entries, err)
+	}
+	_, err = c.Search("dc=missing", SCOPE_SUB, "(objectClass=*)", nil)
+	if resultErr, ok := err.(*ResultError); !ok || resultErr.Code != _resultNoSuchObject {
+		t.Errorf("search of a missing base: %v", err)
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	d := newTestDirectory()
+	d.SetPassword("cn=svc,"+_users, "secret")
+	l := serve(t, d)
+	c, err := Dial("ldap://"+l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Bind("cn=svc,"+_users, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	// the server drops the idle connection
+	l.drop()
+	entries, err := c.Search(_users, SCOPE_ONE, "(objectClass=group)", nil)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Search() after the connection was dropped = %v, %v", entries, err)
+	}
+	if accepted := l.drop(); accepted != 1 {
+		t.Errorf("%d connections after reconnecting, want 1", accepted)
+	}
+	// reconnecting binds again with the same credentials
+	d.SetPassword("cn=svc,"+_users, "changed")
+	_, err = c.Search(_users, SCOPE_ONE, "(objectClass=group)", nil)
+	if resultErr, ok := err.(*ResultError); !ok || resultErr.Code != _resultInvalidCredentials {
+		t.Errorf("Search() after a password change = %v", err)
+	}
+}
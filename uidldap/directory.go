@@ -0,0 +1,336 @@
+package uidldap
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Search scopes
+const (
+	SCOPE_BASE = iota
+	SCOPE_ONE
+	SCOPE_SUB
+)
+
+// Directory is the subset of an LDAP server used by the Syncer. It is implemented by Client
+// (a real LDAP server) and MemoryDirectory (an in-memory stand-in).
+type Directory interface {
+	Search(baseDN string, scope int, filter string, attributes []string) ([]*Entry, error)
+}
+
+// Entry is an LDAP entry
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Values returns the values of attr (attribute names are case insensitive)
+func (e *Entry) Values(attr string) []string {
+	if values, ok := e.Attributes[attr]; ok {
+		return values
+	}
+	for name, values := range e.Attributes {
+		if strings.EqualFold(name, attr) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Value returns the first value of attr (empty if missing)
+func (e *Entry) Value(attr string) string {
+	if values := e.Values(attr); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// splitDN returns the RDNs of dn ("cn=a\,b,dc=x" is "cn=a\,b" and "dc=x")
+func splitDN(dn string) []string {
+	var rdns []string
+	start, escaped := 0, false
+	for i := 0; i < len(dn); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case dn[i] == '\\':
+			escaped = true
+		case dn[i] == ',' || dn[i] == ';':
+			rdns = append(rdns, strings.TrimSpace(dn[start:i]))
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(dn[start:]); rest != "" || len(rdns) > 0 {
+		rdns = append(rdns, rest)
+	}
+	return rdns
+}
+
+// NormalizeDN returns dn in lower case without blanks around the RDNs and attribute types
+func NormalizeDN(dn string) string {
+	rdns := splitDN(dn)
+	for i, rdn := range rdns {
+		if eq := strings.IndexByte(rdn, '='); eq > 0 {
+			rdn = strings.TrimSpace(rdn[:eq]) + "=" + strings.TrimSpace(rdn[eq+1:])
+		}
+		rdns[i] = strings.ToLower(rdn)
+	}
+	return strings.Join(rdns, ",")
+}
+
+// inScope tells whether the normalized dn is found searching the normalized base with scope
+func inScope(dn, base string, scope int) bool {
+	switch scope {
+	case SCOPE_BASE:
+		return dn == base
+	case SCOPE_ONE:
+		rdns := splitDN(dn)
+		return len(rdns) > 1 && strings.Join(rdns[1:], ",") == base
+	}
+	return dn == base || base == "" || strings.HasSuffix(dn, ","+base)
+}
+
+// rangeOption splits an attribute description with a range option ("member;range=1500-2999") into the
+// attribute name and the first and last value indexes (-1 for "*"). ok is false without range option.
+func rangeOption(attr string) (name string, low, high int, ok bool) {
+	i := strings.Index(strings.ToLower(attr), ";range=")
+	if i < 0 {
+		return attr, 0, 0, false
+	}
+	bounds := strings.SplitN(attr[i+len(";range="):], "-", 2)
+	if len(bounds) != 2 {
+		return attr, 0, 0, false
+	}
+	low, err := strconv.Atoi(bounds[0])
+	if err != nil || low < 0 {
+		return attr, 0, 0, false
+	}
+	high = -1
+	if bounds[1] != "*" {
+		if high, err = strconv.Atoi(bounds[1]); err != nil || high < low {
+			return attr, 0, 0, false
+		}
+	}
+	return attr[:i], low, high, true
+}
+
+// MemoryDirectory is an in-memory LDAP directory. It can be searched directly or served over the
+// network ("Serve()") to test LDAP clients.
+type MemoryDirectory struct {
+	lock      sync.Mutex
+	entries   map[string]*Entry
+	passwords map[string]string
+	maxValues int
+}
+
+// NewMemoryDirectory returns an empty directory accepting any bind
+func NewMemoryDirectory() *MemoryDirectory {
+	return &MemoryDirectory{entries: make(map[string]*Entry), passwords: make(map[string]string)}
+}
+
+// Add adds (or replaces) the entry dn
+func (d *MemoryDirectory) Add(dn string, attributes map[string][]string) {
+	entry := &Entry{DN: dn, Attributes: make(map[string][]string, len(attributes))}
+	for name, values := range attributes {
+		entry.Attributes[name] = append([]string(nil), values...)
+	}
+	d.lock.Lock()
+	d.entries[NormalizeDN(dn)] = entry
+	d.lock.Unlock()
+}
+
+// Remove deletes the entry dn
+func (d *MemoryDirectory) Remove(dn string) {
+	d.lock.Lock()
+	delete(d.entries, NormalizeDN(dn))
+	d.lock.Unlock()
+}
+
+// SetPassword defines the password of dn. Once a password is set, binds must provide valid credentials.
+func (d *MemoryDirectory) SetPassword(dn, password string) {
+	d.lock.Lock()
+	d.passwords[NormalizeDN(dn)] = password
+	d.lock.Unlock()
+}
+
+// SetMaxValueRange limits the values returned per attribute like the MaxValRange policy of Active Directory:
+// larger attributes are returned in ranges ("member;range=0-1499") to be retrieved with ranged attribute
+// descriptions ("member;range=1500-*"). Zero (default) returns all values.
+func (d *MemoryDirectory) SetMaxValueRange(max int) {
+	d.lock.Lock()
+	d.maxValues = max
+	d.lock.Unlock()
+}
+
+func (d *MemoryDirectory) Search(baseDN string, scope int, filter string, attributes []string) ([]*Entry, error) {
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	return d.search(baseDN, scope, f, attributes)
+}
+
+func (d *MemoryDirectory) search(baseDN string, scope int, f *filter, attributes []string) ([]*Entry, error) {
+	base := NormalizeDN(baseDN)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.entries[base]; !ok && base != "" {
+		return nil, &ResultError{Code: _resultNoSuchObject, Message: "no such object " + baseDN}
+	}
+	var dns []string
+	for dn := range d.entries {
+		dns = append(dns, dn)
+	}
+	sort.Strings(dns)
+	var entries []*Entry
+	for _, dn := range dns {
+		if entry := d.entries[dn]; inScope(dn, base, scope) && f.match(entry) {
+			entries = append(entries, selectAttributes(entry, attributes, d.maxValues))
+		}
+	}
+	return entries, nil
+}
+
+func selectAttributes(entry *Entry, attributes []string, maxValues int) *Entry {
+	selected := &Entry{DN: entry.DN, Attributes: make(map[string][]string)}
+	for name, values := range entry.Attributes {
+		keep, low, high := len(attributes) == 0, 0, -1
+		for _, attr := range attributes {
+			attrName, rangeLow, rangeHigh, ranged := rangeOption(attr)
+			if attr == "*" || strings.EqualFold(attrName, name) {
+				keep = true
+				if ranged {
+					low, high = rangeLow, rangeHigh
+				}
+			}
+		}
+		if !keep {
+			continue
+		}
+		if maxValues <= 0 && low == 0 && high < 0 {
+			selected.Attributes[name] = append([]string(nil), values...)
+			continue
+		}
+		if low > len(values) {
+			low = len(values)
+		}
+		end := len(values)
+		if high >= 0 && high+1 < end {
+			end = high + 1
+		}
+		if maxValues > 0 && low+maxValues < end {
+			end = low + maxValues
+		}
+		last := "*"
+		if end < len(values) {
+			last = strconv.Itoa(end - 1)
+		}
+		if low == 0 && last == "*" {
+			selected.Attributes[name] = append([]string(nil), values...)
+		} else {
+			selected.Attributes[name+";range="+strconv.Itoa(low)+"-"+last] = append([]string(nil), values[low:end]...)
+		}
+	}
+	return selected
+}
+
+// Serve answers the LDAP bind and search requests received on l until it is closed
+func (d *MemoryDirectory) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go d.serveConn(conn)
+	}
+}
+
+func (d *MemoryDirectory) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		msg, err := readBer(conn)
+		if err != nil {
+			return
+		}
+		id, op := msg.child(0).int(), msg.child(1)
+		var responses []*ber
+		switch op.tag {
+		case _appBindRequest:
+			responses = []*ber{message(id, d.bind(op.child(1).str(), op.child(2).str()), nil)}
+		case _appSearchRequest:
+			responses = d.serveSearch(id, op, msg.child(2))
+		default:
+			// unbind and unsupported operations close the connection
+			return
+		}
+		for _, response := range responses {
+			if _, err = conn.Write(response.encode()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *MemoryDirectory) bind(dn, password string) *ber {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.passwords) > 0 {
+		if expected, ok := d.passwords[NormalizeDN(dn)]; !ok || expected != password || password == "" {
+			return result(_appBindResponse, _resultInvalidCredentials, "invalid credentials")
+		}
+	}
+	return result(_appBindResponse, _resultSuccess, "")
+}
+
+// serveSearch returns the entries found and the search done message, honouring the paged results control
+func (d *MemoryDirectory) serveSearch(id int, op, controls *ber) []*ber {
+	f, err := decodeFilter(op.child(6))
+	if err != nil {
+		return []*ber{message(id, result(_appSearchDone, _resultProtocolError, err.Error()), nil)}
+	}
+	var attributes []string
+	for _, attr := range op.child(7).children {
+		attributes = append(attributes, attr.str())
+	}
+	entries, err := d.search(op.child(0).str(), op.child(1).int(), f, attributes)
+	if err != nil {
+		code, diagnostic := _resultOther, err.Error()
+		if resultErr, ok := err.(*ResultError); ok {
+			code, diagnostic = resultErr.Code, resultErr.Message
+		}
+		return []*ber{message(id, result(_appSearchDone, code, diagnostic), nil)}
+	}
+	var doneControls *ber
+	if size, cookie, ok := pagedControl(controls); ok && size > 0 {
+		offset, _ := strconv.Atoi(cookie)
+		if offset > len(entries) {
+			offset = len(entries)
+		}
+		entries = entries[offset:]
+		next := ""
+		if len(entries) > size {
+			entries, next = entries[:size], strconv.Itoa(offset+size)
+		}
+		doneControls = newConstructed(_tagControls, newPagedControl(0, next))
+	}
+	var responses []*ber
+	for _, entry := range entries {
+		attrs := newConstructed(_tagSequence)
+		for name, values := range entry.Attributes {
+			set := newConstructed(_tagSet)
+			for _, value := range values {
+				set.add(newString(_tagOctetString, value))
+			}
+			attrs.add(newConstructed(_tagSequence, newString(_tagOctetString, name), set))
+		}
+		responses = append(responses, message(id, newConstructed(_appSearchEntry, newString(_tagOctetString, entry.DN), attrs), nil))
+	}
+	return append(responses, message(id, result(_appSearchDone, _resultSuccess, ""), doneControls))
+}
@@ -0,0 +1,286 @@
+package uidldap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Filter choices (RFC 4511 section 4.5.1)
+const (
+	_filterAnd       = 0xa0
+	_filterOr        = 0xa1
+	_filterNot       = 0xa2
+	_filterEquality  = 0xa3
+	_filterSubstring = 0xa4
+	_filterGreater   = 0xa5
+	_filterLess      = 0xa6
+	_filterPresent   = 0x87
+)
+
+// filter is a parsed search filter such as "(&(objectClass=group)(cn=vpn*))"
+type filter struct {
+	op    byte
+	attr  string
+	value string
+	// substring parts (initial*any*...*final)
+	initial, final string
+	any            []string
+	subs           []*filter
+}
+
+// parseFilter parses the string representation of a search filter (RFC 4515).
+// Extensible matches are not supported.
+func parseFilter(s string) (*filter, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		s = "(" + s + ")"
+	}
+	f, rest, err := parseFilterItem(s)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, errors.New("ldap: unexpected characters after filter: " + rest)
+	}
+	return f, nil
+}
+
+func parseFilterItem(s string) (*filter, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", errors.New("ldap: filter must start with (")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", errors.New("ldap: truncated filter")
+	}
+	f := &filter{}
+	switch s[0] {
+	case '&', '|', '!':
+		f.op = map[byte]byte{'&': _filterAnd, '|': _filterOr, '!': _filterNot}[s[0]]
+		s = strings.TrimSpace(s[1:])
+		for strings.HasPrefix(s, "(") {
+			sub, rest, err := parseFilterItem(s)
+			if err != nil {
+				return nil, "", err
+			}
+			f.subs = append(f.subs, sub)
+			s = strings.TrimSpace(rest)
+		}
+		if f.op == _filterNot && len(f.subs) != 1 {
+			return nil, "", errors.New("ldap: ! requires a single filter")
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", errors.New("ldap: missing ) in filter")
+		}
+		return f, s[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("ldap: missing ) in filter")
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq < 1 {
+		return nil, "", errors.New("ldap: invalid filter item " + item)
+	}
+	f.attr, f.op = item[:eq], _filterEquality
+	switch item[eq-1] {
+	case '>':
+		f.attr, f.op = item[:eq-1], _filterGreater
+	case '<':
+		f.attr, f.op = item[:eq-1], _filterLess
+	case '~', ':':
+		return nil, "", errors.New("ldap: unsupported filter item " + item)
+	}
+	raw := item[eq+1:]
+	if f.op == _filterEquality && raw == "*" {
+		f.op = _filterPresent
+		return f, rest, nil
+	}
+	parts := strings.Split(raw, "*")
+	var err error
+	for i := range parts {
+		if parts[i], err = unescapeValue(parts[i]); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(parts) == 1 {
+		f.value = parts[0]
+		return f, rest, nil
+	}
+	if f.op != _filterEquality {
+		return nil, "", errors.New("ldap: invalid filter item " + item)
+	}
+	f.op = _filterSubstring
+	f.initial, f.final = parts[0], parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		if part != "" {
+			f.any = append(f.any, part)
+		}
+	}
+	return f, rest, nil
+}
+
+// unescapeValue decodes the \XX escapes of a filter value
+func unescapeValue(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", errors.New("ldap: invalid escape in filter value " + s)
+		}
+		n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("ldap: invalid escape in filter value " + s)
+		}
+		b.WriteByte(byte(n))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// EscapeFilter escapes the special characters of a value to be used in a search filter
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			b.WriteString("\\" + strconv.FormatUint(uint64(c)>>4, 16) + strconv.FormatUint(uint64(c)&0xf, 16))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (f *filter) encode() *ber {
+	switch f.op {
+	case _filterAnd, _filterOr, _filterNot:
+		e := newConstructed(f.op)
+		for _, sub := range f.subs {
+			e.add(sub.encode())
+		}
+		return e
+	case _filterPresent:
+		return newString(_filterPresent, f.attr)
+	case _filterSubstring:
+		parts := newConstructed(_tagSequence)
+		if f.initial != "" {
+			parts.add(newString(0x80, f.initial))
+		}
+		for _, part := range f.any {
+			parts.add(newString(0x81, part))
+		}
+		if f.final != "" {
+			parts.add(newString(0x82, f.final))
+		}
+		return newConstructed(_filterSubstring, newString(_tagOctetString, f.attr), parts)
+	}
+	return newConstructed(f.op, newString(_tagOctetString, f.attr), newString(_tagOctetString, f.value))
+}
+
+func decodeFilter(e *ber) (*filter, error) {
+	f := &filter{op: e.tag}
+	switch e.tag {
+	case _filterAnd, _filterOr, _filterNot:
+		for _, c := range e.children {
+			sub, err := decodeFilter(c)
+			if err != nil {
+				return nil, err
+			}
+			f.subs = append(f.subs, sub)
+		}
+		if e.tag == _filterNot && len(f.subs) != 1 {
+			return nil, errors.New("ldap: ! requires a single filter")
+		}
+	case _filterPresent:
+		f.attr = e.str()
+	case _filterSubstring:
+		f.attr = e.child(0).str()
+		for _, part := range e.child(1).children {
+			switch part.tag {
+			case 0x80:
+				f.initial = part.str()
+			case 0x81:
+				f.any = append(f.any, part.str())
+			case 0x82:
+				f.final = part.str()
+			}
+		}
+	case _filterEquality, _filterGreater, _filterLess:
+		f.attr, f.value = e.child(0).str(), e.child(1).str()
+	default:
+		return nil, errors.New("ldap: unsupported filter choice " + strconv.Itoa(int(e.tag)))
+	}
+	return f, nil
+}
+
+// match evaluates the filter against entry. Values are compared case insensitively.
+func (f *filter) match(entry *Entry) bool {
+	switch f.op {
+	case _filterAnd:
+		for _, sub := range f.subs {
+			if !sub.match(entry) {
+				return false
+			}
+		}
+		return true
+	case _filterOr:
+		for _, sub := range f.subs {
+			if sub.match(entry) {
+				return true
+			}
+		}
+		return false
+	case _filterNot:
+		return !f.subs[0].match(entry)
+	}
+	values := entry.Values(f.attr)
+	if f.op == _filterPresent {
+		return len(values) > 0
+	}
+	for _, value := range values {
+		value = strings.ToLower(value)
+		switch f.op {
+		case _filterEquality:
+			if value == strings.ToLower(f.value) {
+				return true
+			}
+		case _filterGreater:
+			if value >= strings.ToLower(f.value) {
+				return true
+			}
+		case _filterLess:
+			if value <= strings.ToLower(f.value) {
+				return true
+			}
+		case _filterSubstring:
+			if matchSubstring(value, strings.ToLower(f.initial), strings.ToLower(f.final), f.any) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchSubstring(value, initial, final string, any []string) bool {
+	if !strings.HasPrefix(value, initial) {
+		return false
+	}
+	value = value[len(initial):]
+	for _, part := range any {
+		i := strings.Index(value, strings.ToLower(part))
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, final)
+}
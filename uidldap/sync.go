@@ -0,0 +1,347 @@
+// Package uidldap synchronizes User-ID groups with the groups of an LDAP directory (i.e. Active Directory).
+//
+// A Syncer searches the configured base DNs and group filters, resolves nested groups, normalizes the
+// member names to the "domain\user" format and pushes the membership of every group found through the
+// UID group operations:
+//
+//	dir, _ := uidldap.Dial("ldaps://dc1.acme.local", nil)
+//	dir.Bind("cn=svc-panos,cn=users,dc=acme,dc=local", "secret")
+//	syncer := uidldap.NewSyncer(dir, &uid)
+//	syncer.AddGroupSearch("ou=groups,dc=acme,dc=local", "(cn=vpn-*)")
+//	syncer.Start(15 * time.Minute)
+//
+// MemoryDirectory is an in-memory stand-in for tests, usable directly or served over LDAP.
+package uidldap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+// Sink receives the group membership found in the directory (*gopanosapi.UID implements it)
+type Sink interface {
+	SetGroupMembers(group string, members []string)
+	RemoveGroup(group string)
+}
+
+var _ Sink = (*gopanosapi.UID)(nil)
+
+type groupSearch struct {
+	baseDN, filter string
+}
+
+// Object classes identifying groups and attributes listing their members
+var _groupClasses = []string{"group", "groupofnames", "groupofuniquenames", "posixgroup"}
+var _memberAttributes = []string{"member", "uniqueMember"}
+
+// Syncer pushes the membership of directory groups to a Sink
+type Syncer struct {
+	dir       Directory
+	sink      Sink
+	lock      sync.Mutex
+	searches  []groupSearch
+	domain    string
+	userAttrs []string
+	synced    map[string]struct{}
+	lastErr   error
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewSyncer returns a Syncer reading groups from dir. User names are taken from the sAMAccountName
+// attribute (or uid if missing).
+func NewSyncer(dir Directory, sink Sink) *Syncer {
+	return &Syncer{dir: dir, sink: sink, userAttrs: []string{"sAMAccountName", "uid"}, synced: make(map[string]struct{})}
+}
+
+// AddGroupSearch adds the groups found under baseDN (subtree) matching filter (i.e. "(cn=vpn-*)").
+// The filter is combined with the group object classes.
+func (s *Syncer) AddGroupSearch(baseDN, filter string) {
+	s.lock.Lock()
+	s.searches = append(s.searches, groupSearch{baseDN: baseDN, filter: filter})
+	s.lock.Unlock()
+}
+
+// SetDomain sets the domain (NetBIOS name) used to build the "domain\user" names. By default the
+// first domain component of the user DN is used ("cn=bob,cn=users,dc=acme,dc=local" is "acme\bob").
+func (s *Syncer) SetDomain(domain string) {
+	s.lock.Lock()
+	s.domain = domain
+	s.lock.Unlock()
+}
+
+// SetUserAttributes changes the attributes holding the user name (the first one found is used)
+func (s *Syncer) SetUserAttributes(attrs ...string) {
+	s.lock.Lock()
+	s.userAttrs = attrs
+	s.lock.Unlock()
+}
+
+// LastError returns the error of the last synchronization (nil if it succeeded)
+func (s *Syncer) LastError() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastErr
+}
+
+// resolver expands the members of the groups during a synchronization
+type resolver struct {
+	dir       Directory
+	domain    string
+	userAttrs []string
+	entries   map[string]*Entry
+	// ranged holds the groups whose members were returned in ranges
+	ranged map[string]struct{}
+}
+
+func (r *resolver) lookup(dn string) (*Entry, error) {
+	key := NormalizeDN(dn)
+	if entry, ok := r.entries[key]; ok {
+		return entry, nil
+	}
+	attrs := append([]string{"objectClass", "memberUid"}, _memberAttributes...)
+	entries, err := r.dir.Search(dn, SCOPE_BASE, "(objectClass=*)", append(attrs, r.userAttrs...))
+	if resultErr, ok := err.(*ResultError); ok && resultErr.Code == _resultNoSuchObject {
+		entries, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry *Entry
+	if len(entries) > 0 {
+		entry = entries[0]
+	}
+	r.entries[key] = entry
+	return entry, nil
+}
+
+func isGroup(entry *Entry) bool {
+	for _, class := range entry.Values("objectClass") {
+		for _, groupClass := range _groupClasses {
+			if strings.EqualFold(class, groupClass) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// values returns the values of attr of entry. Attributes returned in ranges (Active Directory returns the
+// members of large groups as "member;range=0-1499") are completed with ranged searches ("member;range=1500-*").
+func (r *resolver) values(entry *Entry, attr string) ([]string, error) {
+	values, low, high, ranged := rangedValues(entry, attr)
+	if !ranged {
+		return entry.Values(attr), nil
+	}
+	r.ranged[NormalizeDN(entry.DN)] = struct{}{}
+	if low != 0 {
+		return nil, errors.New("ldap: incomplete ranged retrieval of " + attr + " of " + entry.DN)
+	}
+	for high >= 0 {
+		next := attr + ";range=" + strconv.Itoa(high+1) + "-*"
+		entries, err := r.dir.Search(entry.DN, SCOPE_BASE, "(objectClass=*)", []string{next})
+		if err != nil {
+			return nil, err
+		}
+		var more []string
+		var nextLow int
+		if len(entries) > 0 {
+			more, nextLow, high, ranged = rangedValues(entries[0], attr)
+		}
+		if len(entries) == 0 || !ranged || nextLow != len(values) || (len(more) == 0 && high >= 0) {
+			return nil, errors.New("ldap: incomplete ranged retrieval of " + attr + " of " + entry.DN)
+		}
+		values = append(values, more...)
+	}
+	return values, nil
+}
+
+// rangedValues returns the values of attr if returned in a range, along with the range bounds
+func rangedValues(entry *Entry, attr string) ([]string, int, int, bool) {
+	for name, values := range entry.Attributes {
+		if attrName, low, high, ok := rangeOption(name); ok && strings.EqualFold(attrName, attr) {
+			return values, low, high, true
+		}
+	}
+	return nil, 0, 0, false
+}
+
+// members returns the users of group, including the ones of the nested groups
+func (r *resolver) members(group *Entry, users map[string]struct{}, visited map[string]struct{}) error {
+	key := NormalizeDN(group.DN)
+	if _, ok := visited[key]; ok {
+		return nil
+	}
+	visited[key] = struct{}{}
+	names, err := r.values(group, "memberUid")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		users[r.normalize(name, group.DN)] = struct{}{}
+	}
+	for _, attr := range _memberAttributes {
+		dns, err := r.values(group, attr)
+		if err != nil {
+			return err
+		}
+		for _, dn := range dns {
+			member, err := r.lookup(dn)
+			if err != nil {
+				return err
+			}
+			if member == nil {
+				// foreign security principals and entries out of reach
+				continue
+			}
+			if isGroup(member) {
+				if err = r.members(member, users, visited); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, userAttr := range r.userAttrs {
+				if name := member.Value(userAttr); name != "" {
+					users[r.normalize(name, member.DN)] = struct{}{}
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// normalize returns name in the "domain\user" format (in lower case, as reported by the device)
+func (r *resolver) normalize(name, dn string) string {
+	if !strings.ContainsAny(name, "\\@") {
+		domain := r.domain
+		if domain == "" {
+			for _, rdn := range splitDN(dn) {
+				if strings.HasPrefix(strings.ToLower(rdn), "dc=") {
+					domain = strings.TrimSpace(rdn[3:])
+					break
+				}
+			}
+		}
+		if domain != "" {
+			name = domain + "\\" + name
+		}
+	}
+	return strings.ToLower(name)
+}
+
+// Sync runs a single synchronization: every group found is pushed with its full membership (the Sink only
+// sends the groups whose membership changed) and the groups no longer found are removed.
+// Groups are identified by their normalized DN. Nothing is removed if the synchronization fails.
+func (s *Syncer) Sync() error {
+	s.lock.Lock()
+	searches := append([]groupSearch(nil), s.searches...)
+	r := &resolver{dir: s.dir, domain: s.domain, userAttrs: s.userAttrs, entries: make(map[string]*Entry),
+		ranged: make(map[string]struct{})}
+	s.lock.Unlock()
+	groups := make(map[string][]string)
+	err := s.collect(r, searches, groups)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastErr = err
+	if err != nil {
+		return err
+	}
+	for name, members := range groups {
+		s.sink.SetGroupMembers(name, members)
+	}
+	for name := range s.synced {
+		if _, ok := groups[name]; !ok {
+			s.sink.RemoveGroup(name)
+		}
+	}
+	s.synced = make(map[string]struct{}, len(groups))
+	for name := range groups {
+		s.synced[name] = struct{}{}
+	}
+	return nil
+}
+
+func (s *Syncer) collect(r *resolver, searches []groupSearch, groups map[string][]string) error {
+	classes := ""
+	for _, class := range _groupClasses {
+		classes += "(objectClass=" + class + ")"
+	}
+	attrs := append(append([]string{"objectClass", "memberUid"}, _memberAttributes...), r.userAttrs...)
+	for _, search := range searches {
+		filter := "(|" + classes + ")"
+		if userFilter := strings.TrimSpace(search.filter); userFilter != "" {
+			if !strings.HasPrefix(userFilter, "(") {
+				userFilter = "(" + userFilter + ")"
+			}
+			filter = "(&" + filter + userFilter + ")"
+		}
+		found, err := r.dir.Search(search.baseDN, SCOPE_SUB, filter, attrs)
+		if err != nil {
+			return err
+		}
+		for _, group := range found {
+			r.entries[NormalizeDN(group.DN)] = group
+			users := make(map[string]struct{})
+			if err = r.members(group, users, make(map[string]struct{})); err != nil {
+				return err
+			}
+			if _, ok := r.ranged[NormalizeDN(group.DN)]; ok && len(users) == 0 {
+				// a partial retrieval must not empty a large group
+				return errors.New("ldap: no members resolved for the ranged membership of " + group.DN)
+			}
+			members := make([]string, 0, len(users))
+			for user := range users {
+				members = append(members, user)
+			}
+			groups[NormalizeDN(group.DN)] = members
+		}
+	}
+	return nil
+}
+
+// Start synchronizes every interval (the first synchronization runs immediately) until "Stop()" is called
+func (s *Syncer) Start(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("ldap: non-positive synchronization interval")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stop != nil {
+		return errors.New("ldap: synchronization already started")
+	}
+	stop := make(chan struct{})
+	s.stop = stop
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.Sync()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends the periodic synchronization started by "Start()"
+func (s *Syncer) Stop() {
+	s.lock.Lock()
+	stop := s.stop
+	s.stop = nil
+	s.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		s.wg.Wait()
+	}
+}
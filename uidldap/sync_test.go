@@ -0,0 +1,163 @@
+package uidldap
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// recorder is a Sink keeping the groups pushed
+type recorder struct {
+	groups map[string][]string
+	pushes int
+}
+
+func (r *recorder) SetGroupMembers(group string, members []string) {
+	sort.Strings(members)
+	r.groups[group] = members
+	r.pushes++
+}
+
+func (r *recorder) RemoveGroup(group string) {
+	delete(r.groups, group)
+}
+
+const _users = "cn=users,dc=acme,dc=local"
+
+// newTestDirectory returns a directory with the users bob, eve and svc, the group "VPN Users" (bob,
+// a nested group with eve and a missing entry) and the group "Other" (svc)
+func newTestDirectory() *MemoryDirectory {
+	d := NewMemoryDirectory()
+	d.Add("dc=acme,dc=local", map[string][]string{"objectClass": {"domain"}})
+	d.Add(_users, map[string][]string{"objectClass": {"container"}})
+	for _, user := range []string{"Bob", "eve", "svc"} {
+		d.Add("cn="+user+","+_users, map[string][]string{"objectClass": {"user"}, "cn": {user}, "sAMAccountName": {user}})
+	}
+	d.Add("cn=VPN Users,"+_users, map[string][]string{"objectClass": {"top", "group"}, "cn": {"VPN Users"},
+		"member": {"CN=Bob,CN=Users,DC=acme,DC=local", "cn=Nested," + _users, "cn=ghost,dc=acme,dc=local"}})
+	d.Add("cn=Nested,"+_users, map[string][]string{"objectClass": {"group"}, "cn": {"Nested"},
+		"member": {"cn=eve," + _users, "cn=VPN Users," + _users}})
+	d.Add("cn=Other,"+_users, map[string][]string{"objectClass": {"group"}, "cn": {"Other"}, "member": {"cn=svc," + _users}})
+	return d
+}
+
+func TestSync(t *testing.T) {
+	d := newTestDirectory()
+	sink := &recorder{groups: make(map[string][]string)}
+	syncer := NewSyncer(d, sink)
+	syncer.AddGroupSearch("dc=acme,dc=local", "cn=vpn*")
+	syncer.AddGroupSearch(_users, "(cn=Other)")
+	if err := syncer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"cn=vpn users," + _users: {"acme\\bob", "acme\\eve"},
+		"cn=other," + _users:     {"acme\\svc"},
+	}
+	if !reflect.DeepEqual(sink.groups, want) {
+		t.Errorf("groups = %v, want %v", sink.groups, want)
+	}
+	d.Remove("cn=Other," + _users)
+	if err := syncer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "cn=other,"+_users)
+	if !reflect.DeepEqual(sink.groups, want) {
+		t.Errorf("groups after removal = %v, want %v", sink.groups, want)
+	}
+	// a failed synchronization removes nothing
+	syncer.AddGroupSearch("ou=missing,dc=acme,dc=local", "")
+	if err := syncer.Sync(); err == nil || syncer.LastError() != err {
+		t.Errorf("Sync() = %v, LastError() = %v", err, syncer.LastError())
+	}
+	if !reflect.DeepEqual(sink.groups, want) {
+		t.Errorf("groups after a failed synchronization = %v, want %v", sink.groups, want)
+	}
+}
+
+// addLargeGroup adds the group "Large" with n members
+func addLargeGroup(d *MemoryDirectory, n int) []string {
+	var members, want []string
+	for i := 0; i < n; i++ {
+		user := fmt.Sprintf("user%03d", i)
+		d.Add("cn="+user+","+_users, map[string][]string{"objectClass": {"user"}, "sAMAccountName": {user}})
+		members = append(members, "cn="+user+","+_users)
+		want = append(want, "acme\\"+user)
+	}
+	d.Add("cn=Large,"+_users, map[string][]string{"objectClass": {"group"}, "cn": {"Large"}, "member": members})
+	return want
+}
+
+func TestSyncRangedMembers(t *testing.T) {
+	d := newTestDirectory()
+	d.SetMaxValueRange(4)
+	want := addLargeGroup(d, 10)
+	sink := &recorder{groups: make(map[string][]string)}
+	syncer := NewSyncer(d, sink)
+	syncer.AddGroupSearch(_users, "(cn=Large)")
+	if err := syncer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.groups["cn=large,"+_users]; !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want %v", got, want)
+	}
+}
+
+// partialDirectory returns only the first range of the ranged attributes
+type partialDirectory struct {
+	*MemoryDirectory
+}
+
+func (d partialDirectory) Search(baseDN string, scope int, filter string, attributes []string) ([]*Entry, error) {
+	for _, attr := range attributes {
+		if _, low, _, ok := rangeOption(attr); ok && low > 0 {
+			return d.MemoryDirectory.Search(baseDN, scope, filter, []string{"objectClass"})
+		}
+	}
+	return d.MemoryDirectory.Search(baseDN, scope, filter, attributes)
+}
+
+func TestSyncRefusesPartialRanges(t *testing.T) {
+	d := newTestDirectory()
+	d.SetMaxValueRange(4)
+	addLargeGroup(d, 10)
+	sink := &recorder{groups: make(map[string][]string)}
+	syncer := NewSyncer(partialDirectory{d}, sink)
+	syncer.AddGroupSearch(_users, "(cn=Large)")
+	if err := syncer.Sync(); err == nil || sink.pushes != 0 {
+		t.Errorf("incomplete ranged retrieval: Sync() = %v, %d groups pushed", err, sink.pushes)
+	}
+
+	// a ranged membership resolving to no users is not pushed either
+	d = NewMemoryDirectory()
+	d.SetMaxValueRange(2)
+	d.Add(_users, map[string][]string{"objectClass": {"container"}})
+	d.Add("cn=Ghosts,"+_users, map[string][]string{"objectClass": {"group"}, "cn": {"Ghosts"},
+		"member": {"cn=a,dc=gone", "cn=b,dc=gone", "cn=c,dc=gone"}})
+	syncer = NewSyncer(d, sink)
+	syncer.AddGroupSearch(_users, "(cn=Ghosts)")
+	if err := syncer.Sync(); err == nil || sink.pushes != 0 {
+		t.Errorf("empty ranged membership: Sync() = %v, %d groups pushed", err, sink.pushes)
+	}
+}
+
+func TestStart(t *testing.T) {
+	sink := &recorder{groups: make(map[string][]string)}
+	syncer := NewSyncer(newTestDirectory(), sink)
+	syncer.AddGroupSearch(_users, "(cn=Other)")
+	if err := syncer.Start(0); err == nil {
+		t.Error("Start(0) did not fail")
+	}
+	if err := syncer.Start(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncer.Start(time.Hour); err == nil {
+		t.Error("second Start() did not fail")
+	}
+	syncer.Stop()
+	if len(sink.groups) != 1 {
+		t.Errorf("groups = %v", sink.groups)
+	}
+}
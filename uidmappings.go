@@ -0,0 +1,145 @@
+package gopanosapi
+
+import (
+	"strconv"
+	"time"
+)
+
+// UidMapping is a login queued through UID and not logged out yet
+type UidMapping struct {
+	User, Ip string
+	// Timeout is the one sent to the device: the one provided to "AddLogin()" rounded up to minutes
+	// (zero means the device default)
+	Timeout time.Duration
+	// Expires is when the device ages the mapping out (zero if the login has no timeout)
+	Expires time.Time
+}
+
+// loginTimeout returns the timeout attribute of a login: minutes, rounded up (empty for the device default)
+func loginTimeout(timeout time.Duration) string {
+	if timeout <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64((timeout+time.Minute-1)/time.Minute), 10)
+}
+
+// track updates the mapping table with op. dataLock must be held.
+func (uid *UID) track(op uidOp) {
+	if uid.mappings == nil {
+		uid.mappings = make(map[string]UidMapping)
+	}
+	key := uid.ip2uKey(op.User, op.Ip)
+	switch op.Op {
+	case _uidOpLogin:
+		mapping := UidMapping{User: op.User, Ip: op.Ip}
+		if minutes, err := strconv.Atoi(op.Timeout); err == nil {
+			mapping.Timeout = time.Duration(minutes) * time.Minute
+		}
+		if mapping.Timeout > 0 {
+			mapping.Expires = uid.getClock().Now().Add(mapping.Timeout)
+		}
+		uid.mappings[key] = mapping
+	case _uidOpLogout:
+		delete(uid.mappings, key)
+	}
+}
+
+// expire drops the mappings already aged out by the device. dataLock must be held.
+func (uid *UID) expire(now time.Time) {
+	for key, mapping := range uid.mappings {
+		if !mapping.Expires.IsZero() && !mapping.Expires.After(now) {
+			delete(uid.mappings, key)
+		}
+	}
+}
+
+// Mappings returns the logins queued and neither logged out nor expired
+func (uid *UID) Mappings() []UidMapping {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
+	uid.expire(uid.getClock().Now())
+	mappings := make([]UidMapping, 0, len(uid.mappings))
+	for _, mapping := range uid.mappings {
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// SetRefresh enables a refresher that queues again the logins expiring within before, so long-lived
+// sessions do not lose their identity when the device ages the mapping out. If active is not nil,
+// only the mappings it reports as active are refreshed; otherwise mappings are refreshed until logged out.
+// Logins without timeout are never refreshed. Zero disables the refresher (default).
+func (uid *UID) SetRefresh(before time.Duration, active func(mapping UidMapping) bool) {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
+	uid.refreshBefore, uid.refreshActive = before, active
+	switch {
+	case uid.refreshing != nil && before > 0:
+		uid.refreshing.Reset(refreshPeriod(before))
+	case uid.refreshing != nil:
+		uid.refreshing.Stop()
+	case uid.isRunning:
+		uid.startRefresher()
+	}
+}
+
+// refreshPeriod is how often mappings are checked: a quarter of the refresh margin, between 1s and 1m
+func refreshPeriod(before time.Duration) time.Duration {
+	period := before / 4
+	if period < time.Second {
+		return time.Second
+	}
+	if period > time.Minute {
+		return time.Minute
+	}
+	return period
+}
+
+// startRefresher launches the refresher if enabled. dataLock must be held.
+func (uid *UID) startRefresher() {
+	if uid.refreshBefore <= 0 || uid.synchronous {
+		return
+	}
+	select {
+	case <-uid.tickerQuit:
+		return
+	default:
+	}
+	uid.refreshing = uid.getClock().NewTicker(refreshPeriod(uid.refreshBefore))
+	uid.wg.Add(1)
+	go uid.refreshRcvr(uid.refreshing)
+}
+
+func (uid *UID) refreshRcvr(ticker Ticker) {
+	defer uid.wg.Done()
+	for {
+		select {
+		case now := <-ticker.C():
+			uid.refresh(now)
+		case <-uid.tickerQuit:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// refresh queues again the logins expiring before now plus the refresh margin
+func (uid *UID) refresh(now time.Time) {
+	uid.dataLock.Lock()
+	uid.expire(now)
+	deadline := now.Add(uid.refreshBefore)
+	var expiring []UidMapping
+	for _, mapping := range uid.mappings {
+		if !mapping.Expires.IsZero() && mapping.Expires.Before(deadline) {
+			expiring = append(expiring, mapping)
+		}
+	}
+	active := uid.refreshActive
+	uid.dataLock.Unlock()
+	for _, mapping := range expiring {
+		if active == nil || active(mapping) {
+			uid.traceUnlocked("UID: refreshing login of " + mapping.User + " at " + mapping.Ip)
+			uid.AddLogin(mapping.User, mapping.Ip, mapping.Timeout)
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package gopanosapi
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
+	"log"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -10,15 +15,63 @@ const UIDVERSION string = "2.0"
 const UIDTYPE string = "update"
 const MAXCHANGES int = 100
 
+const _uidFlushInterval = 2000 * time.Millisecond
+const _uidRetries = 3
+const _uidBackoff = time.Second
+const _uidMaxBackoff = 30 * time.Second
+
+// UidFlushResult describes the outcome of sending a batch of User-ID changes to the device
+type UidFlushResult struct {
+	// Payload is the uid-message sent to the device
+	Payload []byte
+	// Entries is the number of entries in the batch
+	Entries int
+	// Attempts is the number of times the batch was sent
+	Attempts int
+	// Status is the status returned by the device for the last attempt (if any)
+	Status string
+	// Failures lists the entries rejected by the device
+	Failures []UidFailure
+	// Err is set if the batch was not accepted by the device
+	Err error
+	// Rejected tells the device answered with an error status. Rejected batches are neither retried
+	// nor queued again by the journal.
+	Rejected bool
+	// Destination is the name of the destination the batch was sent to
+	Destination string
+}
+
+// Flush policies (see "SetFlushPolicy()")
+const (
+	// Flush when the flush interval elapses or the max batch size is reached (default)
+	FLUSH_SIZE_OR_TIME = iota
+	// Flush only when the max batch size is reached
+	FLUSH_SIZE_ONLY
+	// Flush only when the flush interval elapses
+	FLUSH_TIME_ONLY
+	// Flush as soon as a change is queued
+	FLUSH_IMMEDIATE
+)
+
+type uidRetryPolicy struct {
+	retries             int
+	backoff, maxBackoff time.Duration
+}
+
 type groupMemberEntry struct {
 	XMLName xml.Name `xml:"entry"`
 	Name    string   `xml:"name,attr"`
 }
 
+// groupMembers is always marshalled so that a group without members is cleared in the device
+type groupMembers struct {
+	Entries []groupMemberEntry `xml:"entry"`
+}
+
 type groupEntry struct {
-	XMLName xml.Name           `xml:"entry"`
-	Name    string             `xml:"name,attr"`
-	Members []groupMemberEntry `xml:"members>entry,omitempty"`
+	XMLName xml.Name     `xml:"entry"`
+	Name    string       `xml:"name,attr"`
+	Members groupMembers `xml:"members"`
 }
 
 type loginEntry struct {
@@ -34,213 +87,898 @@ type logoutEntry struct {
 	Ip      string   `xml:"ip,attr"`
 }
 
+type tagMember struct {
+	XMLName xml.Name `xml:"member"`
+	Name    string   `xml:",chardata"`
+	Timeout string   `xml:"timeout,attr,omitempty"`
+}
+
+type registerEntry struct {
+	XMLName xml.Name    `xml:"entry"`
+	Ip      string      `xml:"ip,attr"`
+	Tags    []tagMember `xml:"tag>member"`
+}
+
+type registerUserEntry struct {
+	XMLName xml.Name    `xml:"entry"`
+	User    string      `xml:"user,attr"`
+	Tags    []tagMember `xml:"tag>member"`
+}
+
+// HipReport is a Host Information Profile report to be submitted through the User-ID API.
+// Report must contain the HIP report XML document (as produced by the GlobalProtect agent).
+type HipReport struct {
+	XMLName  xml.Name `xml:"entry" json:"-"`
+	User     string   `xml:"name,attr"`
+	Ip       string   `xml:"ip,attr"`
+	Domain   string   `xml:"domain,attr,omitempty"`
+	Computer string   `xml:"computer,attr,omitempty"`
+	Report   string   `xml:",innerxml"`
+}
+
 type payloadElement struct {
-	XMLName       xml.Name      `xml:"uid-message"`
-	Version       string        `xml:"version"`
-	Type          string        `xml:"type"`
-	LoginEntries  []loginEntry  `xml:"payload>login>entry,omitempty"`
-	LogoutEntries []logoutEntry `xml:"payload>logout>entry,omitempty"`
-	GroupEntries  []groupEntry  `xml:"payload>groups>entry,omitempty"`
+	XMLName               xml.Name            `xml:"uid-message"`
+	Version               string              `xml:"version"`
+	Type                  string              `xml:"type"`
+	LoginEntries          []loginEntry        `xml:"payload>login>entry,omitempty"`
+	LogoutEntries         []logoutEntry       `xml:"payload>logout>entry,omitempty"`
+	GroupEntries          []groupEntry        `xml:"payload>groups>entry,omitempty"`
+	RegisterEntries       []registerEntry     `xml:"payload>register>entry,omitempty"`
+	UnregisterEntries     []registerEntry     `xml:"payload>unregister>entry,omitempty"`
+	RegisterUserEntries   []registerUserEntry `xml:"payload>register-user>entry,omitempty"`
+	UnregisterUserEntries []registerUserEntry `xml:"payload>unregister-user>entry,omitempty"`
+	HipReports            []HipReport         `xml:"payload>hip-report>entry,omitempty"`
+}
+
+// MarshalXML only writes the payload sections with entries: the devices lacking the support of some of
+// them (i.e. HIP reports) still accept the messages not using them
+func (p payloadElement) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: "uid-message"}}
+	payload := xml.StartElement{Name: xml.Name{Local: "payload"}}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := e.EncodeElement(p.Version, xml.StartElement{Name: xml.Name{Local: "version"}}); err != nil {
+		return err
+	}
+	if err := e.EncodeElement(p.Type, xml.StartElement{Name: xml.Name{Local: "type"}}); err != nil {
+		return err
+	}
+	if err := e.EncodeToken(payload); err != nil {
+		return err
+	}
+	for _, section := range []struct {
+		name    string
+		size    int
+		entries interface{}
+	}{
+		{"login", len(p.LoginEntries), p.LoginEntries},
+		{"logout", len(p.LogoutEntries), p.LogoutEntries},
+		{"groups", len(p.GroupEntries), p.GroupEntries},
+		{"register", len(p.RegisterEntries), p.RegisterEntries},
+		{"unregister", len(p.UnregisterEntries), p.UnregisterEntries},
+		{"register-user", len(p.RegisterUserEntries), p.RegisterUserEntries},
+		{"unregister-user", len(p.UnregisterUserEntries), p.UnregisterUserEntries},
+		{"hip-report", len(p.HipReports), p.HipReports},
+	} {
+		if section.size == 0 {
+			continue
+		}
+		wrapper := xml.StartElement{Name: xml.Name{Local: section.name}}
+		if err := e.EncodeToken(wrapper); err != nil {
+			return err
+		}
+		if err := e.Encode(section.entries); err != nil {
+			return err
+		}
+		if err := e.EncodeToken(wrapper.End()); err != nil {
+			return err
+		}
+	}
+	if err := e.EncodeToken(payload.End()); err != nil {
+		return err
+	}
+	return e.EncodeToken(start.End())
+}
+
+// size returns the number of entries in the payload
+func (p *payloadElement) size() int {
+	return len(p.LoginEntries) + len(p.LogoutEntries) + len(p.GroupEntries) +
+		len(p.RegisterEntries) + len(p.UnregisterEntries) +
+		len(p.RegisterUserEntries) + len(p.UnregisterUserEntries) + len(p.HipReports)
 }
 
 type userPendingEntries struct {
-	isLogin           bool
-	username, timeout string
+	isLogin                   bool
+	username, ipaddr, timeout string
+}
+
+type tagPendingEntry struct {
+	register bool
+	timeout  string
 }
 
 type UID struct {
-	payloadE         payloadElement
-	ip2uTransactions map[string]userPendingEntries
-	groups           map[string]map[string]struct{}
-	device           ApiConnector
-	flusher          *sync.Cond
-	wg               *sync.WaitGroup
-	ticking          *time.Ticker
-	flusherQuit      chan struct{}
-	tickerQuit       chan struct{}
-	cumChanges       int
-	dataLock         sync.Mutex
-	isRunning        bool
+	payloadE          payloadElement
+	ip2uTransactions  map[string]userPendingEntries
+	groups            map[string]map[string]struct{}
+	dirtyGroups       map[string]struct{}
+	ipTags            map[string]map[string]tagPendingEntry
+	userTags          map[string]map[string]tagPendingEntry
+	hipReports        map[string]HipReport
+	device            *ApiConnector
+	name              string
+	sink              UidSink
+	flushSignal       chan struct{}
+	flushRequest      chan chan *uidFlushJob
+	wg                *sync.WaitGroup
+	ticking           Ticker
+	flusherQuit       chan struct{}
+	tickerQuit        chan struct{}
+	cumChanges        int
+	dataLock          sync.Mutex
+	isRunning         bool
+	closed            chan struct{}
+	debug             bool
+	multiUser         bool
+	flushPolicy       int
+	flushInterval     time.Duration
+	reconcileInterval time.Duration
+	reconciling       Ticker
+	mappings          map[string]UidMapping
+	refreshBefore     time.Duration
+	refreshActive     func(UidMapping) bool
+	refreshing        Ticker
+	maxBatch          int
+	maxPayloadBytes   int
+	metrics           *Metrics
+	retryPolicy       *uidRetryPolicy
+	onFlush           func(UidFlushResult)
+	onDeadLetter      func(UidFlushResult)
+	destinations      []*uidDestination
+	primary           *uidDestination
+	inflight          []*uidFlushJob
+	journal           *os.File
+	journalPath       string
+	journalErr        error
+	clock             Clock
+	synchronous       bool
+	lastFlushTick     time.Time
+	lastReconcile     time.Time
+	lastRefresh       time.Time
 }
 
+// Init connects to the device dev with the provided credentials and starts sending it the User-ID changes.
+// Use "NewUID()" to reuse an existing connector or API key, to target a Panorama managed device or a vsys,
+// or to send the changes to any other UidSink.
 func (uid *UID) Init(dev, user, passwd string) error {
-	uid.payloadE.Version = UIDVERSION
-	uid.payloadE.Type = UIDTYPE
-	uid.ip2uTransactions = make(map[string]userPendingEntries)
-	uid.groups = make(map[string]map[string]struct{})
-	uid.device.Init(dev)
-	err := uid.device.Keygen(user, passwd)
-	if err != nil {
+	uid.dataLock.Lock()
+	device := uid.connector()
+	uid.dataLock.Unlock()
+	device.Init(dev)
+	if err := device.Keygen(user, passwd); err != nil {
 		return err
 	}
-	uid.flusher = sync.NewCond(&sync.Mutex{})
-	uid.ticking = time.NewTicker(time.Millisecond * 2000)
+	uid.dataLock.Lock()
+	uid.name, uid.sink = dev, device
+	uid.dataLock.Unlock()
+	return uid.Start()
+}
+
+// Start launches the delivery of the User-ID changes to the sink provided to "NewUID()".
+// The UID initialized by "Init()" is already started.
+func (uid *UID) Start() error {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
+	if uid.isRunning {
+		return errors.New("UID is already running")
+	}
+	if uid.sink == nil {
+		return errors.New("UID has no sink, use Init() or NewUID()")
+	}
+	if uid.flushInterval == 0 {
+		uid.flushInterval = _uidFlushInterval
+	}
+	uid.payloadE.Version = UIDVERSION
+	uid.payloadE.Type = UIDTYPE
+	uid.initState()
 	uid.wg = &sync.WaitGroup{}
 	uid.flusherQuit = make(chan struct{})
 	uid.tickerQuit = make(chan struct{})
-	uid.wg.Add(2)
-	go uid.flushData()
-	go uid.tickRcvr()
+	// the primary destination leads the list and is replaced when UID is started again
+	added := uid.destinations
+	if len(added) > 0 && added[0] == uid.primary {
+		added = added[1:]
+	}
+	uid.primary = newDestination(uid.name, uid.sink)
+	uid.destinations = append([]*uidDestination{uid.primary}, added...)
+	if uid.synchronous {
+		now := uid.getClock().Now()
+		uid.lastFlushTick, uid.lastReconcile, uid.lastRefresh = now, now, now
+	} else {
+		uid.flushSignal = make(chan struct{}, 1)
+		uid.flushRequest = make(chan chan *uidFlushJob)
+		uid.ticking = uid.getClock().NewTicker(uid.flushInterval)
+		uid.wg.Add(1)
+		go uid.run()
+		for _, dest := range uid.destinations {
+			uid.wg.Add(1)
+			go uid.runDestination(dest)
+		}
+		uid.startReconciler()
+		uid.startRefresher()
+	}
 	uid.isRunning = true
 	return nil
 }
 
+// connector returns the ApiConnector of UID, used for tracing and metrics when the sink is not a connector.
+// dataLock must be held.
+func (uid *UID) connector() *ApiConnector {
+	if uid.device == nil {
+		uid.device = &ApiConnector{}
+	}
+	return uid.device
+}
+
+// Debug turns on or off the traces of UID and of the API calls of its connector
 func (uid *UID) Debug(debug bool) {
-	uid.device.Debug(debug)
+	uid.dataLock.Lock()
+	uid.debug = debug
+	uid.connector().Debug(debug)
+	uid.dataLock.Unlock()
 }
 
-func (uid *UID) IsRunning() bool {
-	return uid.isRunning
+// trace logs message if debugging is enabled. dataLock must be held.
+func (uid *UID) trace(message string) {
+	if uid.debug {
+		log.Println(message)
+	}
 }
 
-func (uid *UID) Close() {
+// traceUnlocked is "trace()" for callers not holding dataLock
+func (uid *UID) traceUnlocked(message string) {
+	uid.dataLock.Lock()
+	debug := uid.debug
+	uid.dataLock.Unlock()
+	if debug {
+		log.Println(message)
+	}
+}
+
+// SetMetrics enables the collection of User-ID statistics (pending changes, flush batch size,
+// flush duration and failures) as well as the API calls performed by the UID device.
+// It must be called before "Init()" or "Start()": the middleware chain of the device can not
+// change while deliveries are running.
+func (uid *UID) SetMetrics(m *Metrics) error {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
 	if uid.isRunning {
-		close(uid.flusherQuit)
-		uid.flusher.L.Lock()
-		uid.flusher.Signal()
-		uid.flusher.L.Unlock()
-		close(uid.tickerQuit)
-		uid.wg.Wait()
+		return errors.New("UID metrics must be set before Start()")
 	}
-	uid.isRunning = false
+	uid.metrics = m
+	m.Instrument(uid.connector())
+	return nil
 }
 
-func (uid *UID) AddLogin(username, ipaddr, timeout string) {
+// OnFlush registers a callback invoked with the outcome of every flush
+func (uid *UID) OnFlush(callback func(result UidFlushResult)) {
 	uid.dataLock.Lock()
-	_, ok := uid.ip2uTransactions[ipaddr]
-	if ok {
-		delete(uid.ip2uTransactions, ipaddr)
-		uid.incChange(-1)
-	} else {
-		uid.ip2uTransactions[ipaddr] = userPendingEntries{isLogin: true, username: username, timeout: timeout}
-		uid.incChange(1)
+	uid.onFlush = callback
+	uid.dataLock.Unlock()
+}
+
+// OnDeadLetter registers a callback invoked with the batches that could not be delivered: the ones
+// rejected by the device and the ones still failing after exhausting all retries. Such batches are
+// dropped after the callback returns (undelivered ones are kept if a journal is enabled).
+func (uid *UID) OnDeadLetter(callback func(result UidFlushResult)) {
+	uid.dataLock.Lock()
+	uid.onDeadLetter = callback
+	uid.dataLock.Unlock()
+}
+
+// SetRetryPolicy defines how many times a batch failing to be delivered is retried and the backoff
+// between attempts, which doubles on every retry up to maxBackoff.
+// Batches rejected by the device (error status) are never retried.
+// The default policy is 3 retries with a backoff of 1 second up to 30 seconds.
+func (uid *UID) SetRetryPolicy(retries int, backoff, maxBackoff time.Duration) {
+	uid.dataLock.Lock()
+	uid.retryPolicy = &uidRetryPolicy{retries: retries, backoff: backoff, maxBackoff: maxBackoff}
+	uid.dataLock.Unlock()
+}
+
+// SetFlushPolicy selects when pending changes are flushed (FLUSH_SIZE_OR_TIME, FLUSH_SIZE_ONLY,
+// FLUSH_TIME_ONLY or FLUSH_IMMEDIATE)
+func (uid *UID) SetFlushPolicy(policy int) {
+	uid.dataLock.Lock()
+	uid.flushPolicy = policy
+	uid.dataLock.Unlock()
+}
+
+// SetFlushInterval changes the interval between time based flushes (2 seconds by default).
+// Use SetFlushPolicy(FLUSH_SIZE_ONLY) to disable them.
+func (uid *UID) SetFlushInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("non-positive UID flush interval")
+	}
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
+	uid.flushInterval = interval
+	if uid.ticking != nil {
+		uid.ticking.Reset(interval)
 	}
+	return nil
+}
+
+// SetMaxBatchSize changes the number of entries triggering a flush (MAXCHANGES by default).
+// Flushes with more pending entries are split in several uid-messages.
+func (uid *UID) SetMaxBatchSize(entries int) {
+	uid.dataLock.Lock()
+	uid.maxBatch = entries
 	uid.dataLock.Unlock()
 }
 
-func (uid *UID) AddLogout(username, ipaddr string) {
+// SetMaxPayloadBytes limits the size of each uid-message sent to the device, splitting
+// flushes in several messages if needed. Zero (default) means no limit.
+func (uid *UID) SetMaxPayloadBytes(size int) {
+	uid.dataLock.Lock()
+	uid.maxPayloadBytes = size
+	uid.dataLock.Unlock()
+}
+
+func (uid *UID) maxBatchSize() int {
+	if uid.maxBatch <= 0 {
+		return MAXCHANGES
+	}
+	return uid.maxBatch
+}
+
+func (uid *UID) IsRunning() bool {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
+	return uid.isRunning
+}
+
+// Flush synchronously sends all pending changes to every destination and returns the outcome of each batch.
+// The returned error is the first batch error found, or the context error if ctx expires before
+// the flush completes (the flush itself keeps going in the background).
+func (uid *UID) Flush(ctx context.Context) ([]UidFlushResult, error) {
 	uid.dataLock.Lock()
-	_, ok := uid.ip2uTransactions[ipaddr]
-	if ok {
-		delete(uid.ip2uTransactions, ipaddr)
-		uid.incChange(-1)
+	running, synchronous := uid.isRunning, uid.synchronous
+	requests, quit := uid.flushRequest, uid.flusherQuit
+	uid.dataLock.Unlock()
+	if !running {
+		return nil, errors.New("UID is not running")
+	}
+	var job *uidFlushJob
+	if synchronous {
+		job = uid.flush()
+		uid.drain()
 	} else {
-		uid.ip2uTransactions[ipaddr] = userPendingEntries{isLogin: false, username: username, timeout: ""}
+		// a concurrent Close may stop the scheduler before the request is received or answered
+		reply := make(chan *uidFlushJob, 1)
+		select {
+		case requests <- reply:
+		case <-quit:
+			return nil, errors.New("UID closed")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		select {
+		case job = <-reply:
+		case <-quit:
+			return nil, errors.New("UID closed")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	select {
+	case <-job.done:
+		results := job.flushResults()
+		for _, result := range results {
+			if result.Err != nil {
+				return results, result.Err
+			}
+		}
+		return results, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close flushes all pending changes and stops the UID background tasks. It returns the error of the final flush.
+// If ctx expires before the pending changes are delivered, ongoing retries are aborted,
+// undelivered changes are dropped (unless a journal is enabled) and the context error is returned.
+// Concurrent calls wait for the first one to stop UID.
+func (uid *UID) Close(ctx context.Context) error {
+	uid.dataLock.Lock()
+	// closed is set while a Close is in progress and closed once UID is stopped
+	running, closed := uid.isRunning, uid.closed
+	if running && closed == nil {
+		uid.closed = make(chan struct{})
+	}
+	uid.dataLock.Unlock()
+	if !running {
+		return nil
+	}
+	if closed != nil {
+		select {
+		case <-closed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	_, err := uid.Flush(ctx)
+	uid.dataLock.Lock()
+	close(uid.flusherQuit)
+	close(uid.tickerQuit)
+	uid.dataLock.Unlock()
+	uid.wg.Wait()
+	uid.abortQueued()
+	uid.closeJournal()
+	uid.dataLock.Lock()
+	uid.isRunning = false
+	close(uid.closed)
+	uid.closed = nil
+	uid.dataLock.Unlock()
+	return err
+}
+
+// ip2uKey returns the key used to coalesce login/logout changes: the IP address or,
+// when multi-user IPs are enabled, the IP address and user pair
+func (uid *UID) ip2uKey(username, ipaddr string) string {
+	if uid.multiUser {
+		return ipaddr + "\x00" + username
+	}
+	return ipaddr
+}
+
+// setMapping records a pending login/logout. The last change for a given key wins.
+func (uid *UID) setMapping(entry userPendingEntries) {
+	key := uid.ip2uKey(entry.username, entry.ipaddr)
+	if _, ok := uid.ip2uTransactions[key]; !ok {
 		uid.incChange(1)
 	}
+	uid.ip2uTransactions[key] = entry
+}
+
+// SetMultiUser enables (or disables) multi-user IP addresses (i.e. terminal servers).
+// By default the last login or logout for an IP address replaces any pending change for the same IP.
+// With multi-user enabled changes are coalesced per IP address and user instead.
+// It is meant to be called before queuing any change.
+func (uid *UID) SetMultiUser(multiUser bool) {
+	uid.dataLock.Lock()
+	uid.multiUser = multiUser
+	pending := uid.ip2uTransactions
+	uid.ip2uTransactions = make(map[string]userPendingEntries)
+	for _, entry := range pending {
+		uid.ip2uTransactions[uid.ip2uKey(entry.username, entry.ipaddr)] = entry
+	}
+	uid.incChange(len(uid.ip2uTransactions) - len(pending))
+	mappings := uid.mappings
+	uid.mappings = nil
+	for _, mapping := range mappings {
+		if uid.mappings == nil {
+			uid.mappings = make(map[string]UidMapping)
+		}
+		uid.mappings[uid.ip2uKey(mapping.User, mapping.Ip)] = mapping
+	}
 	uid.dataLock.Unlock()
 }
 
-func (uid *UID) AddGroupMember(group, member string) {
+// queue journals op (if a journal is enabled) and applies it to the pending changes
+func (uid *UID) queue(op uidOp) {
 	uid.dataLock.Lock()
-	groupId, okg := uid.groups[group]
-	if okg {
-		_, oku := groupId[member]
-		if !oku {
-			groupId[member] = struct{}{}
+	uid.initState()
+	uid.journalAppend(op)
+	uid.apply(op)
+	// in synchronous mode the caller delivers the changes reaching the flush thresholds
+	flush := uid.synchronous && uid.isRunning && uid.shouldFlush(false)
+	uid.dataLock.Unlock()
+	if flush {
+		uid.flush()
+		uid.drain()
+	}
+}
+
+// apply updates the pending changes with op. dataLock must be held.
+func (uid *UID) apply(op uidOp) {
+	switch op.Op {
+	case _uidOpLogin:
+		uid.setMapping(userPendingEntries{isLogin: true, username: op.User, ipaddr: op.Ip, timeout: op.Timeout})
+	case _uidOpLogout:
+		uid.setMapping(userPendingEntries{isLogin: false, username: op.User, ipaddr: op.Ip})
+	case _uidOpGroupAdd:
+		groupId, okg := uid.groups[op.Group]
+		if !okg {
+			groupId = make(map[string]struct{})
+			uid.groups[op.Group] = groupId
+		}
+		for _, member := range op.Members {
+			if _, oku := groupId[member]; !oku {
+				groupId[member] = struct{}{}
+				uid.incChange(1)
+				uid.markGroup(op.Group)
+			}
+		}
+	case _uidOpGroupRemove:
+		if groupId, okg := uid.groups[op.Group]; okg {
+			for _, member := range op.Members {
+				if _, oku := groupId[member]; oku {
+					delete(groupId, member)
+					uid.incChange(1)
+					uid.markGroup(op.Group)
+				}
+			}
+		}
+	case _uidOpGroupSet, _uidOpGroupSynced:
+		members := make(map[string]struct{}, len(op.Members))
+		for _, member := range op.Members {
+			members[member] = struct{}{}
+		}
+		if current, okg := uid.groups[op.Group]; op.Op == _uidOpGroupSet && (!okg || !sameMembers(current, members)) {
 			uid.incChange(1)
+			uid.markGroup(op.Group)
 		}
-	} else {
-		uid.groups[group] = make(map[string]struct{})
-		uid.groups[group][member] = struct{}{}
+		uid.groups[op.Group] = members
+	case _uidOpGroupDelete:
+		delete(uid.groups, op.Group)
 		uid.incChange(1)
+		uid.markGroup(op.Group)
+	case _uidOpRegister, _uidOpUnregister:
+		uid.setTags(uid.ipTags, op.Ip, op.Op == _uidOpRegister, op.Timeout, op.Tags)
+	case _uidOpRegisterUser, _uidOpUnregisterUser:
+		uid.setTags(uid.userTags, op.User, op.Op == _uidOpRegisterUser, op.Timeout, op.Tags)
+	case _uidOpHip:
+		if op.Hip == nil {
+			return
+		}
+		key := op.Hip.Ip + "/" + op.Hip.User
+		if _, ok := uid.hipReports[key]; !ok {
+			uid.incChange(1)
+		}
+		uid.hipReports[key] = *op.Hip
+	}
+}
+
+func sameMembers(a, b map[string]struct{}) bool {
+	if len(a) != len(b) {
+		return false
 	}
+	for member := range a {
+		if _, ok := b[member]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// AddLogin queues a login of username at ipaddr. It replaces any pending login or logout for the same IP
+// address (or IP address and user if multi-user is enabled).
+// The device ages the mapping out after timeout (rounded up to minutes); zero uses the device default.
+// Logins are tracked until logged out or expired (see "Mappings()" and "SetRefresh()").
+func (uid *UID) AddLogin(username, ipaddr string, timeout time.Duration) {
+	op := uidOp{Op: _uidOpLogin, User: username, Ip: ipaddr, Timeout: loginTimeout(timeout)}
+	uid.dataLock.Lock()
+	uid.track(op)
 	uid.dataLock.Unlock()
+	uid.queue(op)
 }
 
-func (uid *UID) RemoveGroupMember(group, member string) {
+// AddLogout queues a logout of username at ipaddr. It replaces any pending login or logout for the same IP
+// address (or IP address and user if multi-user is enabled).
+func (uid *UID) AddLogout(username, ipaddr string) {
+	op := uidOp{Op: _uidOpLogout, User: username, Ip: ipaddr}
 	uid.dataLock.Lock()
-	groupId, okg := uid.groups[group]
-	if okg {
-		_, oku := groupId[member]
-		if oku {
-			delete(groupId, member)
+	uid.track(op)
+	uid.dataLock.Unlock()
+	uid.queue(op)
+}
+
+// AddGroupMember adds member to group. Groups are sent with their full membership (see "SetGroupMembers()").
+func (uid *UID) AddGroupMember(group, member string) {
+	uid.queue(uidOp{Op: _uidOpGroupAdd, Group: group, Members: []string{member}})
+}
+
+// RemoveGroupMember removes member from group. The group is kept (even if empty) until "RemoveGroup()" is called.
+func (uid *UID) RemoveGroupMember(group, member string) {
+	uid.queue(uidOp{Op: _uidOpGroupRemove, Group: group, Members: []string{member}})
+}
+
+// ClearGroup removes all members from group. The group is sent without members in the next flush.
+func (uid *UID) ClearGroup(group string) {
+	uid.queue(uidOp{Op: _uidOpGroupSet, Group: group})
+}
+
+// setTags records a pending tag (un)registration. The last operation for a given key and tag wins.
+// dataLock must be held.
+func (uid *UID) setTags(pending map[string]map[string]tagPendingEntry, key string, register bool, timeout string, tags []string) {
+	keyTags, ok := pending[key]
+	if !ok {
+		keyTags = make(map[string]tagPendingEntry)
+		pending[key] = keyTags
+	}
+	for _, tag := range tags {
+		if _, ok := keyTags[tag]; !ok {
 			uid.incChange(1)
 		}
+		keyTags[tag] = tagPendingEntry{register: register, timeout: timeout}
 	}
-	uid.dataLock.Unlock()
 }
 
-func (uid *UID) gGarbage() {
-	for gName, gMembers := range uid.groups {
-		if len(gMembers) == 0 {
-			delete(uid.groups, gName)
+// tagTimeout returns the timeout attribute of a tag registration: seconds, rounded up (empty if it never expires)
+func tagTimeout(timeout time.Duration) string {
+	if timeout <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64((timeout+time.Second-1)/time.Second), 10)
+}
+
+// RegisterTags registers the provided tags to ipaddr (i.e. to populate Dynamic Address Groups).
+// The device unregisters them after timeout (rounded up to seconds); zero for tags that never expire.
+func (uid *UID) RegisterTags(ipaddr string, timeout time.Duration, tags ...string) {
+	uid.queue(uidOp{Op: _uidOpRegister, Ip: ipaddr, Timeout: tagTimeout(timeout), Tags: tags})
+}
+
+// UnregisterTags removes the provided tags from ipaddr
+func (uid *UID) UnregisterTags(ipaddr string, tags ...string) {
+	uid.queue(uidOp{Op: _uidOpUnregister, Ip: ipaddr, Tags: tags})
+}
+
+// RegisterUserTags registers the provided tags to username (i.e. to populate Dynamic User Groups).
+// The device unregisters them after timeout (rounded up to seconds); zero for tags that never expire.
+func (uid *UID) RegisterUserTags(username string, timeout time.Duration, tags ...string) {
+	uid.queue(uidOp{Op: _uidOpRegisterUser, User: username, Timeout: tagTimeout(timeout), Tags: tags})
+}
+
+// UnregisterUserTags removes the provided tags from username
+func (uid *UID) UnregisterUserTags(username string, tags ...string) {
+	uid.queue(uidOp{Op: _uidOpUnregisterUser, User: username, Tags: tags})
+}
+
+// AddHipReport queues a HIP report submission. Only the last report for a given user and IP is sent.
+func (uid *UID) AddHipReport(report HipReport) {
+	uid.queue(uidOp{Op: _uidOpHip, Hip: &report})
+}
+
+// initState allocates the pending changes containers. dataLock must be held.
+func (uid *UID) initState() {
+	if uid.ip2uTransactions == nil {
+		uid.ip2uTransactions = make(map[string]userPendingEntries)
+		uid.groups = make(map[string]map[string]struct{})
+		uid.dirtyGroups = make(map[string]struct{})
+		uid.resetTags()
+	}
+}
+
+func (uid *UID) resetTags() {
+	uid.ipTags = make(map[string]map[string]tagPendingEntry)
+	uid.userTags = make(map[string]map[string]tagPendingEntry)
+	uid.hipReports = make(map[string]HipReport)
+}
+
+func tagMembers(tags map[string]tagPendingEntry, register bool) []tagMember {
+	var members []tagMember
+	for tag, entry := range tags {
+		if entry.register == register {
+			members = append(members, tagMember{Name: tag, Timeout: entry.timeout})
+		}
+	}
+	return members
+}
+
+// batchItem is a single payload entry along with its marshalled size
+type batchItem struct {
+	size int
+	add  func(p *payloadElement)
+}
+
+func newBatchItem(entry interface{}, add func(p *payloadElement)) batchItem {
+	data, _ := xml.Marshal(entry)
+	return batchItem{size: len(data), add: add}
+}
+
+// pendingItems moves all pending changes into a list of payload entries. dataLock must be held.
+func (uid *UID) pendingItems() []batchItem {
+	var items []batchItem
+	// let's prepare login and logout entries
+	for _, uidMap := range uid.ip2uTransactions {
+		if uidMap.isLogin {
+			entry := loginEntry{Name: uidMap.username, Ip: uidMap.ipaddr, Timeout: uidMap.timeout}
+			items = append(items, newBatchItem(entry, func(p *payloadElement) {
+				p.LoginEntries = append(p.LoginEntries, entry)
+			}))
+		} else {
+			entry := logoutEntry{Name: uidMap.username, Ip: uidMap.ipaddr}
+			items = append(items, newBatchItem(entry, func(p *payloadElement) {
+				p.LogoutEntries = append(p.LogoutEntries, entry)
+			}))
+		}
+	}
+	// let's prepare group entries (only the ones changed since the last flush)
+	for gName := range uid.dirtyGroups {
+		entry := groupEntry{Name: gName}
+		for mName := range uid.groups[gName] {
+			entry.Members.Entries = append(entry.Members.Entries, groupMemberEntry{Name: mName})
+		}
+		items = append(items, newBatchItem(entry, func(p *payloadElement) {
+			p.GroupEntries = append(p.GroupEntries, entry)
+		}))
+	}
+	// let's prepare tag entries
+	for ipaddr, tags := range uid.ipTags {
+		if members := tagMembers(tags, true); members != nil {
+			entry := registerEntry{Ip: ipaddr, Tags: members}
+			items = append(items, newBatchItem(entry, func(p *payloadElement) {
+				p.RegisterEntries = append(p.RegisterEntries, entry)
+			}))
+		}
+		if members := tagMembers(tags, false); members != nil {
+			entry := registerEntry{Ip: ipaddr, Tags: members}
+			items = append(items, newBatchItem(entry, func(p *payloadElement) {
+				p.UnregisterEntries = append(p.UnregisterEntries, entry)
+			}))
+		}
+	}
+	for username, tags := range uid.userTags {
+		if members := tagMembers(tags, true); members != nil {
+			entry := registerUserEntry{User: username, Tags: members}
+			items = append(items, newBatchItem(entry, func(p *payloadElement) {
+				p.RegisterUserEntries = append(p.RegisterUserEntries, entry)
+			}))
+		}
+		if members := tagMembers(tags, false); members != nil {
+			entry := registerUserEntry{User: username, Tags: members}
+			items = append(items, newBatchItem(entry, func(p *payloadElement) {
+				p.UnregisterUserEntries = append(p.UnregisterUserEntries, entry)
+			}))
+		}
+	}
+	for _, report := range uid.hipReports {
+		entry := report
+		items = append(items, newBatchItem(entry, func(p *payloadElement) {
+			p.HipReports = append(p.HipReports, entry)
+		}))
+	}
+	uid.dirtyGroups = make(map[string]struct{})
+	uid.ip2uTransactions = make(map[string]userPendingEntries)
+	uid.resetTags()
+	uid.cumChanges = 0
+	return items
+}
+
+// envelopeSize returns the size of the marshalled payload without its entries. Every section is measured
+// with one entry, so the size of the wrappers of the sections used by a batch is never underestimated.
+func envelopeSize(empty payloadElement) int {
+	empty.LoginEntries = []loginEntry{{}}
+	empty.LogoutEntries = []logoutEntry{{}}
+	empty.GroupEntries = []groupEntry{{}}
+	empty.RegisterEntries = []registerEntry{{}}
+	empty.UnregisterEntries = []registerEntry{{}}
+	empty.RegisterUserEntries = []registerUserEntry{{}}
+	empty.UnregisterUserEntries = []registerUserEntry{{}}
+	empty.HipReports = []HipReport{{}}
+	data, _ := xml.Marshal(&empty)
+	size := len(data)
+	for _, entry := range []interface{}{loginEntry{}, logoutEntry{}, groupEntry{}, registerEntry{}, registerEntry{},
+		registerUserEntry{}, registerUserEntry{}, HipReport{}} {
+		data, _ = xml.Marshal(entry)
+		size -= len(data)
+	}
+	return size
+}
+
+// splitBatches packs items into as many payloads as needed to honour the batch size and payload bytes limits.
+// A single entry exceeding the payload bytes limit (i.e. a huge group) is sent on its own.
+func (uid *UID) splitBatches(items []batchItem) []payloadElement {
+	var batches []payloadElement
+	empty := payloadElement{Version: UIDVERSION, Type: UIDTYPE}
+	envelope := envelopeSize(empty)
+	current, count, size := empty, 0, envelope
+	for _, item := range items {
+		full := count >= uid.maxBatchSize() ||
+			(uid.maxPayloadBytes > 0 && size+item.size > uid.maxPayloadBytes)
+		if count > 0 && full {
+			batches = append(batches, current)
+			current, count, size = empty, 0, envelope
 		}
+		item.add(&current)
+		count++
+		size += item.size
+	}
+	if count > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// shouldFlush tells whether the pending changes must be flushed according to the flush policy.
+// dataLock must be held.
+func (uid *UID) shouldFlush(tick bool) bool {
+	if uid.cumChanges <= 0 {
+		return false
+	}
+	switch uid.flushPolicy {
+	case FLUSH_IMMEDIATE:
+		return true
+	case FLUSH_TIME_ONLY:
+		return tick
+	case FLUSH_SIZE_ONLY:
+		return uid.cumChanges >= uid.maxBatchSize()
 	}
+	return tick || uid.cumChanges >= uid.maxBatchSize()
 }
 
 func (uid *UID) incChange(increment int) {
 	uid.cumChanges += increment
-	if uid.cumChanges == MAXCHANGES {
-		uid.flusher.L.Lock()
-		uid.flusher.Signal()
-		uid.flusher.L.Unlock()
+	if uid.metrics != nil {
+		uid.metrics.setUidPending(deviceLabel(uid.name, uid.sink), uid.cumChanges)
+	}
+	if increment > 0 && uid.flushSignal != nil && uid.shouldFlush(false) {
+		uid.signal()
 	}
 }
 
-func (uid *UID) tickRcvr() {
-	defer uid.wg.Done()
-LEAVE:
-	for {
-		select {
-		case <-uid.ticking.C:
-			uid.dataLock.Lock()
-			if uid.cumChanges > 0 {
-				uid.flusher.L.Lock()
-				uid.flusher.Signal()
-				uid.flusher.L.Unlock()
-			}
-			uid.dataLock.Unlock()
-		case <-uid.tickerQuit:
-			uid.ticking.Stop()
-			break LEAVE
-		}
+// signal wakes up the flusher. Signals sent while a flush is in progress are not lost.
+func (uid *UID) signal() {
+	select {
+	case uid.flushSignal <- struct{}{}:
+	default:
 	}
 }
 
-func (uid *UID) flushData() {
+// run is the flush scheduler: it flushes, one at a time, on the clock ticks, on the signals of the
+// changes reaching the flush policy thresholds and on "Flush()" requests
+func (uid *UID) run() {
 	defer uid.wg.Done()
 	for {
 		select {
 		case <-uid.flusherQuit:
+			uid.ticking.Stop()
 			return
-		default:
-			uid.flusher.L.Lock()
-			uid.flusher.Wait()
-			uid.flusher.L.Unlock()
+		case <-uid.ticking.C():
 			uid.dataLock.Lock()
-			uid.payloadE.LoginEntries = []loginEntry{}
-			uid.payloadE.LogoutEntries = []logoutEntry{}
-			uid.payloadE.GroupEntries = []groupEntry{}
-			// let's prepare login and logout entries
-			for ipaddr, uidMap := range uid.ip2uTransactions {
-				if uidMap.isLogin {
-					uid.payloadE.LoginEntries = append(uid.payloadE.LoginEntries,
-						loginEntry{Name: uidMap.username,
-							Ip: ipaddr, Timeout: uidMap.timeout})
-				} else {
-					uid.payloadE.LogoutEntries = append(uid.payloadE.LogoutEntries,
-						logoutEntry{Name: uidMap.username, Ip: ipaddr})
-				}
-			}
-			// let's prepare group entries
-			for gName, gMembers := range uid.groups {
-				newGEntry := groupEntry{Name: gName, Members: []groupMemberEntry{}}
-				for mName := range gMembers {
-					newGEntry.Members = append(newGEntry.Members, groupMemberEntry{Name: mName})
-				}
-				uid.payloadE.GroupEntries = append(uid.payloadE.GroupEntries, newGEntry)
-			}
-			uid.gGarbage()
-			uid.ip2uTransactions = make(map[string]userPendingEntries)
-			uid.cumChanges = 0
+			flush := uid.shouldFlush(true)
 			uid.dataLock.Unlock()
-			message, _ := xml.Marshal(&uid.payloadE)
-			uid.device.Uid(string(message[:]))
+			if flush {
+				uid.flush()
+			}
+		case <-uid.flushSignal:
+			uid.flush()
+		case reply := <-uid.flushRequest:
+			reply <- uid.flush()
 		}
 	}
 }
 
+// flush moves all pending changes into a job queued to every destination. The job completes
+// once every destination has processed it and the jobs queued before.
+func (uid *UID) flush() *uidFlushJob {
+	uid.dataLock.Lock()
+	job := newFlushJob(uid.splitBatches(uid.pendingItems()))
+	if uid.metrics != nil {
+		uid.metrics.setUidPending(deviceLabel(uid.name, uid.sink), 0)
+	}
+	destinations := append([]*uidDestination(nil), uid.destinations...)
+	// empty jobs are queued too so they complete after the ones flushed before
+	job.pending = len(destinations)
+	if job.pending > 0 {
+		uid.inflight = append(uid.inflight, job)
+	}
+	uid.dataLock.Unlock()
+	if job.pending == 0 {
+		uid.completeJob(job)
+		return job
+	}
+	for _, dest := range destinations {
+		dest.enqueue(job)
+	}
+	return job
+}
+
 func (uid *UID) Marshall() ([]byte, error) {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
 	return (xml.Marshal(&uid.payloadE))
 }
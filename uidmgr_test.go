@@ -0,0 +1,403 @@
+package gopanosapi
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xhoms/gopanosapi/panostest"
+)
+
+func TestConcurrentClose(t *testing.T) {
+	uid, err := NewUID(&fakeSink{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uid.Start(); err != nil {
+		t.Fatal(err)
+	}
+	uid.AddLogin("acme\\bob", "10.0.0.1", 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			uid.Close(context.Background())
+		}()
+	}
+	wg.Wait()
+	if uid.IsRunning() {
+		t.Error("UID still running after Close()")
+	}
+}
+
+func TestFlushWhileClosing(t *testing.T) {
+	uid, err := NewUID(&fakeSink{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uid.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// stop the background tasks like Close does before it clears isRunning
+	uid.dataLock.Lock()
+	close(uid.flusherQuit)
+	close(uid.tickerQuit)
+	uid.dataLock.Unlock()
+	uid.wg.Wait()
+	done := make(chan error, 1)
+	go func() {
+		_, err := uid.Flush(context.Background())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Flush() succeeded on a closing UID")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush() blocked on a closing UID")
+	}
+	uid.dataLock.Lock()
+	uid.isRunning = false
+	uid.dataLock.Unlock()
+}
+
+func TestRestart(t *testing.T) {
+	sink, other := &fakeSink{}, &fakeSink{}
+	uid, _ := startTestUID(t, sink, func(uid *UID) { uid.AddDestination("other", other) })
+	if err := uid.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := uid.Start(); err != nil {
+		t.Fatal(err)
+	}
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	if results := flush(t, uid); len(results) != 2 {
+		t.Errorf("Flush() = %+v, want a result per destination", results)
+	}
+	if len(sink.received()) != 1 || len(other.received()) != 1 {
+		t.Errorf("payloads received after a restart: %d and %d, want 1 and 1", len(sink.received()), len(other.received()))
+	}
+}
+
+func TestDebugWhileDelivering(t *testing.T) {
+	sink := &fakeSink{failures: 3}
+	uid, err := NewUID(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid.SetRetryPolicy(3, time.Millisecond, time.Millisecond)
+	if err := uid.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer uid.Close(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			uid.Debug(i%2 == 0)
+		}
+	}()
+	uid.AddLogin("acme\\bob", "10.0.0.1", 0)
+	if _, err := uid.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestDebugWhileDeliveringToDevice(t *testing.T) {
+	device := panostest.NewServer()
+	defer device.Close()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	uid := &UID{}
+	if err := uid.Init(device.Host, device.User, device.Password); err != nil {
+		t.Fatal(err)
+	}
+	defer uid.Close(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			uid.Debug(i%2 == 0)
+		}
+	}()
+	for i := 1; i <= 5; i++ {
+		uid.AddLogin("acme\\user"+strconv.Itoa(i), "10.0.0."+strconv.Itoa(i), time.Hour)
+		if _, err := uid.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if mappings := device.Mappings(); len(mappings) != 5 {
+		t.Errorf("device mappings = %v", mappings)
+	}
+}
+
+func TestSetMetricsBeforeStart(t *testing.T) {
+	metrics := NewMetrics()
+	uid, _ := startTestUID(t, &fakeSink{}, func(uid *UID) {
+		if err := uid.SetMetrics(metrics); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err := uid.SetMetrics(NewMetrics()); err == nil {
+		t.Error("SetMetrics() accepted while running")
+	}
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	flush(t, uid)
+	if uid.metrics != metrics {
+		t.Error("metrics replaced while running")
+	}
+}
+
+func TestTimeoutsAreRounded(t *testing.T) {
+	sink := &fakeSink{}
+	uid, clock := startTestUID(t, sink, nil)
+	uid.AddLogin("acme\\bob", "10.0.0.1", 61*time.Second)
+	mappings := uid.Mappings()
+	if len(mappings) != 1 || mappings[0].Timeout != 2*time.Minute || !mappings[0].Expires.Equal(clock.Now().Add(2*time.Minute)) {
+		t.Errorf("Mappings() = %+v", mappings)
+	}
+	uid.RegisterTags("10.0.0.1", 1500*time.Millisecond, "quarantine")
+	if _, err := uid.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	payloads := sink.received()
+	if len(payloads) != 1 || !strings.Contains(payloads[0], `ip="10.0.0.1" timeout="2"`) ||
+		!strings.Contains(payloads[0], `<member timeout="2">quarantine</member>`) {
+		t.Errorf("sink received %q", payloads)
+	}
+}
+
+// sent decodes the uid-messages received by sink
+func sent(t *testing.T, sink *fakeSink) []payloadElement {
+	t.Helper()
+	var payloads []payloadElement
+	for _, data := range sink.received() {
+		var payload payloadElement
+		if err := xml.Unmarshal([]byte(data), &payload); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+func logins(payload payloadElement) []string {
+	var entries []string
+	for _, entry := range payload.LoginEntries {
+		entries = append(entries, entry.Name+"@"+entry.Ip)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func logouts(payload payloadElement) []string {
+	var entries []string
+	for _, entry := range payload.LogoutEntries {
+		entries = append(entries, entry.Name+"@"+entry.Ip)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func flush(t *testing.T, uid *UID) []UidFlushResult {
+	t.Helper()
+	results, err := uid.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestLastChangePerIpWins(t *testing.T) {
+	sink := &fakeSink{}
+	uid, _ := startTestUID(t, sink, nil)
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	uid.AddLogin("acme\\alice", "10.0.0.1", time.Hour)
+	uid.AddLogin("acme\\carol", "10.0.0.2", time.Hour)
+	uid.AddLogout("acme\\carol", "10.0.0.2")
+	flush(t, uid)
+	payloads := sent(t, sink)
+	if len(payloads) != 1 {
+		t.Fatalf("sink received %d payloads, want 1", len(payloads))
+	}
+	if got := logins(payloads[0]); !reflect.DeepEqual(got, []string{"acme\\alice@10.0.0.1"}) {
+		t.Errorf("logins = %q", got)
+	}
+	if got := logouts(payloads[0]); !reflect.DeepEqual(got, []string{"acme\\carol@10.0.0.2"}) {
+		t.Errorf("logouts = %q", got)
+	}
+	if mappings := uid.Mappings(); len(mappings) != 1 || mappings[0].User != "acme\\alice" {
+		t.Errorf("Mappings() = %+v", mappings)
+	}
+}
+
+func TestMultiUserIp(t *testing.T) {
+	sink := &fakeSink{}
+	uid, _ := startTestUID(t, sink, func(uid *UID) { uid.SetMultiUser(true) })
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	uid.AddLogin("acme\\alice", "10.0.0.1", time.Hour)
+	uid.AddLogin("acme\\carol", "10.0.0.1", time.Hour)
+	uid.AddLogout("acme\\carol", "10.0.0.1")
+	flush(t, uid)
+	payloads := sent(t, sink)
+	if len(payloads) != 1 {
+		t.Fatalf("sink received %d payloads, want 1", len(payloads))
+	}
+	if got := logins(payloads[0]); !reflect.DeepEqual(got, []string{"acme\\alice@10.0.0.1", "acme\\bob@10.0.0.1"}) {
+		t.Errorf("logins = %q", got)
+	}
+	if got := logouts(payloads[0]); !reflect.DeepEqual(got, []string{"acme\\carol@10.0.0.1"}) {
+		t.Errorf("logouts = %q", got)
+	}
+	if mappings := uid.Mappings(); len(mappings) != 2 {
+		t.Errorf("Mappings() = %+v", mappings)
+	}
+
+	// disabling multi-user coalesces the pending changes per IP address again
+	uid.AddLogin("acme\\dave", "10.0.0.2", time.Hour)
+	uid.AddLogin("acme\\erin", "10.0.0.2", time.Hour)
+	uid.SetMultiUser(false)
+	uid.AddLogin("acme\\frank", "10.0.0.2", time.Hour)
+	flush(t, uid)
+	if payloads := sent(t, sink); len(payloads) != 2 || !reflect.DeepEqual(logins(payloads[1]), []string{"acme\\frank@10.0.0.2"}) {
+		t.Errorf("payloads after disabling multi-user = %+v", payloads)
+	}
+}
+
+func TestLogoutCancelsPendingLogin(t *testing.T) {
+	sink := &fakeSink{}
+	uid, _ := startTestUID(t, sink, nil)
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	uid.AddLogout("acme\\bob", "10.0.0.1")
+	uid.AddLogout("acme\\alice", "10.0.0.2")
+	uid.AddLogin("acme\\alice", "10.0.0.2", time.Hour)
+	if results := flush(t, uid); len(results) != 1 || results[0].Entries != 2 {
+		t.Fatalf("Flush() = %+v", results)
+	}
+	payloads := sent(t, sink)
+	if got := logins(payloads[0]); !reflect.DeepEqual(got, []string{"acme\\alice@10.0.0.2"}) {
+		t.Errorf("logins = %q", got)
+	}
+	if got := logouts(payloads[0]); !reflect.DeepEqual(got, []string{"acme\\bob@10.0.0.1"}) {
+		t.Errorf("logouts = %q", got)
+	}
+	if mappings := uid.Mappings(); len(mappings) != 1 || mappings[0].User != "acme\\alice" {
+		t.Errorf("Mappings() = %+v", mappings)
+	}
+	// nothing is left pending
+	if results := flush(t, uid); len(results) != 0 {
+		t.Errorf("second Flush() = %+v", results)
+	}
+}
+
+func TestBatchSplitting(t *testing.T) {
+	sink := &fakeSink{}
+	uid, _ := startTestUID(t, sink, func(uid *UID) {
+		uid.SetFlushPolicy(FLUSH_TIME_ONLY)
+		uid.SetMaxBatchSize(2)
+	})
+	for i := 1; i <= 5; i++ {
+		uid.AddLogin("acme\\user"+strconv.Itoa(i), "10.0.0."+strconv.Itoa(i), time.Hour)
+	}
+	if len(sink.received()) != 0 {
+		t.Fatal("time only policy flushed on size")
+	}
+	results := flush(t, uid)
+	var entries []int
+	for _, result := range results {
+		entries = append(entries, result.Entries)
+	}
+	if !reflect.DeepEqual(entries, []int{2, 2, 1}) {
+		t.Errorf("batch entries = %v, want [2 2 1]", entries)
+	}
+	var all []string
+	for _, payload := range sent(t, sink) {
+		all = append(all, logins(payload)...)
+	}
+	if len(all) != 5 {
+		t.Errorf("logins sent = %q", all)
+	}
+}
+
+func TestSizeTriggeredFlush(t *testing.T) {
+	sink := &fakeSink{}
+	uid, _ := startTestUID(t, sink, func(uid *UID) { uid.SetMaxBatchSize(2) })
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	if len(sink.received()) != 0 {
+		t.Fatal("flushed below the batch size")
+	}
+	uid.AddLogin("acme\\alice", "10.0.0.2", time.Hour)
+	if payloads := sent(t, sink); len(payloads) != 1 || len(logins(payloads[0])) != 2 {
+		t.Errorf("payloads = %+v", payloads)
+	}
+}
+
+func TestMaxPayloadBytes(t *testing.T) {
+	sink := &fakeSink{}
+	const limit = 400
+	uid, _ := startTestUID(t, sink, func(uid *UID) {
+		uid.SetFlushPolicy(FLUSH_TIME_ONLY)
+		uid.SetMaxPayloadBytes(limit)
+	})
+	for i := 1; i <= 10; i++ {
+		uid.AddLogin("acme\\user"+strconv.Itoa(i), "10.0.0."+strconv.Itoa(i), time.Hour)
+	}
+	results := flush(t, uid)
+	if len(results) < 2 {
+		t.Fatalf("%d batches, want the flush split", len(results))
+	}
+	total := 0
+	for _, result := range results {
+		if len(result.Payload) > limit {
+			t.Errorf("payload of %d bytes exceeds %d", len(result.Payload), limit)
+		}
+		total += result.Entries
+	}
+	if total != 10 {
+		t.Errorf("%d entries sent, want 10", total)
+	}
+}
+
+func TestPayloadElements(t *testing.T) {
+	sink := &fakeSink{}
+	uid, _ := startTestUID(t, sink, func(uid *UID) { uid.SetFlushPolicy(FLUSH_TIME_ONLY) })
+	uid.SetGroupMembers("admins", []string{"acme\\bob"})
+	flush(t, uid)
+	uid.ClearGroup("admins")
+	uid.RegisterTags("10.0.0.1", 90*time.Second, "blocklist")
+	uid.UnregisterTags("10.0.0.2", "quarantine")
+	uid.RegisterUserTags("acme\\bob", 0, "vip")
+	uid.UnregisterUserTags("acme\\carol", "contractor")
+	uid.AddHipReport(HipReport{User: "acme\\bob", Ip: "10.0.0.1", Domain: "acme", Computer: "laptop",
+		Report: "<hip-report><md5-sum>d41d8cd9</md5-sum></hip-report>"})
+	flush(t, uid)
+	want := []string{
+		`<uid-message><version>2.0</version><type>update</type><payload><groups>` +
+			`<entry name="admins"><members><entry name="acme\bob"></entry></members></entry></groups></payload></uid-message>`,
+		`<uid-message><version>2.0</version><type>update</type><payload>` +
+			`<groups><entry name="admins"><members></members></entry></groups>` +
+			`<register><entry ip="10.0.0.1"><tag><member timeout="90">blocklist</member></tag></entry></register>` +
+			`<unregister><entry ip="10.0.0.2"><tag><member>quarantine</member></tag></entry></unregister>` +
+			`<register-user><entry user="acme\bob"><tag><member>vip</member></tag></entry></register-user>` +
+			`<unregister-user><entry user="acme\carol"><tag><member>contractor</member></tag></entry></unregister-user>` +
+			`<hip-report><entry name="acme\bob" ip="10.0.0.1" domain="acme" computer="laptop">` +
+			`<hip-report><md5-sum>d41d8cd9</md5-sum></hip-report></entry></hip-report>` +
+			`</payload></uid-message>`,
+	}
+	if got := sink.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("payloads =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,299 @@
+package gopanosapi
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Number of entries requested per page by the "All..." query helpers
+const _queryPageSize = 500
+
+// Maximum number of pages retrieved by the "All..." query helpers
+const _queryMaxPages = 1000
+
+// IpUserMapping is an entry of "show user ip-user-mapping". Timeouts are reported in seconds or "Never".
+type IpUserMapping struct {
+	Ip          string `xml:"ip"`
+	Vsys        string `xml:"vsys"`
+	Type        string `xml:"type"`
+	User        string `xml:"user"`
+	IdleTimeout string `xml:"idle_timeout"`
+	Timeout     string `xml:"timeout"`
+}
+
+// RegisteredIp is an entry of "show object registered-ip" (dynamic address group tags)
+type RegisteredIp struct {
+	Ip         string   `xml:"ip,attr"`
+	FromAgent  string   `xml:"from_agent,attr"`
+	Persistent string   `xml:"persistent,attr"`
+	Tags       []string `xml:"tag>member"`
+}
+
+// UserGroup is the output of "show user group name"
+type UserGroup struct {
+	Name, ShortName, SourceType, Source string
+	Members                             []string
+}
+
+// UserIdEntry is an entry of "show user user-ids": a user and the groups it belongs to
+type UserIdEntry struct {
+	User, Vsys string
+	Groups     []string
+}
+
+type ipUserMappingResult struct {
+	Entries []IpUserMapping `xml:"entry"`
+	Count   int             `xml:"count"`
+}
+
+type registeredIpResult struct {
+	Entries []RegisteredIp `xml:"entry"`
+	Count   int            `xml:"count"`
+}
+
+// groupMemberLine matches the member lines ("[1     ] domain\user") of "show user group name"
+var groupMemberLine = regexp.MustCompile(`^\[\s*\d+\s*\]\s*(.+?)\s*$`)
+
+// opText returns the text of an op command result (CLI like outputs are usually wrapped in CDATA)
+func opText(result []byte) string {
+	var text struct {
+		Text string `xml:",chardata"`
+	}
+	if xml.Unmarshal([]byte("<result>"+string(result)+"</result>"), &text) != nil {
+		return string(result)
+	}
+	return text.Text
+}
+
+func escapeText(value string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(value))
+	return b.String()
+}
+
+// lastPage tells whether paging is over after a page of size entries, total entries retrieved so far
+// and count entries reported by the device (zero if not reported)
+func lastPage(size, total, count int) bool {
+	return size < _queryPageSize || (count > 0 && total >= count)
+}
+
+// pageElements returns the paging elements of a query (none if limit is zero)
+func pageElements(startPoint, limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	if startPoint < 1 {
+		startPoint = 1
+	}
+	return "<start-point>" + strconv.Itoa(startPoint) + "</start-point><limit>" + strconv.Itoa(limit) + "</limit>"
+}
+
+// query runs an op command and unmarshalls its <result> into v (if not nil)
+func (apiC *ApiConnector) query(cmd string, v interface{}) ([]byte, error) {
+	result, err := apiC.Op(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if apiC.LastStatus != STATUS_OK {
+		return nil, errors.New("op command failed: " + strings.TrimSpace(apiC.LastResponseMessage))
+	}
+	if v != nil {
+		apiC.LastUnmarshallError = xml.Unmarshal([]byte("<result>"+string(result)+"</result>"), v)
+		if apiC.LastUnmarshallError != nil {
+			return nil, apiC.LastUnmarshallError
+		}
+	}
+	return result, nil
+}
+
+// IpUserMappings returns a page of the IP to user mappings known by the device, starting at
+// startPoint (1 based) with up to limit entries. A zero limit returns the device default output.
+func (apiC *ApiConnector) IpUserMappings(startPoint, limit int) ([]IpUserMapping, error) {
+	result, err := apiC.ipUserMappings(startPoint, limit)
+	return result.Entries, err
+}
+
+func (apiC *ApiConnector) ipUserMappings(startPoint, limit int) (ipUserMappingResult, error) {
+	var result ipUserMappingResult
+	_, err := apiC.query("<show><user><ip-user-mapping><all>"+pageElements(startPoint, limit)+
+		"</all></ip-user-mapping></user></show>", &result)
+	return result, err
+}
+
+// AllIpUserMappings returns all the IP to user mappings known by the device, paging through the table.
+// Paging stops on a short page, once the count reported by the device is reached or when a page repeats
+// the previous one (devices ignoring the paging elements).
+func (apiC *ApiConnector) AllIpUserMappings() ([]IpUserMapping, error) {
+	var mappings, previous []IpUserMapping
+	for pages, start := 0, 1; pages < _queryMaxPages; pages, start = pages+1, start+_queryPageSize {
+		page, err := apiC.ipUserMappings(start, _queryPageSize)
+		if err != nil {
+			return nil, err
+		}
+		if pages > 0 && reflect.DeepEqual(page.Entries, previous) {
+			return mappings, nil
+		}
+		mappings = append(mappings, page.Entries...)
+		if lastPage(len(page.Entries), len(mappings), page.Count) {
+			return mappings, nil
+		}
+		previous = page.Entries
+	}
+	return nil, errors.New("too many pages of IP to user mappings")
+}
+
+// IpUserMapping returns the mapping of the IP address ip (nil if the address is not mapped)
+func (apiC *ApiConnector) IpUserMapping(ip string) (*IpUserMapping, error) {
+	var result ipUserMappingResult
+	if _, err := apiC.query("<show><user><ip-user-mapping><ip>"+escapeText(ip)+
+		"</ip></ip-user-mapping></user></show>", &result); err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, nil
+	}
+	return &result.Entries[0], nil
+}
+
+// UserIpMappings returns the mappings of user (the device has no such filter so all mappings are retrieved).
+// User names are compared case insensitively.
+func (apiC *ApiConnector) UserIpMappings(user string) ([]IpUserMapping, error) {
+	all, err := apiC.AllIpUserMappings()
+	if err != nil {
+		return nil, err
+	}
+	var mappings []IpUserMapping
+	for _, mapping := range all {
+		if strings.EqualFold(mapping.User, user) {
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings, nil
+}
+
+// UserGroupList returns the names of the groups known by the device ("show user group list")
+func (apiC *ApiConnector) UserGroupList() ([]string, error) {
+	result, err := apiC.query("<show><user><group><list></list></group></user></show>", nil)
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, line := range strings.Split(opText(result), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "Total:") || strings.HasPrefix(line, "* :") {
+			continue
+		}
+		groups = append(groups, line)
+	}
+	return groups, nil
+}
+
+// UserGroup returns the details and members of group ("show user group name")
+func (apiC *ApiConnector) UserGroup(group string) (*UserGroup, error) {
+	result, err := apiC.query("<show><user><group><name>"+escapeText(group)+"</name></group></user></show>", nil)
+	if err != nil {
+		return nil, err
+	}
+	userGroup := &UserGroup{Name: group, Members: []string{}}
+	for _, line := range strings.Split(opText(result), "\n") {
+		line = strings.TrimSpace(line)
+		if m := groupMemberLine.FindStringSubmatch(line); m != nil {
+			userGroup.Members = append(userGroup.Members, m[1])
+			continue
+		}
+		if i := strings.Index(line, ":"); i > 0 {
+			value := strings.TrimSpace(line[i+1:])
+			switch line[:i] {
+			case "short name":
+				userGroup.ShortName = value
+			case "source type":
+				userGroup.SourceType = value
+			case "source":
+				userGroup.Source = value
+			}
+		}
+	}
+	return userGroup, nil
+}
+
+// UserGroupMembers returns the members of group as reported by the device ("show user group name")
+func (apiC *ApiConnector) UserGroupMembers(group string) ([]string, error) {
+	userGroup, err := apiC.UserGroup(group)
+	if err != nil {
+		return nil, err
+	}
+	return userGroup.Members, nil
+}
+
+// RegisteredIps returns a page of the IP addresses registered in the device and their tags, starting at
+// startPoint (1 based) with up to limit entries. A zero limit returns the device default output.
+func (apiC *ApiConnector) RegisteredIps(startPoint, limit int) ([]RegisteredIp, error) {
+	result, err := apiC.registeredIps(startPoint, limit)
+	return result.Entries, err
+}
+
+func (apiC *ApiConnector) registeredIps(startPoint, limit int) (registeredIpResult, error) {
+	var result registeredIpResult
+	_, err := apiC.query("<show><object><registered-ip><all>"+pageElements(startPoint, limit)+
+		"</all></registered-ip></object></show>", &result)
+	return result, err
+}
+
+// AllRegisteredIps returns all the IP addresses registered in the device, paging through the table
+// like "AllIpUserMappings()"
+func (apiC *ApiConnector) AllRegisteredIps() ([]RegisteredIp, error) {
+	var ips, previous []RegisteredIp
+	for pages, start := 0, 1; pages < _queryMaxPages; pages, start = pages+1, start+_queryPageSize {
+		page, err := apiC.registeredIps(start, _queryPageSize)
+		if err != nil {
+			return nil, err
+		}
+		if pages > 0 && reflect.DeepEqual(page.Entries, previous) {
+			return ips, nil
+		}
+		ips = append(ips, page.Entries...)
+		if lastPage(len(page.Entries), len(ips), page.Count) {
+			return ips, nil
+		}
+		previous = page.Entries
+	}
+	return nil, errors.New("too many pages of registered IP addresses")
+}
+
+// UserIds returns the users known by the device and the groups they belong to ("show user user-ids")
+func (apiC *ApiConnector) UserIds() ([]UserIdEntry, error) {
+	result, err := apiC.query("<show><user><user-ids></user-ids></user></show>", nil)
+	if err != nil {
+		return nil, err
+	}
+	var users []UserIdEntry
+	for _, line := range strings.Split(opText(result), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "---") || strings.HasPrefix(line, "User Name") ||
+			strings.HasPrefix(fields[0], "Total") {
+			continue
+		}
+		// lines starting with blanks list additional groups of the previous user
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(users) > 0 {
+				last := &users[len(users)-1]
+				last.Groups = append(last.Groups, strings.Join(fields, " "))
+			}
+			continue
+		}
+		entry := UserIdEntry{User: fields[0]}
+		if len(fields) > 1 {
+			entry.Vsys = fields[1]
+		}
+		if len(fields) > 2 {
+			entry.Groups = append(entry.Groups, strings.Join(fields[2:], " "))
+		}
+		users = append(users, entry)
+	}
+	return users, nil
+}
@@ -0,0 +1,101 @@
+package gopanosapi_test
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/xhoms/gopanosapi"
+	"github.com/xhoms/gopanosapi/panostest"
+)
+
+var (
+	pagingElements = regexp.MustCompile(`<start-point>\d+</start-point><limit>\d+</limit>`)
+	countElement   = regexp.MustCompile(`<count>\d+</count>`)
+)
+
+// newMappedDevice returns an emulated device with n IP to user mappings and tag registrations, and a
+// connector to it counting the queries sent
+func newMappedDevice(t *testing.T, n int) (*gopanosapi.ApiConnector, *int32) {
+	t.Helper()
+	device := panostest.NewServer()
+	t.Cleanup(device.Close)
+	apiC := &gopanosapi.ApiConnector{}
+	apiC.Init(device.Host)
+	if err := apiC.Keygen(device.User, device.Password); err != nil {
+		t.Fatal(err)
+	}
+	var logins, tags strings.Builder
+	for i := 0; i < n; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		fmt.Fprintf(&logins, `<entry name="acme\user%d" ip="%s"/>`, i, ip)
+		fmt.Fprintf(&tags, `<entry ip="%s"><tag><member>managed</member></tag></entry>`, ip)
+	}
+	if _, err := apiC.SendUid("<uid-message><version>2.0</version><type>update</type><payload><login>" +
+		logins.String() + "</login><register>" + tags.String() + "</register></payload></uid-message>"); err != nil {
+		t.Fatal(err)
+	}
+	queries := new(int32)
+	apiC.OnRequest(func(apiCall *gopanosapi.ApiCall) {
+		if strings.Contains(apiCall.Params.Get("cmd"), "<all>") {
+			atomic.AddInt32(queries, 1)
+		}
+	})
+	return apiC, queries
+}
+
+// ignorePaging makes apiC behave like a device ignoring the paging elements and, if withoutCount,
+// not reporting the number of entries
+func ignorePaging(apiC *gopanosapi.ApiConnector, withoutCount bool) {
+	apiC.Use(func(next gopanosapi.ApiHandler) gopanosapi.ApiHandler {
+		return func(apiCall *gopanosapi.ApiCall) *gopanosapi.ApiResult {
+			apiCall.Params.Set("cmd", pagingElements.ReplaceAllString(apiCall.Params.Get("cmd"), ""))
+			result := next(apiCall)
+			if withoutCount && result.Err == nil {
+				result.Body = countElement.ReplaceAll(result.Body, nil)
+			}
+			return result
+		}
+	})
+}
+
+func TestAllStopsOnCount(t *testing.T) {
+	apiC, queries := newMappedDevice(t, 1000)
+	mappings, err := apiC.AllIpUserMappings()
+	if err != nil || len(mappings) != 1000 {
+		t.Fatalf("AllIpUserMappings() = %d mappings, %v", len(mappings), err)
+	}
+	ips, err := apiC.AllRegisteredIps()
+	if err != nil || len(ips) != 1000 {
+		t.Fatalf("AllRegisteredIps() = %d IPs, %v", len(ips), err)
+	}
+	// two full pages each: the count reported by the device avoids asking for an empty third one
+	if *queries != 4 {
+		t.Errorf("%d queries, want 4", *queries)
+	}
+}
+
+func TestAllWithoutPaging(t *testing.T) {
+	for _, withoutCount := range []bool{false, true} {
+		apiC, queries := newMappedDevice(t, 600)
+		ignorePaging(apiC, withoutCount)
+		mappings, err := apiC.AllIpUserMappings()
+		if err != nil || len(mappings) != 600 {
+			t.Fatalf("AllIpUserMappings() = %d mappings, %v", len(mappings), err)
+		}
+		ips, err := apiC.AllRegisteredIps()
+		if err != nil || len(ips) != 600 {
+			t.Fatalf("AllRegisteredIps() = %d IPs, %v", len(ips), err)
+		}
+		// without count the repeated page tells the device returned the whole table
+		want := int32(2)
+		if withoutCount {
+			want = 4
+		}
+		if *queries != want {
+			t.Errorf("withoutCount = %v: %d queries, want %d", withoutCount, *queries, want)
+		}
+	}
+}
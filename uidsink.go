@@ -0,0 +1,301 @@
+package gopanosapi
+
+import (
+	"encoding/xml"
+	"errors"
+	"sync"
+)
+
+// UidSink is the destination of the User-ID payloads built by UID. ApiConnector implements it
+// ("ApiConnector.WithTarget()" returns a connector bound to a Panorama managed device and/or vsys).
+type UidSink interface {
+	SendUid(payload string) (*UidResult, error)
+}
+
+// UidOption configures the UID created by "NewUID()"
+type UidOption func(config *uidConfig)
+
+type uidConfig struct {
+	name, target, vsys string
+}
+
+// UidTarget sends the changes to the Panorama managed device with the provided serial (ApiConnector sinks only)
+func UidTarget(serial string) UidOption {
+	return func(config *uidConfig) {
+		config.target = serial
+	}
+}
+
+// UidVsys sends the changes to the provided vsys (ApiConnector sinks only)
+func UidVsys(vsys string) UidOption {
+	return func(config *uidConfig) {
+		config.vsys = vsys
+	}
+}
+
+// UidName names the sink in the flush results and metrics (the hostname of ApiConnector sinks by default)
+func UidName(name string) UidOption {
+	return func(config *uidConfig) {
+		config.name = name
+	}
+}
+
+// NewUID returns a UID sending the User-ID changes to sink, which can be an initialized ApiConnector (i.e.
+// using an API key set with "SetKey()" or a proxy aware transport) or any other UidSink (i.e. a mock).
+// Connectors are copied so UID does not race with other users of the connector.
+// The UID is configured with its setters and then started with "Start()".
+func NewUID(sink UidSink, options ...UidOption) (*UID, error) {
+	var config uidConfig
+	for _, option := range options {
+		option(&config)
+	}
+	uid := &UID{name: config.name, sink: sink}
+	switch connector := sink.(type) {
+	case nil:
+		return nil, errors.New("UID sink is nil")
+	case *ApiConnector:
+		uid.device = connector.WithTarget(config.target, config.vsys)
+		uid.sink = uid.device
+		if uid.name == "" {
+			uid.name = connector.hostname
+		}
+	default:
+		if config.target != "" || config.vsys != "" {
+			return nil, errors.New("target and vsys options require an ApiConnector sink")
+		}
+	}
+	return uid, nil
+}
+
+// uidDestination is a sink with its own queue of flush jobs so a slow device does not block the others
+type uidDestination struct {
+	name   string
+	device string
+	sink   UidSink
+	groups UidGroupSource
+	lock   sync.Mutex
+	queue  []*uidFlushJob
+	wakeup chan struct{}
+}
+
+func newDestination(name string, sink UidSink) *uidDestination {
+	dest := &uidDestination{name: name, device: deviceLabel(name, sink), sink: sink, wakeup: make(chan struct{}, 1)}
+	switch source := sink.(type) {
+	case *ApiConnector:
+		// queries run concurrently with the deliveries so they get their own connector
+		dest.groups = source.WithTarget("", "")
+	case UidGroupSource:
+		dest.groups = source
+	}
+	return dest
+}
+
+// deviceLabel returns the device label of the metrics of sink: the hostname of ApiConnector sinks, so
+// the UID series match the ones of their API calls, and name for the other sinks
+func deviceLabel(name string, sink UidSink) string {
+	if connector, ok := sink.(*ApiConnector); ok && connector.hostname != "" {
+		return connector.hostname
+	}
+	return name
+}
+
+func (dest *uidDestination) enqueue(job *uidFlushJob) {
+	dest.lock.Lock()
+	dest.queue = append(dest.queue, job)
+	dest.lock.Unlock()
+	select {
+	case dest.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (dest *uidDestination) pop() *uidFlushJob {
+	dest.lock.Lock()
+	defer dest.lock.Unlock()
+	if len(dest.queue) == 0 {
+		return nil
+	}
+	job := dest.queue[0]
+	dest.queue[0] = nil
+	dest.queue = dest.queue[1:]
+	return job
+}
+
+// uidFlushJob holds the batches of a flush until every destination has processed them
+type uidFlushJob struct {
+	batches []payloadElement
+	lock    sync.Mutex
+	pending int
+	results []UidFlushResult
+	// failed tells the batches not delivered to at least one destination
+	failed []bool
+	done   chan struct{}
+}
+
+func newFlushJob(batches []payloadElement) *uidFlushJob {
+	return &uidFlushJob{batches: batches, failed: make([]bool, len(batches)), done: make(chan struct{})}
+}
+
+func (job *uidFlushJob) flushResults() []UidFlushResult {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return append([]UidFlushResult(nil), job.results...)
+}
+
+// AddDestination adds a sink the User-ID batches are sent to, in addition to the device provided to "Init()".
+// Each destination has its own queue and retries, so a slow or unreachable device does not delay the others.
+// Every flushed batch is sent to all destinations (the ones added while running get the batches flushed after).
+// With a journal enabled, a batch not delivered to one of the destinations (but not rejected by it) is
+// queued again and sent to all of them in the next flush.
+func (uid *UID) AddDestination(name string, sink UidSink) {
+	uid.dataLock.Lock()
+	defer uid.dataLock.Unlock()
+	dest := newDestination(name, sink)
+	uid.destinations = append(uid.destinations, dest)
+	if !uid.isRunning || uid.synchronous {
+		return
+	}
+	select {
+	case <-uid.flusherQuit:
+	default:
+		uid.wg.Add(1)
+		go uid.runDestination(dest)
+	}
+}
+
+// runDestination sends the queued jobs to dest until UID is closed
+func (uid *UID) runDestination(dest *uidDestination) {
+	defer uid.wg.Done()
+	for {
+		job := dest.pop()
+		if job != nil {
+			uid.process(dest, job)
+			continue
+		}
+		select {
+		case <-uid.flusherQuit:
+			return
+		case <-dest.wakeup:
+		}
+	}
+}
+
+// abortQueued reports the jobs left in the destination queues once UID is closed
+func (uid *UID) abortQueued() {
+	uid.dataLock.Lock()
+	destinations := append([]*uidDestination(nil), uid.destinations...)
+	uid.dataLock.Unlock()
+	for _, dest := range destinations {
+		for job := dest.pop(); job != nil; job = dest.pop() {
+			uid.process(dest, job)
+		}
+	}
+}
+
+func (uid *UID) process(dest *uidDestination, job *uidFlushJob) {
+	for i := range job.batches {
+		result := uid.sendPayload(dest, &job.batches[i])
+		job.lock.Lock()
+		job.results = append(job.results, result)
+		if result.Err != nil && !result.Rejected {
+			job.failed[i] = true
+		}
+		job.lock.Unlock()
+	}
+	job.lock.Lock()
+	job.pending--
+	completed := job.pending == 0
+	job.lock.Unlock()
+	if completed {
+		uid.completeJob(job)
+	}
+}
+
+// completeJob queues again the undelivered changes of job (if a journal is enabled) and wakes up its waiters
+func (uid *UID) completeJob(job *uidFlushJob) {
+	uid.dataLock.Lock()
+	for i, inflight := range uid.inflight {
+		if inflight == job {
+			uid.inflight = append(uid.inflight[:i], uid.inflight[i+1:]...)
+			break
+		}
+	}
+	if uid.journalPath != "" {
+		var undelivered []uidOp
+		for i, failed := range job.failed {
+			if failed {
+				undelivered = append(undelivered, payloadOps(&job.batches[i])...)
+			}
+		}
+		if undelivered = uid.superseded(undelivered); len(undelivered) > 0 {
+			uid.requeue(undelivered)
+		}
+		uid.compactJournal()
+	}
+	uid.dataLock.Unlock()
+	close(job.done)
+}
+
+// sendPayload delivers a batch to dest, retrying on failure, and reports the outcome
+func (uid *UID) sendPayload(dest *uidDestination, payload *payloadElement) UidFlushResult {
+	uid.dataLock.Lock()
+	policy := uidRetryPolicy{retries: _uidRetries, backoff: _uidBackoff, maxBackoff: _uidMaxBackoff}
+	if uid.retryPolicy != nil {
+		policy = *uid.retryPolicy
+	}
+	metrics, onFlush, onDeadLetter := uid.metrics, uid.onFlush, uid.onDeadLetter
+	clock := uid.getClock()
+	uid.payloadE = *payload
+	uid.dataLock.Unlock()
+	start := clock.Now()
+	result := UidFlushResult{Entries: payload.size(), Destination: dest.name}
+	result.Payload, result.Err = xml.Marshal(payload)
+	if result.Err == nil {
+		select {
+		case <-uid.flusherQuit:
+			result.Err = errors.New("UID closed before delivery")
+		default:
+			uid.deliver(dest, &result, policy, metrics)
+		}
+	}
+	if metrics != nil {
+		metrics.observeUidFlush(dest.device, result.Entries, clock.Now().Sub(start), result.Err != nil)
+	}
+	if onFlush != nil {
+		onFlush(result)
+	}
+	if result.Err != nil && onDeadLetter != nil {
+		onDeadLetter(result)
+	}
+	return result
+}
+
+// deliver sends result.Payload until it is accepted, rejected or the retries are exhausted.
+// Only the errors without a device response (communication errors, HTTP errors) are retried:
+// the same payload would be rejected again.
+func (uid *UID) deliver(dest *uidDestination, result *UidFlushResult, policy uidRetryPolicy, metrics *Metrics) {
+	backoff := policy.backoff
+	for {
+		result.Attempts++
+		uidResult, err := dest.sink.SendUid(string(result.Payload))
+		result.Err = err
+		if uidResult != nil {
+			result.Status = uidResult.Status
+			result.Failures = uidResult.Failures
+			result.Rejected = err != nil
+		}
+		if err == nil || result.Rejected || result.Attempts > policy.retries {
+			return
+		}
+		uid.traceUnlocked("UID: flush to " + dest.name + " failed, retrying in " + backoff.String() + ": " + err.Error())
+		if metrics != nil {
+			metrics.ObserveRetry(dest.device, _TYPE_UID)
+		}
+		if !uid.sleep(backoff) {
+			return
+		}
+		if backoff *= 2; backoff > policy.maxBackoff {
+			backoff = policy.maxBackoff
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package gopanosapi
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink records the payloads it receives. The first failures calls fail with a communication
+// error and, if reject is set, the device rejects every payload.
+type fakeSink struct {
+	lock     sync.Mutex
+	payloads []string
+	failures int
+	reject   bool
+}
+
+func (sink *fakeSink) SendUid(payload string) (*UidResult, error) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.payloads = append(sink.payloads, payload)
+	if sink.failures > 0 {
+		sink.failures--
+		return nil, errors.New("connection refused")
+	}
+	if sink.reject {
+		return &UidResult{Status: STATUS_ERROR, Message: "invalid timeout"}, errors.New("uid-message rejected: invalid timeout")
+	}
+	return &UidResult{Status: STATUS_OK}, nil
+}
+
+func (sink *fakeSink) received() []string {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return append([]string(nil), sink.payloads...)
+}
+
+// startTestUID starts a synchronous UID on a manual clock sending to sink. configure (if not nil)
+// is called before starting it.
+func startTestUID(t *testing.T, sink UidSink, configure func(uid *UID)) (*UID, *ManualClock) {
+	t.Helper()
+	uid, err := NewUID(sink, UidName("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	uid.SetClock(clock)
+	uid.SetSynchronous(true)
+	if configure != nil {
+		configure(uid)
+	}
+	if err := uid.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { uid.Close(context.Background()) })
+	return uid, clock
+}
+
+func TestRejectedBatchIsNotRetried(t *testing.T) {
+	sink := &fakeSink{reject: true}
+	var deadLetters []UidFlushResult
+	uid, _ := startTestUID(t, sink, func(uid *UID) {
+		if err := uid.SetJournal(filepath.Join(t.TempDir(), "uid.journal")); err != nil {
+			t.Fatal(err)
+		}
+		uid.OnDeadLetter(func(result UidFlushResult) { deadLetters = append(deadLetters, result) })
+	})
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	results, err := uid.Flush(context.Background())
+	if err == nil || len(results) != 1 {
+		t.Fatalf("Flush() = %v, %v", results, err)
+	}
+	if !results[0].Rejected || results[0].Attempts != 1 {
+		t.Errorf("rejected batch: Rejected = %v, Attempts = %d", results[0].Rejected, results[0].Attempts)
+	}
+	if len(deadLetters) != 1 {
+		t.Errorf("%d dead letters, want 1", len(deadLetters))
+	}
+	// the journal must not queue the rejected batch again
+	if results, _ := uid.Flush(context.Background()); len(results) != 0 {
+		t.Errorf("rejected batch flushed again: %v", results)
+	}
+	if got := len(sink.received()); got != 1 {
+		t.Errorf("sink received %d payloads, want 1", got)
+	}
+}
+
+func TestUndeliveredBatchIsRequeued(t *testing.T) {
+	sink := &fakeSink{failures: 2}
+	var deadLetters []UidFlushResult
+	uid, _ := startTestUID(t, sink, func(uid *UID) {
+		if err := uid.SetJournal(filepath.Join(t.TempDir(), "uid.journal")); err != nil {
+			t.Fatal(err)
+		}
+		uid.SetRetryPolicy(1, time.Second, time.Second)
+		uid.OnDeadLetter(func(result UidFlushResult) { deadLetters = append(deadLetters, result) })
+	})
+	uid.AddLogin("acme\\bob", "10.0.0.1", time.Hour)
+	results, err := uid.Flush(context.Background())
+	if err == nil || len(results) != 1 || results[0].Rejected || results[0].Attempts != 2 {
+		t.Fatalf("Flush() = %+v, %v", results, err)
+	}
+	if len(deadLetters) != 1 {
+		t.Errorf("%d dead letters, want 1", len(deadLetters))
+	}
+	results, err = uid.Flush(context.Background())
+	if err != nil || len(results) != 1 || results[0].Payload == nil {
+		t.Fatalf("requeued Flush() = %+v, %v", results, err)
+	}
+	if payloads := sink.received(); len(payloads) != 3 || payloads[2] != payloads[0] {
+		t.Errorf("sink received %q", payloads)
+	}
+}
@@ -0,0 +1,290 @@
+// Package uidsyslog feeds User-ID login and logout events parsed from syslog messages to a UID batcher.
+//
+// A Listener receives syslog messages (RFC 3164 or RFC 5424) over UDP, TCP or TLS (newline delimited or
+// octet counted framing), matches them against a list of parse profiles and queues the events found:
+//
+//	var uid gopanosapi.UID
+//	uid.Init("firewall", "admin", "secret")
+//	profile, _ := uidsyslog.NewProfile("vpn", `login user=(?P<user>\S+) from (?P<ip>[\d.]+)`,
+//		`logout user=(?P<user>\S+) from (?P<ip>[\d.]+)`)
+//	listener := uidsyslog.NewListener(&uid)
+//	listener.AddProfile(profile)
+//	listener.ListenUDP(":514")
+package uidsyslog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+// Maximum size of a syslog message
+const _maxMessage = 64 * 1024
+
+// Sink receives the events extracted from the syslog messages (*gopanosapi.UID implements it)
+type Sink interface {
+	AddLogin(username, ipaddr string, timeout time.Duration)
+	AddLogout(username, ipaddr string)
+}
+
+var _ Sink = (*gopanosapi.UID)(nil)
+
+// Stats are the counters of a Listener
+type Stats struct {
+	// Messages received
+	Received uint64
+	// Messages matched by a profile as login or logout events
+	Logins, Logouts uint64
+	// Messages not matched by any profile
+	Unmatched uint64
+	// Read errors and messages exceeding the maximum size
+	Errors uint64
+}
+
+// Listener receives syslog messages and feeds the events matched by its profiles to a Sink
+type Listener struct {
+	stats    Stats
+	sink     Sink
+	lock     sync.Mutex
+	profiles []*Profile
+	timeout  time.Duration
+	closers  map[io.Closer]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewListener returns a Listener feeding sink. Profiles must be added before starting to listen.
+func NewListener(sink Sink) *Listener {
+	return &Listener{sink: sink, closers: make(map[io.Closer]struct{})}
+}
+
+// AddProfile adds a parse profile. Profiles are tried in the order they were added.
+func (l *Listener) AddProfile(profile *Profile) {
+	l.lock.Lock()
+	l.profiles = append(l.profiles, profile)
+	l.lock.Unlock()
+}
+
+// SetLoginTimeout sets the timeout of the logins queued (device default if zero)
+func (l *Listener) SetLoginTimeout(timeout time.Duration) {
+	l.lock.Lock()
+	l.timeout = timeout
+	l.lock.Unlock()
+}
+
+// Stats returns the current counters
+func (l *Listener) Stats() Stats {
+	return Stats{
+		Received:  atomic.LoadUint64(&l.stats.Received),
+		Logins:    atomic.LoadUint64(&l.stats.Logins),
+		Logouts:   atomic.LoadUint64(&l.stats.Logouts),
+		Unmatched: atomic.LoadUint64(&l.stats.Unmatched),
+		Errors:    atomic.LoadUint64(&l.stats.Errors),
+	}
+}
+
+// Handle parses a single syslog message and queues the event found (if any), which is returned
+func (l *Listener) Handle(data []byte) *Event {
+	atomic.AddUint64(&l.stats.Received, 1)
+	msg := Parse(data)
+	l.lock.Lock()
+	profiles, timeout := l.profiles, l.timeout
+	l.lock.Unlock()
+	for _, profile := range profiles {
+		event := profile.Match(msg)
+		if event == nil {
+			continue
+		}
+		if event.Login {
+			atomic.AddUint64(&l.stats.Logins, 1)
+			l.sink.AddLogin(event.User, event.Ip, timeout)
+		} else {
+			atomic.AddUint64(&l.stats.Logouts, 1)
+			l.sink.AddLogout(event.User, event.Ip)
+		}
+		return event
+	}
+	atomic.AddUint64(&l.stats.Unmatched, 1)
+	return nil
+}
+
+// track registers c to be closed by "Close()"
+func (l *Listener) track(c io.Closer) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		c.Close()
+		return false
+	}
+	l.closers[c] = struct{}{}
+	return true
+}
+
+func (l *Listener) untrack(c io.Closer) {
+	l.lock.Lock()
+	delete(l.closers, c)
+	l.lock.Unlock()
+	c.Close()
+}
+
+// ListenUDP receives syslog messages on the UDP address addr and returns the address actually bound
+func (l *Listener) ListenUDP(addr string) (net.Addr, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !l.track(conn) {
+		return nil, errors.New("listener closed")
+	}
+	l.wg.Add(1)
+	go l.servePackets(conn)
+	return conn.LocalAddr(), nil
+}
+
+// ListenTCP receives syslog messages on the TCP address addr and returns the address actually bound
+func (l *Listener) ListenTCP(addr string) (net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return l.serve(ln)
+}
+
+// ListenTLS receives syslog messages over TLS (RFC 5425) on the TCP address addr and returns the address
+// actually bound. Set config.ClientAuth to require client certificates.
+func (l *Listener) ListenTLS(addr string, config *tls.Config) (net.Addr, error) {
+	ln, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return l.serve(ln)
+}
+
+func (l *Listener) serve(ln net.Listener) (net.Addr, error) {
+	if !l.track(ln) {
+		return nil, errors.New("listener closed")
+	}
+	l.wg.Add(1)
+	go l.accept(ln)
+	return ln.Addr(), nil
+}
+
+// Close stops listening, closes the open connections and waits for the pending messages to be handled
+func (l *Listener) Close() error {
+	l.lock.Lock()
+	l.closed = true
+	for c := range l.closers {
+		c.Close()
+	}
+	l.lock.Unlock()
+	l.wg.Wait()
+	return nil
+}
+
+func (l *Listener) servePackets(conn net.PacketConn) {
+	defer l.wg.Done()
+	defer l.untrack(conn)
+	buf := make([]byte, _maxMessage)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			atomic.AddUint64(&l.stats.Errors, 1)
+			continue
+		}
+		l.Handle(buf[:n])
+	}
+}
+
+func (l *Listener) accept(ln net.Listener) {
+	defer l.wg.Done()
+	defer l.untrack(ln)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			atomic.AddUint64(&l.stats.Errors, 1)
+			continue
+		}
+		if !l.track(conn) {
+			return
+		}
+		l.wg.Add(1)
+		go l.serveConn(conn)
+	}
+}
+
+func (l *Listener) serveConn(conn net.Conn) {
+	defer l.wg.Done()
+	defer l.untrack(conn)
+	r := bufio.NewReaderSize(conn, _maxMessage)
+	for {
+		frame, err := readFrame(r)
+		if err == errTooLong {
+			atomic.AddUint64(&l.stats.Errors, 1)
+			continue
+		}
+		if len(frame) > 0 {
+			l.Handle(frame)
+		}
+		if err != nil {
+			if err != io.EOF && !isClosed(err) {
+				atomic.AddUint64(&l.stats.Errors, 1)
+			}
+			return
+		}
+	}
+}
+
+var errTooLong = errors.New("syslog message too long")
+
+// readFrame reads a message using octet counting ("LEN MSG", RFC 6587) or newline delimited framing
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		prefix, err := r.ReadSlice(' ')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(string(prefix[:len(prefix)-1]))
+		if err != nil || size > _maxMessage {
+			return nil, errors.New("invalid octet count " + string(prefix))
+		}
+		frame := make([]byte, size)
+		n, err := io.ReadFull(r, frame)
+		// a truncated message is returned without the zero padding
+		return frame[:n], err
+	}
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// skip the rest of the message
+		for err == bufio.ErrBufferFull {
+			_, err = r.ReadSlice('\n')
+		}
+		if err == nil {
+			err = errTooLong
+		}
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), err
+}
+
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,167 @@
+package uidsyslog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a Sink keeping the events received
+type recorder struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *recorder) AddLogin(username, ipaddr string, timeout time.Duration) {
+	r.lock.Lock()
+	r.events = append(r.events, "login "+username+" "+ipaddr+" "+timeout.String())
+	r.lock.Unlock()
+}
+
+func (r *recorder) AddLogout(username, ipaddr string) {
+	r.lock.Lock()
+	r.events = append(r.events, "logout "+username+" "+ipaddr)
+	r.lock.Unlock()
+}
+
+func (r *recorder) received() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	events := append([]string(nil), r.events...)
+	sort.Strings(events)
+	return events
+}
+
+// frames reads input with readFrame until an error, reporting the oversized messages as "<too long>"
+func frames(input string) ([]string, error) {
+	r := bufio.NewReaderSize(strings.NewReader(input), _maxMessage)
+	var read []string
+	for {
+		frame, err := readFrame(r)
+		if err == errTooLong {
+			read = append(read, "<too long>")
+			continue
+		}
+		if len(frame) > 0 {
+			read = append(read, string(frame))
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	for _, test := range []struct {
+		in     string
+		frames []string
+		err    string
+	}{
+		{in: "a\nb\n", frames: []string{"a", "b"}, err: "EOF"},
+		{in: "a\r\nb", frames: []string{"a", "b"}, err: "EOF"},
+		{in: "5 hello3 abc", frames: []string{"hello", "abc"}, err: "EOF"},
+		// octet counted messages may contain newlines and be mixed with newline delimited ones
+		{in: "7 a\nb\nc d<13>x\n", frames: []string{"a\nb\nc d", "<13>x"}, err: "EOF"},
+		{in: "<13>1 x\n", frames: []string{"<13>1 x"}, err: "EOF"},
+		{in: "10 abc", frames: []string{"abc"}, err: "unexpected EOF"},
+		{in: "99999999 x", err: "invalid octet count 99999999 "},
+		{in: "12x x", err: "invalid octet count 12x "},
+		{in: strings.Repeat("a", _maxMessage+10) + "\nb\n", frames: []string{"<too long>", "b"}, err: "EOF"},
+	} {
+		read, err := frames(test.in)
+		if !reflect.DeepEqual(read, test.frames) || err == nil || err.Error() != test.err {
+			t.Errorf("readFrame(%.20q) = %q, %v; want %q, %s", test.in, read, err, test.frames, test.err)
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	if _, err := NewProfile("bad", `login (?P<user>\S+)`, ""); err == nil {
+		t.Error("NewProfile() accepted an expression without ip")
+	}
+	if _, err := NewProfile("bad", "", `(`); err == nil {
+		t.Error("NewProfile() accepted an invalid expression")
+	}
+	p, err := NewProfile("vpn", `login user=(?:(?P<domain>\w+)/)?(?P<user>\S*) from (?P<ip>[\d.]+)`,
+		`logout user=(?P<user>\S+) from (?P<ip>[\d.]+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Domain, p.Hostname = "acme", "VPN1"
+	for _, test := range []struct {
+		hostname, content string
+		event             *Event
+	}{
+		{"vpn1", "login user=bob from 10.0.0.1", &Event{Login: true, User: "acme\\bob", Ip: "10.0.0.1", Profile: "vpn"}},
+		{"vpn1", "login user=corp/bob from 10.0.0.1", &Event{Login: true, User: "corp\\bob", Ip: "10.0.0.1", Profile: "vpn"}},
+		{"vpn1", "login user=bob@acme.com from 10.0.0.1", &Event{Login: true, User: "bob@acme.com", Ip: "10.0.0.1", Profile: "vpn"}},
+		{"vpn1", "logout user=bob from 10.0.0.1", &Event{User: "acme\\bob", Ip: "10.0.0.1", Profile: "vpn"}},
+		{"vpn1", "login user= from 10.0.0.1", nil},
+		{"vpn1", "session started", nil},
+		{"vpn2", "login user=bob from 10.0.0.1", nil},
+	} {
+		event := p.Match(Message{Hostname: test.hostname, Content: test.content})
+		if !reflect.DeepEqual(event, test.event) {
+			t.Errorf("Match(%s, %q) = %+v, want %+v", test.hostname, test.content, event, test.event)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	sink := &recorder{}
+	l := NewListener(sink)
+	p, err := NewProfile("vpn", `login user=(?P<user>\S+) from (?P<ip>[\d.]+)`, `logout user=(?P<user>\S+) from (?P<ip>[\d.]+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Domain = "acme"
+	l.AddProfile(p)
+	l.SetLoginTimeout(time.Hour)
+	udp, err := l.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := l.ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	send(t, "udp", udp, "<13>Oct 11 22:14:15 vpn1 vpnd: login user=bob from 10.0.0.1")
+	login := "<13>1 - vpn1 vpnd - - - login user=corp\\alice from 10.0.0.2"
+	send(t, "tcp", tcp, "<13>Oct 11 22:14:15 vpn1 vpnd: logout user=carol from 10.0.0.3\n"+
+		"<13>Oct 11 22:14:15 vpn1 vpnd: session started\n"+fmt.Sprintf("%d %s", len(login), login))
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Stats().Received < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.Close()
+	if stats := l.Stats(); stats != (Stats{Received: 4, Logins: 2, Logouts: 1, Unmatched: 1}) {
+		t.Errorf("Stats() = %+v", stats)
+	}
+	want := []string{"login acme\\bob 10.0.0.1 1h0m0s", "login corp\\alice 10.0.0.2 1h0m0s", "logout acme\\carol 10.0.0.3"}
+	if got := sink.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+	if _, err := l.ListenUDP("127.0.0.1:0"); err == nil {
+		t.Error("ListenUDP() accepted after Close()")
+	}
+}
+
+func send(t *testing.T, network string, addr net.Addr, data string) {
+	t.Helper()
+	conn, err := net.Dial(network, addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,127 @@
+package uidsyslog
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Message is a parsed syslog message (RFC 3164 or RFC 5424). Fields missing in the message are left empty.
+type Message struct {
+	Facility, Severity int
+	Timestamp          time.Time
+	Hostname, AppName  string
+	// Content is the free form part of the message (the one parse profiles are matched against)
+	Content string
+}
+
+// Parse parses a syslog message. Messages not following any of the RFCs are kept as Content.
+func Parse(data []byte) Message {
+	line := strings.TrimRight(string(data), "\r\n\x00")
+	if !utf8.ValidString(line) {
+		line = strings.ToValidUTF8(line, "?")
+	}
+	var msg Message
+	rest, ok := msg.parsePri(line)
+	if !ok {
+		msg.Content = line
+		return msg
+	}
+	if strings.HasPrefix(rest, "1 ") {
+		msg.parse5424(rest[2:])
+	} else {
+		msg.parse3164(rest)
+	}
+	return msg
+}
+
+func (msg *Message) parsePri(line string) (string, bool) {
+	end := strings.IndexByte(line, '>')
+	if !strings.HasPrefix(line, "<") || end < 2 || end > 4 {
+		return line, false
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return line, false
+	}
+	msg.Facility, msg.Severity = pri/8, pri%8
+	return line[end+1:], true
+}
+
+// parse3164 handles "Mmm dd hh:mm:ss hostname tag: content"
+func (msg *Message) parse3164(rest string) {
+	const stamp = "Jan _2 15:04:05"
+	if len(rest) > len(stamp) && rest[len(stamp)] == ' ' {
+		if ts, err := time.ParseInLocation(stamp, rest[:len(stamp)], time.Local); err == nil {
+			now := time.Now()
+			msg.Timestamp = ts.AddDate(now.Year(), 0, 0)
+			// messages from the last days of the previous year
+			if msg.Timestamp.After(now.AddDate(0, 1, 0)) {
+				msg.Timestamp = msg.Timestamp.AddDate(-1, 0, 0)
+			}
+			rest = rest[len(stamp)+1:]
+			if i := strings.IndexByte(rest, ' '); i > 0 {
+				msg.Hostname, rest = rest[:i], rest[i+1:]
+			}
+		}
+	}
+	// the tag ends at the first character not allowed in it (usually ':' or '[')
+	if i := strings.IndexAny(rest, ":[ "); i > 0 && rest[i] != ' ' {
+		msg.AppName = rest[:i]
+	}
+	msg.Content = rest
+}
+
+// parse5424 handles "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG"
+func (msg *Message) parse5424(rest string) {
+	fields := make([]string, 0, 5)
+	for len(fields) < 5 {
+		i := strings.IndexByte(rest, ' ')
+		if i < 0 {
+			fields, rest = append(fields, rest), ""
+			break
+		}
+		fields, rest = append(fields, rest[:i]), rest[i+1:]
+	}
+	for len(fields) < 5 {
+		fields = append(fields, "-")
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		msg.Timestamp = ts
+	}
+	msg.Hostname, msg.AppName = nilValue(fields[1]), nilValue(fields[2])
+	rest = skipStructuredData(rest)
+	msg.Content = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+}
+
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+// skipStructuredData returns what follows the STRUCTURED-DATA field
+func skipStructuredData(rest string) string {
+	if strings.HasPrefix(rest, "-") {
+		return rest[1:]
+	}
+	inElement, escaped := false, false
+	for i, r := range rest {
+		switch {
+		case escaped:
+			escaped = false
+		case inElement && r == '\\':
+			escaped = true
+		case inElement && r == ']':
+			inElement = false
+		case inElement:
+		case r == '[':
+			inElement = true
+		default:
+			return rest[i:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,50 @@
+package uidsyslog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		in                 string
+		facility, severity int
+		hostname, appName  string
+		content            string
+		timestamp          string
+	}{
+		{in: "<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick",
+			facility: 4, severity: 2, hostname: "mymachine", appName: "su",
+			content: "su: 'su root' failed for lonvick", timestamp: "10-11 22:14:15"},
+		{in: "<13>sshd[42]: accepted publickey",
+			facility: 1, severity: 5, appName: "sshd", content: "sshd[42]: accepted publickey"},
+		{in: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Appl\]ication"] ` + "\ufeff" + "An application event",
+			facility: 20, severity: 5, hostname: "mymachine.example.com", appName: "evntslog",
+			content: "An application event", timestamp: "10-11 22:14:15"},
+		{in: "<13>1 - - - - - - login user=bob from 10.0.0.1\r\n",
+			facility: 1, severity: 5, content: "login user=bob from 10.0.0.1"},
+		{in: "<13>1 2003-10-11T22:14:15Z host",
+			facility: 1, severity: 5, hostname: "host", timestamp: "10-11 22:14:15"},
+		// messages not following the RFCs are kept as they are
+		{in: "no pri at all\x00", content: "no pri at all"},
+		{in: "<192>out of range", content: "<192>out of range"},
+		{in: "<1x>not a number", content: "<1x>not a number"},
+		{in: "<13>invalid \xff utf-8", facility: 1, severity: 5, content: "invalid ? utf-8"},
+	} {
+		msg := Parse([]byte(test.in))
+		if msg.Facility != test.facility || msg.Severity != test.severity || msg.Hostname != test.hostname ||
+			msg.AppName != test.appName || msg.Content != test.content {
+			t.Errorf("Parse(%q) = %+v", test.in, msg)
+		}
+		timestamp := ""
+		if !msg.Timestamp.IsZero() {
+			timestamp = msg.Timestamp.UTC().Format("01-02 15:04:05")
+			if msg.Timestamp.Location() == time.Local {
+				timestamp = msg.Timestamp.Format("01-02 15:04:05")
+			}
+		}
+		if timestamp != test.timestamp {
+			t.Errorf("Parse(%q).Timestamp = %v, want %s", test.in, msg.Timestamp, test.timestamp)
+		}
+	}
+}
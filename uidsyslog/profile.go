@@ -0,0 +1,88 @@
+package uidsyslog
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Profile extracts login and logout events from syslog messages, like the syslog parse profiles of the
+// firewall. Login and Logout are matched against the message content and must define the named groups
+// "user" and "ip" (and optionally "domain"). Any of them may be nil.
+type Profile struct {
+	Name   string
+	Login  *regexp.Regexp
+	Logout *regexp.Regexp
+	// Domain is prepended to the user names without domain ("domain\user")
+	Domain string
+	// Hostname restricts the profile to the messages sent by this host (empty matches any host)
+	Hostname string
+}
+
+// Event is a login or logout extracted from a syslog message
+type Event struct {
+	Login    bool
+	User, Ip string
+	Profile  string
+}
+
+// NewProfile compiles the login and logout expressions of a profile. Empty expressions are not matched.
+func NewProfile(name, login, logout string) (*Profile, error) {
+	p := &Profile{Name: name}
+	var err error
+	if p.Login, err = compile(login); err != nil {
+		return nil, err
+	}
+	if p.Logout, err = compile(logout); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func compile(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("user") < 0 || re.SubexpIndex("ip") < 0 {
+		return nil, errors.New("expression " + expr + " must define the named groups user and ip")
+	}
+	return re, nil
+}
+
+// Match returns the event found in msg (nil if the profile does not match it)
+func (p *Profile) Match(msg Message) *Event {
+	if p.Hostname != "" && !strings.EqualFold(p.Hostname, msg.Hostname) {
+		return nil
+	}
+	if event := p.match(p.Login, msg.Content); event != nil {
+		event.Login = true
+		return event
+	}
+	return p.match(p.Logout, msg.Content)
+}
+
+func (p *Profile) match(re *regexp.Regexp, content string) *Event {
+	if re == nil {
+		return nil
+	}
+	m := re.FindStringSubmatch(content)
+	if m == nil {
+		return nil
+	}
+	event := &Event{Profile: p.Name, User: m[re.SubexpIndex("user")], Ip: m[re.SubexpIndex("ip")]}
+	if event.User == "" || event.Ip == "" {
+		return nil
+	}
+	domain := p.Domain
+	if i := re.SubexpIndex("domain"); i >= 0 && m[i] != "" {
+		domain = m[i]
+	}
+	if domain != "" && !strings.ContainsAny(event.User, "\\@") {
+		event.User = domain + "\\" + event.User
+	}
+	return event
+}
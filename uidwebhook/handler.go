@@ -0,0 +1,242 @@
+// Package uidwebhook provides an http.Handler feeding User-ID changes posted as JSON webhooks to a UID batcher.
+//
+// The default schema accepts a single event, an array of events or an object with an "events" array:
+//
+//	{"events": [
+//		{"type": "login", "user": "acme\\bob", "ip": "10.0.0.1", "timeout": "60"},
+//		{"type": "logout", "user": "acme\\bob", "ip": "10.0.0.1"},
+//		{"type": "register", "ip": "10.0.0.1", "tags": ["quarantine"], "timeout": "3600"},
+//		{"type": "unregister", "ip": "10.0.0.1", "tags": ["quarantine"]},
+//		{"type": "register-user", "user": "acme\\bob", "tags": ["risky"]},
+//		{"type": "unregister-user", "user": "acme\\bob", "tags": ["risky"]},
+//		{"type": "group-add", "group": "cn=vpn,dc=acme", "user": ["acme\\bob", "acme\\eve"]},
+//		{"type": "group-remove", "group": "cn=vpn,dc=acme", "user": "acme\\eve"}
+//	]}
+//
+// Login timeouts are numbers of minutes and tag registration timeouts numbers of seconds; both also accept
+// durations such as "90m" or "8h". Events with an invalid timeout are rejected.
+//
+// Other schemas are supported through a Mapping. Every request gets a JSON response with the number of
+// events accepted and the errors found in the rejected ones:
+//
+//	{"accepted": 7, "rejected": 1, "errors": ["event 3: login requires a user and an ip"]}
+package uidwebhook
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/gopanosapi"
+)
+
+// Maximum size of a request body (1 MiB)
+const _maxBody = 1 << 20
+
+// Sink receives the events posted (*gopanosapi.UID implements it)
+type Sink interface {
+	AddLogin(username, ipaddr string, timeout time.Duration)
+	AddLogout(username, ipaddr string)
+	AddGroupMember(group, member string)
+	RemoveGroupMember(group, member string)
+	RegisterTags(ipaddr string, timeout time.Duration, tags ...string)
+	UnregisterTags(ipaddr string, tags ...string)
+	RegisterUserTags(username string, timeout time.Duration, tags ...string)
+	UnregisterUserTags(username string, tags ...string)
+}
+
+var _ Sink = (*gopanosapi.UID)(nil)
+
+// Stats are the counters of a Handler
+type Stats struct {
+	// Requests received and requests rejected for lack of (valid) credentials
+	Requests, Unauthorized uint64
+	// Events accepted and rejected
+	Accepted, Rejected uint64
+}
+
+type response struct {
+	Accepted int      `json:"accepted"`
+	Rejected int      `json:"rejected"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// Handler is an http.Handler accepting User-ID events posted as JSON
+type Handler struct {
+	stats       Stats
+	sink        Sink
+	lock        sync.Mutex
+	mapping     Mapping
+	token       string
+	requireCert bool
+	clientNames map[string]struct{}
+}
+
+// NewHandler returns a Handler feeding sink with the default schema and no authentication
+func NewHandler(sink Sink) *Handler {
+	return &Handler{sink: sink}
+}
+
+// SetMapping changes where the event fields are found in the posted documents
+func (h *Handler) SetMapping(mapping Mapping) {
+	h.lock.Lock()
+	h.mapping = mapping
+	h.lock.Unlock()
+}
+
+// SetToken requires callers to provide token as "Authorization: Bearer <token>" or in the "X-Auth-Token" header
+func (h *Handler) SetToken(token string) {
+	h.lock.Lock()
+	h.token = token
+	h.lock.Unlock()
+}
+
+// RequireClientCert requires callers to present a TLS client certificate (mTLS). The server must verify it
+// (tls.Config.ClientAuth set to tls.RequireAndVerifyClientCert). If names are provided, the certificate
+// subject common name or one of its DNS names must be in the list.
+func (h *Handler) RequireClientCert(names ...string) {
+	h.lock.Lock()
+	h.requireCert = true
+	h.clientNames = make(map[string]struct{}, len(names))
+	for _, name := range names {
+		h.clientNames[strings.ToLower(name)] = struct{}{}
+	}
+	h.lock.Unlock()
+}
+
+// Stats returns the current counters
+func (h *Handler) Stats() Stats {
+	return Stats{
+		Requests:     atomic.LoadUint64(&h.stats.Requests),
+		Unauthorized: atomic.LoadUint64(&h.stats.Unauthorized),
+		Accepted:     atomic.LoadUint64(&h.stats.Accepted),
+		Rejected:     atomic.LoadUint64(&h.stats.Rejected),
+	}
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	h.lock.Lock()
+	token, requireCert, clientNames := h.token, h.requireCert, h.clientNames
+	h.lock.Unlock()
+	if token != "" {
+		provided := r.Header.Get("X-Auth-Token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			provided = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			return false
+		}
+	}
+	if requireCert {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return false
+		}
+		if len(clientNames) == 0 {
+			return true
+		}
+		cert := r.TLS.VerifiedChains[0][0]
+		if _, ok := clientNames[strings.ToLower(cert.Subject.CommonName)]; ok {
+			return true
+		}
+		for _, name := range cert.DNSNames {
+			if _, ok := clientNames[strings.ToLower(name)]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func reply(w http.ResponseWriter, status int, resp response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&h.stats.Requests, 1)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		reply(w, http.StatusMethodNotAllowed, response{Errors: []string{"only POST is allowed"}})
+		return
+	}
+	if !h.authorized(r) {
+		atomic.AddUint64(&h.stats.Unauthorized, 1)
+		reply(w, http.StatusUnauthorized, response{Errors: []string{"unauthorized"}})
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, _maxBody+1))
+	if err != nil {
+		reply(w, http.StatusBadRequest, response{Errors: []string{err.Error()}})
+		return
+	}
+	if len(body) > _maxBody {
+		reply(w, http.StatusRequestEntityTooLarge, response{Errors: []string{"request body too large"}})
+		return
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err = dec.Decode(&doc); err != nil {
+		reply(w, http.StatusBadRequest, response{Errors: []string{"invalid JSON: " + err.Error()}})
+		return
+	}
+	h.lock.Lock()
+	mapping := h.mapping
+	h.lock.Unlock()
+	var resp response
+	for i, object := range mapping.events(doc) {
+		event, problem := mapping.decode(object)
+		if problem != "" {
+			resp.Rejected++
+			resp.Errors = append(resp.Errors, "event "+strconv.Itoa(i)+": "+problem)
+			continue
+		}
+		h.apply(event)
+		resp.Accepted++
+	}
+	atomic.AddUint64(&h.stats.Accepted, uint64(resp.Accepted))
+	atomic.AddUint64(&h.stats.Rejected, uint64(resp.Rejected))
+	status := http.StatusOK
+	if resp.Accepted == 0 && resp.Rejected > 0 {
+		status = http.StatusBadRequest
+	}
+	reply(w, status, resp)
+}
+
+func (h *Handler) apply(event Event) {
+	switch event.Type {
+	case EVENT_LOGIN:
+		timeout, _ := event.LoginTimeout()
+		h.sink.AddLogin(event.Users[0], event.Ip, timeout)
+	case EVENT_LOGOUT:
+		h.sink.AddLogout(event.Users[0], event.Ip)
+	case EVENT_REGISTER:
+		timeout, _ := event.RegisterTimeout()
+		h.sink.RegisterTags(event.Ip, timeout, event.Tags...)
+	case EVENT_UNREGISTER:
+		h.sink.UnregisterTags(event.Ip, event.Tags...)
+	case EVENT_REGISTER_USER:
+		timeout, _ := event.RegisterTimeout()
+		h.sink.RegisterUserTags(event.Users[0], timeout, event.Tags...)
+	case EVENT_UNREGISTER_USER:
+		h.sink.UnregisterUserTags(event.Users[0], event.Tags...)
+	case EVENT_GROUP_ADD:
+		for _, user := range event.Users {
+			h.sink.AddGroupMember(event.Group, user)
+		}
+	case EVENT_GROUP_REMOVE:
+		for _, user := range event.Users {
+			h.sink.RemoveGroupMember(event.Group, user)
+		}
+	}
+}
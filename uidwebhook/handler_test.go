@@ -0,0 +1,80 @@
+package uidwebhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recorder is a Sink recording the events applied
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) AddLogin(username, ipaddr string, timeout time.Duration) {
+	r.events = append(r.events, fmt.Sprint("login ", username, " ", ipaddr, " ", timeout))
+}
+func (r *recorder) AddLogout(username, ipaddr string) {
+	r.events = append(r.events, fmt.Sprint("logout ", username, " ", ipaddr))
+}
+func (r *recorder) AddGroupMember(group, member string)    {}
+func (r *recorder) RemoveGroupMember(group, member string) {}
+func (r *recorder) RegisterTags(ipaddr string, timeout time.Duration, tags ...string) {
+	r.events = append(r.events, fmt.Sprint("register ", ipaddr, " ", timeout, " ", tags))
+}
+func (r *recorder) UnregisterTags(ipaddr string, tags ...string) {}
+func (r *recorder) RegisterUserTags(username string, timeout time.Duration, tags ...string) {
+	r.events = append(r.events, fmt.Sprint("register-user ", username, " ", timeout, " ", tags))
+}
+func (r *recorder) UnregisterUserTags(username string, tags ...string) {}
+
+func post(h http.Handler, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	return w
+}
+
+func TestRegisterTimeout(t *testing.T) {
+	sink := &recorder{}
+	h := NewHandler(sink)
+	w := post(h, `[{"type": "register", "ip": "10.0.0.1", "tags": ["a"], "timeout": 90},
+		{"type": "register", "ip": "10.0.0.2", "tags": ["b"], "timeout": "2h"},
+		{"type": "register-user", "user": "acme\\bob", "tags": ["c"]}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	want := []string{"register 10.0.0.1 1m30s [a]", "register 10.0.0.2 2h0m0s [b]", "register-user acme\\bob 0s [c]"}
+	if fmt.Sprint(sink.events) != fmt.Sprint(want) {
+		t.Errorf("events = %q, want %q", sink.events, want)
+	}
+	for _, body := range []string{
+		`{"type": "register", "ip": "10.0.0.1", "tags": ["a"], "timeout": "soon"}`,
+		`{"type": "register-user", "user": "acme\\bob", "tags": ["a"], "timeout": -5}`,
+	} {
+		if w := post(h, body); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid timeout") {
+			t.Errorf("%s: status %d: %s", body, w.Code, w.Body)
+		}
+	}
+	if len(sink.events) != 3 {
+		t.Errorf("invalid events applied: %q", sink.events[3:])
+	}
+}
+
+func TestMethodCheckedBeforeAuth(t *testing.T) {
+	h := NewHandler(&recorder{})
+	h.SetToken("secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET without token: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+	if w := post(h, `{"type": "logout", "user": "acme\\bob", "ip": "10.0.0.1"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST without token: status %d", w.Code)
+	}
+	if stats := h.Stats(); stats.Unauthorized != 1 {
+		t.Errorf("Unauthorized = %d, want 1", stats.Unauthorized)
+	}
+}
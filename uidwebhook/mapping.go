@@ -0,0 +1,187 @@
+package uidwebhook
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event types
+const (
+	EVENT_LOGIN           = "login"
+	EVENT_LOGOUT          = "logout"
+	EVENT_REGISTER        = "register"
+	EVENT_UNREGISTER      = "unregister"
+	EVENT_REGISTER_USER   = "register-user"
+	EVENT_UNREGISTER_USER = "unregister-user"
+	EVENT_GROUP_ADD       = "group-add"
+	EVENT_GROUP_REMOVE    = "group-remove"
+)
+
+// Mapping tells where the event fields are found in the JSON objects posted. Paths use dots to descend
+// into nested objects ("data.actor.name"). Empty paths use the field names of the default schema.
+type Mapping struct {
+	Type, User, Ip, Timeout, Group, Tags string
+	// Types translates the values found in the Type field into event types (i.e. "session.start": EVENT_LOGIN)
+	Types map[string]string
+	// DefaultType is used if the type field is missing (i.e. for endpoints only receiving logins)
+	DefaultType string
+	// Events is the path of the array of events in the posted document ("events" by default).
+	// Documents without it are handled as a single event or an array of events.
+	Events string
+}
+
+// Event is a User-ID change decoded from a webhook
+type Event struct {
+	Type    string
+	Users   []string
+	Ip      string
+	Timeout string
+	Group   string
+	Tags    []string
+}
+
+// LoginTimeout returns the timeout of a login event: an integer number of minutes or
+// a duration ("90m", "8h"). Empty means the device default (zero).
+func (event *Event) LoginTimeout() (time.Duration, error) {
+	if event.Timeout == "" {
+		return 0, nil
+	}
+	if minutes, err := strconv.Atoi(event.Timeout); err == nil && minutes >= 0 {
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	timeout, err := time.ParseDuration(event.Timeout)
+	if err == nil && timeout < 0 {
+		err = errors.New("negative timeout")
+	}
+	return timeout, err
+}
+
+// RegisterTimeout returns the timeout of a tag registration event: an integer number of seconds or
+// a duration ("90s", "24h"). Empty means tags that never expire (zero).
+func (event *Event) RegisterTimeout() (time.Duration, error) {
+	if event.Timeout == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(event.Timeout); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	timeout, err := time.ParseDuration(event.Timeout)
+	if err == nil && timeout < 0 {
+		err = errors.New("negative timeout")
+	}
+	return timeout, err
+}
+
+func orDefault(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path
+}
+
+// lookup returns the value found at path in doc (nil if missing)
+func lookup(doc interface{}, path string) interface{} {
+	for _, key := range strings.Split(path, ".") {
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if doc, ok = object[key]; !ok {
+			return nil
+		}
+	}
+	return doc
+}
+
+// text returns a scalar JSON value as a string
+func text(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	}
+	return ""
+}
+
+// texts returns a JSON value (either a scalar or an array of scalars) as a list of strings
+func texts(value interface{}) []string {
+	var list []string
+	if array, ok := value.([]interface{}); ok {
+		for _, item := range array {
+			if s := text(item); s != "" {
+				list = append(list, s)
+			}
+		}
+	} else if s := text(value); s != "" {
+		list = append(list, s)
+	}
+	return list
+}
+
+// events returns the objects of a posted document
+func (m *Mapping) events(doc interface{}) []interface{} {
+	if list, ok := lookup(doc, orDefault(m.Events, "events")).([]interface{}); ok {
+		return list
+	}
+	if list, ok := doc.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{doc}
+}
+
+// decode extracts an event from a JSON object using the mapping
+func (m *Mapping) decode(object interface{}) (Event, string) {
+	event := Event{
+		Type:    text(lookup(object, orDefault(m.Type, "type"))),
+		Users:   texts(lookup(object, orDefault(m.User, "user"))),
+		Ip:      text(lookup(object, orDefault(m.Ip, "ip"))),
+		Timeout: text(lookup(object, orDefault(m.Timeout, "timeout"))),
+		Group:   text(lookup(object, orDefault(m.Group, "group"))),
+		Tags:    texts(lookup(object, orDefault(m.Tags, "tags"))),
+	}
+	if event.Type == "" {
+		event.Type = m.DefaultType
+	}
+	if translated, ok := m.Types[event.Type]; ok {
+		event.Type = translated
+	}
+	switch event.Type {
+	case EVENT_LOGIN, EVENT_LOGOUT:
+		if len(event.Users) != 1 || event.Ip == "" {
+			return event, event.Type + " requires a user and an ip"
+		}
+		if _, err := event.LoginTimeout(); err != nil && event.Type == EVENT_LOGIN {
+			return event, "invalid timeout \"" + event.Timeout + "\""
+		}
+	case EVENT_REGISTER, EVENT_UNREGISTER:
+		if event.Ip == "" || len(event.Tags) == 0 {
+			return event, event.Type + " requires an ip and tags"
+		}
+		if _, err := event.RegisterTimeout(); err != nil && event.Type == EVENT_REGISTER {
+			return event, "invalid timeout \"" + event.Timeout + "\""
+		}
+	case EVENT_REGISTER_USER, EVENT_UNREGISTER_USER:
+		if len(event.Users) != 1 || len(event.Tags) == 0 {
+			return event, event.Type + " requires a user and tags"
+		}
+		if _, err := event.RegisterTimeout(); err != nil && event.Type == EVENT_REGISTER_USER {
+			return event, "invalid timeout \"" + event.Timeout + "\""
+		}
+	case EVENT_GROUP_ADD, EVENT_GROUP_REMOVE:
+		if event.Group == "" || len(event.Users) == 0 {
+			return event, event.Type + " requires a group and users"
+		}
+	default:
+		return event, "unknown event type \"" + event.Type + "\""
+	}
+	return event, ""
+}